@@ -0,0 +1,528 @@
+package filter
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Expr is a node of the tree of a filter, one of *And, *Or, *Not, *Prefix,
+// *Netmask, *Range, *Port, *Proto and *Name.
+type Expr interface {
+	// Source returns the span of the node in the filter it was parsed from.
+	Source() Span
+	// String returns the node as a filter string, which compiles back to it.
+	String() string
+	expr()
+}
+
+// Span is the byte offsets [Pos, End) of a node in the filter it was parsed
+// from, a value qualified by src, dst, host or net spans its qualifiers too.
+// A node built by hand has the zero span.
+type Span struct {
+	Pos int
+	End int
+}
+
+func (s Span) Source() Span {
+	return s
+}
+
+// Dir is the direction qualifier of a Prefix, a Netmask, a Range or a Port, a value without one
+// matches either the source or the destination.
+type Dir int
+
+const (
+	DirAny Dir = dir_any
+	DirSrc Dir = dir_src
+	DirDst Dir = dir_dst
+)
+
+// Kind is the type qualifier of a Prefix, a Netmask or a Range, a host must
+// be a full address.
+type Kind int
+
+const (
+	KindAny  Kind = kind_any
+	KindHost Kind = kind_host
+	KindNet  Kind = kind_net
+)
+
+// And matches if both X and Y match.
+type And struct {
+	Span
+	X Expr
+	Y Expr
+}
+
+// Or matches if either X or Y matches.
+type Or struct {
+	Span
+	X Expr
+	Y Expr
+}
+
+// Not matches if X does not match.
+type Not struct {
+	Span
+	X Expr
+}
+
+// Prefix matches an address in Prefix, an ipv4 prefix only matches ipv4
+// addresses and a v4-mapped ipv6 prefix of 96 bits or more is the ipv4
+// prefix it maps.
+type Prefix struct {
+	Span
+	Dir    Dir
+	Kind   Kind
+	Prefix netip.Prefix
+}
+
+// Netmask matches an address whose bits under Mask are those of Addr, Mask
+// is of the family of Addr and need not be a prefix mask, as the wildcard
+// 10.*.3.* is 10.0.3.0 with the mask 255.0.255.0.
+type Netmask struct {
+	Span
+	Dir  Dir
+	Kind Kind
+	Addr netip.Addr
+	Mask netip.Addr
+}
+
+// Range matches an address in First~Last, which are both ipv4 or both ipv6
+// addresses, an ipv6 range never matches an ipv4 address.
+type Range struct {
+	Span
+	Dir   Dir
+	Kind  Kind
+	First netip.Addr
+	Last  netip.Addr
+}
+
+// Port matches a tcp, udp or sctp port in Lo~Hi, Range tells a portrange
+// from a port, whose Lo and Hi are the same.
+type Port struct {
+	Span
+	Dir   Dir
+	Lo    uint16
+	Hi    uint16
+	Range bool
+}
+
+// Proto matches the ip protocol Proto, of ipv4 packets only if Family is 4,
+// of ipv6 packets only if it is 6, and of either if it is 0.
+type Proto struct {
+	Span
+	Family int
+	Proto  uint8
+}
+
+// Name is a set, as @office or the built-in private, or a macro, as $web,
+// as written in the filter. The trees of Parse and Expr have the names
+// expanded, Format keeps them.
+type Name struct {
+	Span
+	Dir  Dir
+	Kind Kind
+	Name string
+}
+
+func (*And) expr()     {}
+func (*Or) expr()      {}
+func (*Not) expr()     {}
+func (*Prefix) expr()  {}
+func (*Netmask) expr() {}
+func (*Range) expr()   {}
+func (*Port) expr()    {}
+func (*Proto) expr()   {}
+func (*Name) expr()    {}
+
+var (
+	ErrNilExpr = errors.New("nil expression")
+	ErrExpr    = errors.New("malformed expression")
+)
+
+// ExprError records a node which can not be compiled, Err is ErrNilExpr,
+// ErrExpr or one of the sentinels of ParseError.
+type ExprError struct {
+	Expr Expr
+	Err  error
+}
+
+func (e *ExprError) Error() string {
+	if e.Expr == nil {
+		return "compile expression: " + e.Err.Error()
+	}
+	return "compile expression " + strconv.Quote(e.Expr.String()) + ": " + e.Err.Error()
+}
+
+func (e *ExprError) Unwrap() error {
+	return e.Err
+}
+
+// Parse parses filter into its tree, with the errors of Compile.
+func Parse(filter string) (Expr, error) {
+	return ParseEnv(filter, nil)
+}
+
+// ParseEnv parses filter as Parse does, with the names of env expanded in
+// the tree, each node of a name spans the name.
+func ParseEnv(filter string, env *EnvT) (Expr, error) {
+	rpn, err := compile(filter, HostDefault, env, nil)
+	if err != nil {
+		return nil, err
+	}
+	tokens, _ := tokenize(filter, HostDefault)
+	return exprOf(toExpr(rpn), newSpans(tokens, filter, HostDefault)), nil
+}
+
+// namedExpr parses filter into its tree with the names kept as Name nodes
+func namedExpr(filter string, mode HostMode) (Expr, error) {
+	tokens, err := tokenize(filter, mode)
+	if err != nil {
+		return nil, err
+	}
+	rpn, err := toRPN(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return exprOf(toExpr(rpn), newSpans(tokens, filter, mode)), nil
+}
+
+// Expr returns the tree of the compiled filter, or nil if it is not compiled.
+func (f *FilterT) Expr() Expr {
+	if !f.OK() {
+		return nil
+	}
+	tokens, _ := tokenize(f.filter, f.Mode)
+	return exprOf(toExpr(f.rpn), newSpans(tokens, f.filter, f.Mode))
+}
+
+// CompileExpr compiles the tree e, the filter becomes e.String(). As Compile,
+// it keeps the filter if e can not be compiled. A *Name node of a set or a
+// macro is undefined, see CompileExprEnv.
+func (f *FilterT) CompileExpr(e Expr) error {
+	return f.CompileExprEnv(e, nil)
+}
+
+// CompileExprEnv compiles the tree e as CompileExpr does, with the names of
+// env for its *Name nodes.
+func (f *FilterT) CompileExprEnv(e Expr, env *EnvT) error {
+	if err := checkExpr(e); err != nil {
+		return err
+	}
+	return f.CompileEnv(e.String(), env)
+}
+
+// Walk calls fn for e and then, unless fn returns false, for each of its
+// operands, depth first.
+func Walk(e Expr, fn func(Expr) bool) {
+	if e == nil || !fn(e) {
+		return
+	}
+	switch e := e.(type) {
+	case *And:
+		Walk(e.X, fn)
+		Walk(e.Y, fn)
+	case *Or:
+		Walk(e.X, fn)
+		Walk(e.Y, fn)
+	case *Not:
+		Walk(e.X, fn)
+	}
+}
+
+// Rewrite rewrites the operands of e and then e itself with fn, which
+// returns the node replacing the one it is given, or that node to keep it.
+// The nodes of e are not changed, a node whose operands are replaced is
+// copied first.
+func Rewrite(e Expr, fn func(Expr) Expr) Expr {
+	switch n := e.(type) {
+	case *And:
+		if x, y := Rewrite(n.X, fn), Rewrite(n.Y, fn); x != n.X || y != n.Y {
+			copied := *n
+			copied.X, copied.Y = x, y
+			e = &copied
+		}
+	case *Or:
+		if x, y := Rewrite(n.X, fn), Rewrite(n.Y, fn); x != n.X || y != n.Y {
+			copied := *n
+			copied.X, copied.Y = x, y
+			e = &copied
+		}
+	case *Not:
+		if x := Rewrite(n.X, fn); x != n.X {
+			copied := *n
+			copied.X = x
+			e = &copied
+		}
+	}
+	if e == nil {
+		return nil
+	}
+	return fn(e)
+}
+
+func (e *And) String() string     { return exprString(e) }
+func (e *Or) String() string      { return exprString(e) }
+func (e *Not) String() string     { return exprString(e) }
+func (e *Prefix) String() string  { return exprString(e) }
+func (e *Netmask) String() string { return exprString(e) }
+func (e *Range) String() string   { return exprString(e) }
+func (e *Port) String() string    { return exprString(e) }
+func (e *Proto) String() string   { return exprString(e) }
+func (e *Name) String() string    { return exprString(e) }
+
+func exprString(e Expr) string {
+	var b strings.Builder
+	writeExpr(&b, e)
+	return b.String()
+}
+
+// writeExpr writes e with the brackets its precedence needs, and and or
+// are of the same precedence and left associative
+func writeExpr(b *strings.Builder, e Expr) {
+	switch e := e.(type) {
+	case *And:
+		writeBinary(b, e.X, tokenOut[token_and], e.Y)
+	case *Or:
+		writeBinary(b, e.X, tokenOut[token_or], e.Y)
+	case *Not:
+		b.WriteString(tokenOut[token_not] + " ")
+		writeOperand(b, e.X)
+	case nil:
+		b.WriteString("<nil>")
+	case *Name:
+		token, err := tokenOf(e)
+		if err != nil {
+			b.WriteString("<" + errors.Unwrap(err).Error() + ">")
+			return
+		}
+		b.WriteString(outputQualifiers(token) + e.Name)
+	default:
+		token, err := tokenOf(e)
+		if err != nil {
+			b.WriteString("<" + errors.Unwrap(err).Error() + ">")
+			return
+		}
+		b.WriteString(outputValue(token))
+	}
+}
+
+func writeBinary(b *strings.Builder, x Expr, op string, y Expr) {
+	writeExpr(b, x)
+	b.WriteString(" " + op + " ")
+	writeOperand(b, y)
+}
+
+func writeOperand(b *strings.Builder, e Expr) {
+	switch e.(type) {
+	case *And, *Or:
+		b.WriteString(tokenOut[token_left])
+		writeExpr(b, e)
+		b.WriteString(tokenOut[token_right])
+	default:
+		writeExpr(b, e)
+	}
+}
+
+// checkExpr returns the first node of e which can not be compiled
+func checkExpr(e Expr) error {
+	if e == nil {
+		return &ExprError{Err: ErrNilExpr}
+	}
+	var err error
+	Walk(e, func(e Expr) bool {
+		if err != nil {
+			return false
+		}
+		switch n := e.(type) {
+		case *And:
+			if n.X == nil || n.Y == nil {
+				err = &ExprError{Expr: e, Err: ErrNilExpr}
+			}
+		case *Or:
+			if n.X == nil || n.Y == nil {
+				err = &ExprError{Expr: e, Err: ErrNilExpr}
+			}
+		case *Not:
+			if n.X == nil {
+				err = &ExprError{Expr: e, Err: ErrNilExpr}
+			}
+		default:
+			_, err = tokenOf(e)
+		}
+		return err == nil
+	})
+	return err
+}
+
+// tokenOf converts a value node to its token
+func tokenOf(e Expr) (tokenT, error) {
+	switch n := e.(type) {
+	case *Prefix:
+		if !n.Prefix.IsValid() || n.Dir < DirAny || n.Dir > DirDst || n.Kind < KindAny || n.Kind > KindNet {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrExpr}
+		}
+		token := tokenT{t: token_value, pos: n.Pos, dir: int(n.Dir), kind: int(n.Kind), cidr: cidrFromPrefix(n.Prefix)}
+		if n.Kind == KindHost && !n.Prefix.IsSingleIP() {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrHost}
+		}
+		return token, nil
+	case *Netmask:
+		if !n.Addr.IsValid() || !n.Mask.IsValid() || n.Dir < DirAny || n.Dir > DirDst || n.Kind < KindAny || n.Kind > KindNet {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrExpr}
+		} else if n.Addr.Is4() != n.Mask.Is4() {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrNetmask}
+		}
+		token := tokenT{t: token_value, pos: n.Pos, dir: int(n.Dir), kind: int(n.Kind), cidr: cidrFromNetmask(n.Addr, n.Mask)}
+		if m, _ := maskLen(token.cidr.mask); n.Kind == KindHost && m != 128 {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrHost}
+		}
+		return token, nil
+	case *Range:
+		if !n.First.IsValid() || !n.Last.IsValid() || n.Dir < DirAny || n.Dir > DirDst || n.Kind < KindAny || n.Kind > KindNet {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrExpr}
+		} else if n.Kind == KindHost {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrHost}
+		}
+		first, last := HostFromAddr(n.First).ip, HostFromAddr(n.Last).ip
+		if first.isV4() != last.isV4() || last.less(first) {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrRange}
+		}
+		cidr := cidrT{ip: first, last: last, isRange: true}
+		return tokenT{t: token_value, pos: n.Pos, dir: int(n.Dir), kind: int(n.Kind), cidr: cidr}, nil
+	case *Port:
+		if n.Dir < DirAny || n.Dir > DirDst || (!n.Range && n.Lo != n.Hi) {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrExpr}
+		} else if n.Lo > n.Hi {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrPortRange}
+		}
+		token := tokenT{t: token_value, pos: n.Pos, dir: int(n.Dir), kind: kind_port, ports: portsT{lo: int(n.Lo), hi: int(n.Hi)}}
+		if n.Range {
+			token.kind = kind_portrange
+		}
+		return token, nil
+	case *Name:
+		if n.Name == "" || n.Dir < DirAny || n.Dir > DirDst || n.Kind < KindAny || n.Kind > KindNet {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrExpr}
+		}
+		token, end, err := lex(&n.Name, 0, HostDefault)
+		if err != nil || end != len(n.Name) || (token.t != token_set && token.t != token_macro) {
+			return tokenT{}, &ExprError{Expr: e, Err: ErrExpr}
+		}
+		token.pos, token.dir, token.kind = n.Pos, int(n.Dir), int(n.Kind)
+		return token, nil
+	case *Proto:
+		token := tokenT{t: token_value, pos: n.Pos, kind: kind_proto, proto: int(n.Proto)}
+		switch n.Family {
+		case 0:
+		case 4:
+			token.kind = kind_proto4
+		case 6:
+			token.kind = kind_proto6
+		default:
+			return tokenT{}, &ExprError{Expr: e, Err: ErrExpr}
+		}
+		return token, nil
+	}
+	return tokenT{}, &ExprError{Expr: e, Err: ErrExpr}
+}
+
+// spansT finds the spans of the nodes of a filter from its tokens
+type spansT struct {
+	filter   string
+	mode     HostMode
+	starts   map[int]int   // value position to the first qualifier before it
+	brackets map[Span]Span // span in brackets to the span with them
+}
+
+func newSpans(tokens []tokenT, filter string, mode HostMode) *spansT {
+	spans := &spansT{filter: filter, mode: mode, starts: map[int]int{}, brackets: map[Span]Span{}}
+	var lefts []int
+	for i, token := range tokens {
+		switch token.t {
+		case token_value, token_set, token_macro:
+			start := i
+			for ; start > 0 && isQualifier(tokens[start-1].t); start-- {
+			}
+			spans.starts[token.pos] = tokens[start].pos
+		case token_left:
+			lefts = append(lefts, i)
+		case token_right:
+			if len(lefts) == 0 {
+				break
+			}
+			left := lefts[len(lefts)-1]
+			lefts = lefts[:len(lefts)-1]
+			if left+1 < i {
+				inner := Span{Pos: tokens[left+1].pos, End: spans.end(tokens[i-1].pos)}
+				spans.brackets[inner] = Span{Pos: tokens[left].pos, End: spans.end(token.pos)}
+			}
+		}
+	}
+	return spans
+}
+
+// end returns the end of the token at pos, or pos without spans
+func (spans *spansT) end(pos int) int {
+	if spans == nil {
+		return pos
+	}
+	_, end, _ := lex(&spans.filter, pos, spans.mode)
+	return end
+}
+
+// span returns s with the brackets around it
+func (spans *spansT) span(s Span) Span {
+	for spans != nil {
+		bracketed, found := spans.brackets[s]
+		if !found {
+			return s
+		}
+		s = bracketed
+	}
+	return s
+}
+
+// exprOf converts e to its tree, without spans the nodes span their
+// positions only
+func exprOf(e *exprT, spans *spansT) Expr {
+	switch e.token.t {
+	case token_and:
+		x, y := exprOf(e.x, spans), exprOf(e.y, spans)
+		return &And{Span: spans.span(Span{Pos: x.Source().Pos, End: y.Source().End}), X: x, Y: y}
+	case token_or:
+		x, y := exprOf(e.x, spans), exprOf(e.y, spans)
+		return &Or{Span: spans.span(Span{Pos: x.Source().Pos, End: y.Source().End}), X: x, Y: y}
+	case token_not:
+		x := exprOf(e.x, spans)
+		return &Not{Span: spans.span(Span{Pos: e.token.pos, End: x.Source().End}), X: x}
+	}
+	token := e.token
+	span := Span{Pos: token.pos, End: spans.end(token.pos)}
+	if spans == nil {
+	} else if start, found := spans.starts[token.pos]; found {
+		span.Pos = start
+	}
+	span = spans.span(span)
+	if token.t == token_set || token.t == token_macro {
+		return &Name{Span: span, Dir: Dir(token.dir), Kind: Kind(token.kind), Name: spans.filter[token.pos:spans.end(token.pos)]}
+	}
+	switch token.kind {
+	case kind_port, kind_portrange:
+		return &Port{Span: span, Dir: Dir(token.dir), Lo: uint16(token.ports.lo), Hi: uint16(token.ports.hi), Range: token.kind == kind_portrange}
+	case kind_proto, kind_proto4, kind_proto6:
+		family := map[int]int{kind_proto: 0, kind_proto4: 4, kind_proto6: 6}[token.kind]
+		return &Proto{Span: span, Family: family, Proto: uint8(token.proto)}
+	}
+	if _, ok := maskLen(token.cidr.mask); !ok && !token.cidr.isRange {
+		addr, mask := token.cidr.netmask()
+		return &Netmask{Span: span, Dir: Dir(token.dir), Kind: Kind(token.kind), Addr: addr, Mask: mask}
+	} else if token.cidr.isRange {
+		first, last := HostT{ip: token.cidr.ip}.Addr(), HostT{ip: token.cidr.last}.Addr()
+		return &Range{Span: span, Dir: Dir(token.dir), Kind: Kind(token.kind), First: first, Last: last}
+	}
+	return &Prefix{Span: span, Dir: Dir(token.dir), Kind: Kind(token.kind), Prefix: token.cidr.prefix()}
+}
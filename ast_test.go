@@ -0,0 +1,239 @@
+package filter
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	filter := "src net 10 and not (dst port 80 or ip6 proto 17)  or\t2001:db8::/32"
+	e, err := Parse(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &Or{
+		Span: Span{0, 66},
+		X: &And{
+			Span: Span{0, 48},
+			X:    &Prefix{Span: Span{0, 10}, Dir: DirSrc, Kind: KindNet, Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+			Y: &Not{
+				Span: Span{15, 48},
+				X: &Or{
+					Span: Span{19, 48},
+					X:    &Port{Span: Span{20, 31}, Dir: DirDst, Lo: 80, Hi: 80},
+					Y:    &Proto{Span: Span{35, 47}, Family: 6, Proto: 17},
+				},
+			},
+		},
+		Y: &Prefix{Span: Span{53, 66}, Prefix: netip.MustParsePrefix("2001:db8::/32")},
+	}
+	if !reflect.DeepEqual(e, expect) {
+		t.Errorf("Parse(%q): expect %s, got %s", filter, expect, e)
+	}
+	Walk(e, func(e Expr) bool {
+		span := e.Source()
+		if _, err := Parse(filter[span.Pos:span.End]); err != nil {
+			t.Errorf("span %v of %s is %q", span, e, filter[span.Pos:span.End])
+		}
+		return true
+	})
+
+	if _, err := Parse("10 and"); !errors.Is(err, ErrNoValues) {
+		t.Errorf("expect ErrNoValues, got %v", err)
+	}
+
+	f := FilterT{}
+	if f.Expr() != nil {
+		t.Error("expect no tree before compile")
+	}
+	if err := f.Compile(filter); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.Expr(), expect) {
+		t.Errorf("Expr(): expect %s, got %s", expect, f.Expr())
+	}
+}
+
+func TestExprString(t *testing.T) {
+	for filter, expect := range map[string]string{
+		"10":                                 "10.0.0.0/8",
+		"10 or 11 and 12":                    "10.0.0.0/8 or 11.0.0.0/8 and 12.0.0.0/8",
+		"10 or (11 and 12)":                  "10.0.0.0/8 or (11.0.0.0/8 and 12.0.0.0/8)",
+		"((10 or 11)) and 12":                "10.0.0.0/8 or 11.0.0.0/8 and 12.0.0.0/8",
+		"not not (10 or 11)":                 "not not (10.0.0.0/8 or 11.0.0.0/8)",
+		"!host 1.2.3.4 && dst portrange 1-2": "not host 1.2.3.4/32 and dst portrange 1-2",
+		"tcp or proto 132 or ip proto 1":     "tcp or proto 132 or ip proto 1",
+		"dst fe80::1/64":                     "dst fe80::1/64",
+		"::ffff:10.0.0.0/104":                "10.0.0.0/8",
+	} {
+		e, err := Parse(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.String(); got != expect {
+			t.Errorf("Parse(%q).String(): expect %q, got %q", filter, expect, got)
+		}
+		f, g := FilterT{}, FilterT{}
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.CompileExpr(e); err != nil {
+			t.Fatal(err)
+		}
+		if g.GetFilter() != expect || !compareTokens(clearPos(f.rpn), clearPos(g.rpn)) {
+			t.Errorf("CompileExpr(%s): expect rpn %s, got %s", expect, f.GetRPN(), g.GetRPN())
+		}
+	}
+}
+
+func TestCompileExpr(t *testing.T) {
+	f := FilterT{}
+	e := &Or{
+		X: &And{
+			X: &Or{
+				X: &Prefix{Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+				Y: &Prefix{Kind: KindHost, Dir: DirSrc, Prefix: netip.MustParsePrefix("2001:db8::1/128")},
+			},
+			Y: &Not{X: &Or{
+				X: &Port{Lo: 20, Hi: 21, Range: true},
+				Y: &Range{Dir: DirDst, First: netip.MustParseAddr("10.0.0.5"), Last: netip.MustParseAddr("10.0.0.77")},
+			}},
+		},
+		Y: &Netmask{Kind: KindNet, Addr: netip.MustParseAddr("10.0.3.0"), Mask: netip.MustParseAddr("255.0.255.0")},
+	}
+	if err := f.CompileExpr(e); err != nil {
+		t.Fatal(err)
+	}
+	if f.GetFilter() != "10.0.0.0/8 or src host 2001:db8::1/128 and not (portrange 20-21 or dst 10.0.0.5-10.0.0.77) or net 10.*.3.*" {
+		t.Errorf("unexpected filter %q", f.GetFilter())
+	}
+	if !f.Check(0x0a000001) || f.Check(0x0b000001) || !f.CheckAddr(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("unexpected check")
+	}
+
+	good := f.GetFilter()
+	for _, c := range []struct {
+		e   Expr
+		err error
+	}{
+		{nil, ErrNilExpr},
+		{&And{X: e}, ErrNilExpr},
+		{&Not{}, ErrNilExpr},
+		{&Prefix{}, ErrExpr},
+		{&Prefix{Kind: KindHost, Prefix: netip.MustParsePrefix("10.0.0.0/8")}, ErrHost},
+		{&Prefix{Dir: 3, Prefix: netip.MustParsePrefix("10.0.0.0/8")}, ErrExpr},
+		{&Port{Lo: 2, Hi: 1, Range: true}, ErrPortRange},
+		{&Range{First: netip.MustParseAddr("10.0.0.2"), Last: netip.MustParseAddr("10.0.0.1")}, ErrRange},
+		{&Netmask{Addr: netip.MustParseAddr("10.0.0.1"), Mask: netip.MustParseAddr("ffff::")}, ErrNetmask},
+		{&Netmask{Kind: KindHost, Addr: netip.MustParseAddr("10.0.0.1"), Mask: netip.MustParseAddr("255.0.255.0")}, ErrHost},
+		{&Netmask{Mask: netip.MustParseAddr("255.0.255.0")}, ErrExpr},
+		{&Range{First: netip.MustParseAddr("10.0.0.1"), Last: netip.MustParseAddr("::1")}, ErrRange},
+		{&Range{First: netip.MustParseAddr("10.0.0.1")}, ErrExpr},
+		{&Range{Kind: KindHost, First: netip.MustParseAddr("::1"), Last: netip.MustParseAddr("::1")}, ErrHost},
+		{&Port{Lo: 1, Hi: 2}, ErrExpr},
+		{&Or{X: e, Y: &Proto{Family: 5}}, ErrExpr},
+		{&Name{}, ErrExpr},
+		{&Name{Name: "10"}, ErrExpr},
+		{&Name{Name: "@office or 10"}, ErrExpr},
+		{&Name{Name: "privates"}, ErrExpr},
+		{&Name{Dir: 3, Name: "private"}, ErrExpr},
+	} {
+		err := f.CompileExpr(c.e)
+		var exprErr *ExprError
+		if !errors.Is(err, c.err) || !errors.As(err, &exprErr) {
+			t.Errorf("CompileExpr(%v): expect %v, got %v", c.e, c.err, err)
+		}
+	}
+	if f.GetFilter() != good {
+		t.Error("not keep old filter")
+	}
+
+	if err := f.CompileExpr(&And{X: &Name{Dir: DirSrc, Name: "private"}, Y: &Not{X: &Name{Name: "loopback"}}}); err != nil {
+		t.Fatal(err)
+	} else if f.GetFilter() != "src private and not loopback" || !f.Check(0x0a000001) {
+		t.Errorf("unexpected filter of names %q", f.GetFilter())
+	}
+
+	// a tree of a set or a macro compiles with its env
+	env := &EnvT{
+		Sets:   map[string][]netip.Prefix{"office": prefixes("10.1.0.0/16", "10.2.0.0/16")},
+		Macros: map[string]string{"web": "port 80 or port 443"},
+	}
+	g := FilterT{}
+	if err := g.CompileEnv("src @office and $web", env); err != nil {
+		t.Fatal(err)
+	}
+	named, err := namedExpr(g.GetFilter(), g.Mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []Expr{g.Expr(), named} {
+		h := FilterT{}
+		if err := h.CompileExprEnv(e, env); err != nil {
+			t.Fatal(err)
+		}
+		if same, addr, err := g.Equivalent(&h); !same || err != nil {
+			t.Errorf("CompileExprEnv(%s): expect the hosts of the filter, got %v, %v", e, addr, err)
+		}
+		if !compareTokens(clearPos(g.rpn), clearPos(h.rpn)) {
+			t.Errorf("CompileExprEnv(%s): expect rpn %s, got %s", e, g.GetRPN(), h.GetRPN())
+		}
+	}
+	if err := f.CompileExpr(named); !errors.Is(err, ErrUndefined) {
+		t.Errorf("CompileExpr of a set without env: expect %v, got %v", ErrUndefined, err)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	e, err := Parse("10 or not 11 and port 80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := e.String()
+	var values int
+	Walk(e, func(e Expr) bool {
+		if _, ok := e.(*Not); ok {
+			return false
+		}
+		switch e.(type) {
+		case *Prefix, *Port:
+			values++
+		}
+		return true
+	})
+	if values != 2 {
+		t.Errorf("Walk: expect 2 values outside not, got %d", values)
+	}
+
+	rewritten := Rewrite(e, func(e Expr) Expr {
+		switch n := e.(type) {
+		case *Prefix:
+			copied := *n
+			copied.Dir = DirDst
+			return &copied
+		case *Not:
+			return n.X
+		}
+		return e
+	})
+	if got := rewritten.String(); got != "dst 10.0.0.0/8 or dst 11.0.0.0/8 and port 80" {
+		t.Errorf("Rewrite: got %q", got)
+	}
+	if e.String() != before {
+		t.Errorf("Rewrite changed its tree to %q", e.String())
+	}
+	if same := Rewrite(e, func(e Expr) Expr { return e }); same != e {
+		t.Error("Rewrite copied an unchanged tree")
+	}
+}
+
+func clearPos(rpn []tokenT) []tokenT {
+	cleared := make([]tokenT, len(rpn))
+	for i, token := range rpn {
+		token.pos = 0
+		cleared[i] = token
+	}
+	return cleared
+}
@@ -0,0 +1,625 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// BPFInsn is a classic bpf instruction, laid out as struct sock_filter and
+// convertible to bpf.RawInstruction of golang.org/x/net/bpf.
+type BPFInsn struct {
+	Op uint16
+	Jt uint8
+	Jf uint8
+	K  uint32
+}
+
+var (
+	ErrNotCompiled = errors.New("filter is not compiled")
+	ErrBPFTooLong  = errors.New("bpf program is too long")
+)
+
+const (
+	bpf_ld   = 0x00
+	bpf_ldx  = 0x01
+	bpf_st   = 0x02
+	bpf_stx  = 0x03
+	bpf_alu  = 0x04
+	bpf_jmp  = 0x05
+	bpf_ret  = 0x06
+	bpf_misc = 0x07
+
+	bpf_w = 0x00
+	bpf_h = 0x08
+	bpf_b = 0x10
+
+	bpf_imm = 0x00
+	bpf_abs = 0x20
+	bpf_ind = 0x40
+	bpf_mem = 0x60
+	bpf_len = 0x80
+	bpf_msh = 0xa0
+
+	bpf_add = 0x00
+	bpf_sub = 0x10
+	bpf_mul = 0x20
+	bpf_div = 0x30
+	bpf_or  = 0x40
+	bpf_and = 0x50
+	bpf_lsh = 0x60
+	bpf_rsh = 0x70
+	bpf_neg = 0x80
+	bpf_mod = 0x90
+	bpf_xor = 0xa0
+
+	bpf_ja   = 0x00
+	bpf_jeq  = 0x10
+	bpf_jgt  = 0x20
+	bpf_jge  = 0x30
+	bpf_jset = 0x40
+
+	bpf_k = 0x00
+	bpf_x = 0x08
+	bpf_a = 0x10
+
+	bpf_tax = 0x00
+	bpf_txa = 0x80
+
+	bpf_max_insns = 4096
+	bpf_max_jump  = 255
+	bpf_accept    = 262144
+)
+
+// CompileBPF compiles the filter to a classic bpf program for ethernet
+// frames, as attached to a packet socket with SO_ATTACH_FILTER. The program
+// accepts exactly the frames CheckPacket matches.
+func (f *FilterT) CompileBPF() ([]BPFInsn, error) {
+	return f.compileBPF(ether_header_len)
+}
+
+// CompileIPBPF compiles the filter to a classic bpf program for raw ipv4 or
+// ipv6 packets, which accepts exactly the packets CheckIPPacket matches.
+func (f *FilterT) CompileIPBPF() ([]BPFInsn, error) {
+	return f.compileBPF(0)
+}
+
+// BPFString disassembles prog, as tcpdump -d does.
+func BPFString(prog []BPFInsn) string {
+	out := ""
+	for i, insn := range prog {
+		op, arg := bpfDisasm(insn)
+		line := fmt.Sprintf("(%03d) %-8s %s", i, op, arg)
+		if insn.Op&0x07 == bpf_jmp {
+			if insn.Op&0xf0 == bpf_ja {
+				line = fmt.Sprintf("(%03d) %-8s %d", i, op, i+1+int(insn.K))
+			} else {
+				line = fmt.Sprintf("(%03d) %-8s %-16s jt %d\tjf %d", i, op, arg, i+1+int(insn.Jt), i+1+int(insn.Jf))
+			}
+		}
+		out += strings.TrimRight(line, " ") + "\n"
+	}
+	return out
+}
+
+func bpfDisasm(insn BPFInsn) (string, string) {
+	k := fmt.Sprintf("#0x%x", insn.K)
+	size := map[uint16]string{bpf_w: "", bpf_h: "h", bpf_b: "b"}[insn.Op&0x18]
+	switch insn.Op & 0x07 {
+	case bpf_ld:
+		switch insn.Op & 0xe0 {
+		case bpf_imm:
+			return "ld", fmt.Sprintf("#%d", insn.K)
+		case bpf_abs:
+			return "ld" + size, fmt.Sprintf("[%d]", insn.K)
+		case bpf_ind:
+			return "ld" + size, fmt.Sprintf("[x + %d]", insn.K)
+		case bpf_mem:
+			return "ld", fmt.Sprintf("M[%d]", insn.K)
+		case bpf_len:
+			return "ld", "#pktlen"
+		}
+	case bpf_ldx:
+		switch insn.Op & 0xe0 {
+		case bpf_imm:
+			return "ldx", fmt.Sprintf("#%d", insn.K)
+		case bpf_mem:
+			return "ldx", fmt.Sprintf("M[%d]", insn.K)
+		case bpf_len:
+			return "ldx", "#pktlen"
+		case bpf_msh:
+			return "ldxb", fmt.Sprintf("4*([%d]&0xf)", insn.K)
+		}
+	case bpf_st:
+		return "st", fmt.Sprintf("M[%d]", insn.K)
+	case bpf_stx:
+		return "stx", fmt.Sprintf("M[%d]", insn.K)
+	case bpf_alu:
+		name := map[uint16]string{bpf_add: "add", bpf_sub: "sub", bpf_mul: "mul", bpf_div: "div",
+			bpf_or: "or", bpf_and: "and", bpf_lsh: "lsh", bpf_rsh: "rsh", bpf_neg: "neg",
+			bpf_mod: "mod", bpf_xor: "xor"}[insn.Op&0xf0]
+		if insn.Op&0xf0 == bpf_neg {
+			return name, ""
+		} else if insn.Op&bpf_x != 0 {
+			return name, "x"
+		}
+		return name, k
+	case bpf_jmp:
+		name := map[uint16]string{bpf_ja: "ja", bpf_jeq: "jeq", bpf_jgt: "jgt", bpf_jge: "jge",
+			bpf_jset: "jset"}[insn.Op&0xf0]
+		if insn.Op&bpf_x != 0 {
+			return name, "x"
+		}
+		return name, k
+	case bpf_ret:
+		if insn.Op&0x18 == bpf_a {
+			return "ret", "a"
+		}
+		return "ret", fmt.Sprintf("#%d", insn.K)
+	case bpf_misc:
+		if insn.Op&0xf8 == bpf_txa {
+			return "txa", ""
+		}
+		return "tax", ""
+	}
+	return "unimp", fmt.Sprintf("0x%x", insn.Op)
+}
+
+// bpfInsnT is an instruction whose jumps target labels
+type bpfInsnT struct {
+	insn BPFInsn
+	jump bool
+	jt   int
+	jf   int
+}
+
+// bpfGenT generates a program, nh is the offset of the ip header
+type bpfGenT struct {
+	code   []bpfInsnT
+	labels []int
+	nh     uint32
+}
+
+func (f *FilterT) compileBPF(nh uint32) ([]BPFInsn, error) {
+	if len(f.rpn) == 0 {
+		return nil, ErrNotCompiled
+	}
+	g := &bpfGenT{nh: nh}
+	accept, reject := g.newLabel(), g.newLabel()
+	ip4, ip6, other := g.newLabel(), g.newLabel(), g.newLabel()
+	if nh == 0 {
+		g.emit(bpf_ld|bpf_b|bpf_abs, 0)
+		g.emit(bpf_alu|bpf_and|bpf_k, 0xf0)
+		g.jump(bpf_jeq, 0x40, ip4, other)
+		g.place(other)
+		g.jump(bpf_jeq, 0x60, ip6, reject)
+	} else {
+		g.emit(bpf_ld|bpf_h|bpf_abs, 12)
+		g.jump(bpf_jeq, ether_type_ip4, ip4, other)
+		g.place(other)
+		g.jump(bpf_jeq, ether_type_ip6, ip6, reject)
+	}
+
+	e := toExpr(f.rpn)
+	for _, v6 := range []bool{false, true} {
+		ok := g.newLabel()
+		if v6 {
+			g.place(ip6)
+			g.checkIP6(ok, reject)
+		} else {
+			g.place(ip4)
+			g.checkIP4(ok, reject)
+		}
+		g.place(ok)
+		g.expr(e, v6, accept, reject)
+	}
+
+	g.place(accept)
+	g.emit(bpf_ret|bpf_k, bpf_accept)
+	g.place(reject)
+	g.emit(bpf_ret|bpf_k, 0)
+
+	prog, ok := g.assemble(false)
+	if !ok {
+		prog, _ = g.assemble(true)
+	}
+	if len(prog) > bpf_max_insns {
+		return nil, ErrBPFTooLong
+	}
+	return prog, nil
+}
+
+func (g *bpfGenT) newLabel() int {
+	g.labels = append(g.labels, -1)
+	return len(g.labels) - 1
+}
+
+func (g *bpfGenT) place(label int) {
+	g.labels[label] = len(g.code)
+}
+
+func (g *bpfGenT) emit(op uint16, k uint32) {
+	g.code = append(g.code, bpfInsnT{insn: BPFInsn{Op: op, K: k}})
+}
+
+// jump emits a conditional jump, op compares A with k
+func (g *bpfGenT) jump(op uint16, k uint32, jt, jf int) {
+	g.code = append(g.code, bpfInsnT{insn: BPFInsn{Op: bpf_jmp | op, K: k}, jump: true, jt: jt, jf: jf})
+}
+
+// jumpX emits a conditional jump which compares A with X
+func (g *bpfGenT) jumpX(op uint16, jt, jf int) {
+	g.code = append(g.code, bpfInsnT{insn: BPFInsn{Op: bpf_jmp | op | bpf_x}, jump: true, jt: jt, jf: jf})
+}
+
+func (g *bpfGenT) ja(label int) {
+	g.code = append(g.code, bpfInsnT{insn: BPFInsn{Op: bpf_jmp | bpf_ja}, jump: true, jt: label})
+}
+
+// assemble resolves the labels, a conditional jump too far for its 8 bit
+// offsets fails unless trampoline, which routes every conditional jump
+// through two ja instructions
+func (g *bpfGenT) assemble(trampoline bool) ([]BPFInsn, bool) {
+	pos := make([]int, len(g.code)+1)
+	n := 0
+	for i, insn := range g.code {
+		pos[i] = n
+		n++
+		if trampoline && insn.jump && insn.insn.Op&0xf0 != bpf_ja {
+			n += 2
+		}
+	}
+	pos[len(g.code)] = n
+	target := func(label int) int {
+		return pos[g.labels[label]]
+	}
+
+	prog := make([]BPFInsn, 0, n)
+	for _, insn := range g.code {
+		at := len(prog)
+		switch {
+		case !insn.jump:
+			prog = append(prog, insn.insn)
+		case insn.insn.Op&0xf0 == bpf_ja:
+			insn.insn.K = uint32(target(insn.jt) - at - 1)
+			prog = append(prog, insn.insn)
+		case trampoline:
+			insn.insn.Jt, insn.insn.Jf = 0, 1
+			prog = append(prog, insn.insn,
+				BPFInsn{Op: bpf_jmp | bpf_ja, K: uint32(target(insn.jt) - at - 2)},
+				BPFInsn{Op: bpf_jmp | bpf_ja, K: uint32(target(insn.jf) - at - 3)})
+		default:
+			jt, jf := target(insn.jt)-at-1, target(insn.jf)-at-1
+			if jt > bpf_max_jump || jf > bpf_max_jump {
+				return nil, false
+			}
+			insn.insn.Jt, insn.insn.Jf = uint8(jt), uint8(jf)
+			prog = append(prog, insn.insn)
+		}
+	}
+	return prog, true
+}
+
+// checkIP4 rejects what decodeIP4 rejects, A is the version byte
+func (g *bpfGenT) checkIP4(ok, reject int) {
+	nh := g.nh
+	version, headerLen, totalLen, captured, transport := g.newLabel(), g.newLabel(), g.newLabel(), g.newLabel(), g.newLabel()
+	g.emit(bpf_ld|bpf_b|bpf_abs, nh)
+	g.emit(bpf_alu|bpf_and|bpf_k, 0xf0)
+	g.jump(bpf_jeq, 0x40, version, reject)
+	g.place(version)
+	g.emit(bpf_ld|bpf_b|bpf_abs, nh)
+	g.emit(bpf_alu|bpf_and|bpf_k, 0x0f)
+	g.jump(bpf_jge, ip4_header_len/4, headerLen, reject)
+	g.place(headerLen)
+	g.emit(bpf_ldx|bpf_b|bpf_msh, nh)
+	g.emit(bpf_ld|bpf_h|bpf_abs, nh+2)
+	g.jumpX(bpf_jge, totalLen, reject)
+	g.place(totalLen)
+	g.emit(bpf_st, 0)
+	g.emit(bpf_ld|bpf_w|bpf_len, 0)
+	if nh != 0 {
+		g.emit(bpf_alu|bpf_sub|bpf_k, nh)
+	}
+	g.emit(bpf_ldx|bpf_mem, 0)
+	g.jumpX(bpf_jge, captured, reject)
+	g.place(captured)
+	g.emit(bpf_ld|bpf_h|bpf_abs, nh+6)
+	g.jump(bpf_jset, ip4_offset_mask, ok, transport)
+	g.place(transport)
+	g.emit(bpf_ld|bpf_b|bpf_abs, nh+9)
+	g.checkTransport(ok, reject, func() {
+		g.emit(bpf_ldx|bpf_b|bpf_msh, nh)
+		g.emit(bpf_ld|bpf_h|bpf_abs, nh+2)
+		g.emit(bpf_alu|bpf_sub|bpf_x, 0)
+	})
+}
+
+// checkIP6 rejects what decodeIP6 rejects
+func (g *bpfGenT) checkIP6(ok, reject int) {
+	nh := g.nh
+	version, header, captured := g.newLabel(), g.newLabel(), g.newLabel()
+	g.emit(bpf_ld|bpf_b|bpf_abs, nh)
+	g.emit(bpf_alu|bpf_and|bpf_k, 0xf0)
+	g.jump(bpf_jeq, 0x60, version, reject)
+	g.place(version)
+	g.emit(bpf_ld|bpf_w|bpf_len, 0)
+	g.jump(bpf_jge, nh+ip6_header_len, header, reject)
+	g.place(header)
+	g.emit(bpf_ld|bpf_h|bpf_abs, nh+4)
+	g.emit(bpf_st, 0)
+	g.emit(bpf_ld|bpf_w|bpf_len, 0)
+	g.emit(bpf_alu|bpf_sub|bpf_k, nh+ip6_header_len)
+	g.emit(bpf_ldx|bpf_mem, 0)
+	g.jumpX(bpf_jge, captured, reject)
+	g.place(captured)
+	g.emit(bpf_ld|bpf_b|bpf_abs, nh+6)
+	g.checkTransport(ok, reject, func() {
+		g.emit(bpf_ld|bpf_h|bpf_abs, nh+4)
+	})
+}
+
+// checkTransport rejects a tcp, udp or sctp packet, the protocol of which is
+// in A, whose transport length loaded by length is too short for its header
+func (g *bpfGenT) checkTransport(ok, reject int, length func()) {
+	for _, transport := range []struct {
+		proto     uint32
+		headerLen uint32
+	}{{proto_tcp, tcp_header_len}, {proto_udp, udp_header_len}, {proto_sctp, sctp_header_len}} {
+		found, next := g.newLabel(), g.newLabel()
+		g.jump(bpf_jeq, transport.proto, found, next)
+		g.place(found)
+		length()
+		g.jump(bpf_jge, transport.headerLen, ok, reject)
+		g.place(next)
+	}
+	g.ja(ok)
+}
+
+// expr jumps to t if e matches a valid ipv4, or ipv6 if v6, packet, to f
+// otherwise
+func (g *bpfGenT) expr(e *exprT, v6 bool, t, f int) {
+	switch e.token.t {
+	case token_and:
+		mid := g.newLabel()
+		g.expr(e.x, v6, mid, f)
+		g.place(mid)
+		g.expr(e.y, v6, t, f)
+	case token_or:
+		mid := g.newLabel()
+		g.expr(e.x, v6, t, mid)
+		g.place(mid)
+		g.expr(e.y, v6, t, f)
+	case token_not:
+		g.expr(e.x, v6, f, t)
+	case token_value:
+		g.value(e.token, v6, t, f)
+	default:
+		panic("illegal token")
+	}
+}
+
+func (g *bpfGenT) value(token tokenT, v6 bool, t, f int) {
+	var side func(dst bool, t, f int)
+	switch token.kind {
+	case kind_port, kind_portrange:
+		side = func(dst bool, t, f int) {
+			g.ports(token.ports, v6, dst, t, f)
+		}
+	case kind_proto, kind_proto4, kind_proto6:
+		g.proto(token, v6, t, f)
+		return
+	default:
+		side = func(dst bool, t, f int) {
+			switch {
+			case v6 && token.cidr.isRange:
+				g.range6(token.cidr, dst, t, f)
+			case v6:
+				g.cidr6(token.cidr, dst, t, f)
+			case token.cidr.isRange:
+				g.range4(token.cidr, dst, t, f)
+			default:
+				g.cidr4(token.cidr, dst, t, f)
+			}
+		}
+	}
+	switch token.dir {
+	case dir_src:
+		side(false, t, f)
+	case dir_dst:
+		side(true, t, f)
+	default:
+		mid := g.newLabel()
+		side(false, t, mid)
+		g.place(mid)
+		side(true, t, f)
+	}
+}
+
+// cidr4 matches the ipv4 src or dst address against cidr, as checkIn does
+func (g *bpfGenT) cidr4(cidr cidrT, dst bool, t, f int) {
+	ip := cidr.ip.and(cidr.mask)
+	if !isV4Mask(cidr.mask) || !ip.isV4() {
+		g.ja(f)
+		return
+	}
+	mask := uint32(cidr.mask.lo)
+	if mask == 0 {
+		g.ja(t)
+		return
+	}
+	off := g.nh + 12
+	if dst {
+		off += 4
+	}
+	g.emit(bpf_ld|bpf_w|bpf_abs, off)
+	if mask != ^uint32(0) {
+		g.emit(bpf_alu|bpf_and|bpf_k, mask)
+	}
+	g.jump(bpf_jeq, uint32(ip.lo), t, f)
+}
+
+// cidr6 matches the ipv6 src or dst address against cidr, as checkIn does,
+// a v4-mapped address only matches a cidr with an ipv4 mask
+func (g *bpfGenT) cidr6(cidr cidrT, dst bool, t, f int) {
+	off := g.nh + 8
+	if dst {
+		off += 16
+	}
+	ip := cidr.ip.and(cidr.mask)
+	matched := t
+	mapped := !isV4Mask(cidr.mask) && ipT{lo: v4_mapped_prefix << 32}.and(cidr.mask) == ip
+	if mapped {
+		matched = g.newLabel()
+	}
+	masks := [4]uint32{uint32(cidr.mask.hi >> 32), uint32(cidr.mask.hi), uint32(cidr.mask.lo >> 32), uint32(cidr.mask.lo)}
+	ips := [4]uint32{uint32(ip.hi >> 32), uint32(ip.hi), uint32(ip.lo >> 32), uint32(ip.lo)}
+	last := -1
+	for i := range masks {
+		if masks[i] != 0 {
+			last = i
+		}
+	}
+	if last < 0 {
+		g.ja(matched)
+	}
+	for i := 0; i <= last; i++ {
+		if masks[i] == 0 {
+			continue
+		}
+		next := matched
+		if i != last {
+			next = g.newLabel()
+		}
+		g.emit(bpf_ld|bpf_w|bpf_abs, off+uint32(4*i))
+		if masks[i] != ^uint32(0) {
+			g.emit(bpf_alu|bpf_and|bpf_k, masks[i])
+		}
+		g.jump(bpf_jeq, ips[i], next, f)
+		if i != last {
+			g.place(next)
+		}
+	}
+	if mapped {
+		g.place(matched)
+		g.mapped(off, f, t)
+	}
+}
+
+// range4 matches the ipv4 src or dst address against the range cidr
+func (g *bpfGenT) range4(cidr cidrT, dst bool, t, f int) {
+	if !cidr.ip.isV4() {
+		g.ja(f)
+		return
+	}
+	off := g.nh + 12
+	if dst {
+		off += 4
+	}
+	above := g.newLabel()
+	g.emit(bpf_ld|bpf_w|bpf_abs, off)
+	g.jump(bpf_jge, uint32(cidr.ip.lo), above, f)
+	g.place(above)
+	g.jump(bpf_jgt, uint32(cidr.last.lo), f, t)
+}
+
+// range6 matches the ipv6 src or dst address against the prefixes of the
+// range cidr, as 128 bit addresses can not be compared in a word
+func (g *bpfGenT) range6(cidr cidrT, dst bool, t, f int) {
+	cidrs := cidrsOf(cidr)
+	for i, c := range cidrs {
+		next := f
+		if i != len(cidrs)-1 {
+			next = g.newLabel()
+		}
+		g.cidr6(c, dst, t, next)
+		if i != len(cidrs)-1 {
+			g.place(next)
+		}
+	}
+}
+
+// ports matches the src or dst port of the first fragment of a tcp, udp or
+// sctp packet against ports
+func (g *bpfGenT) ports(ports portsT, v6 bool, dst bool, t, f int) {
+	nh, found := g.nh, g.newLabel()
+	off := uint32(0)
+	if dst {
+		off = 2
+	}
+	if v6 {
+		g.emit(bpf_ld|bpf_b|bpf_abs, nh+6)
+	} else {
+		first := g.newLabel()
+		g.emit(bpf_ld|bpf_h|bpf_abs, nh+6)
+		g.jump(bpf_jset, ip4_offset_mask, f, first)
+		g.place(first)
+		g.emit(bpf_ld|bpf_b|bpf_abs, nh+9)
+	}
+	for _, proto := range []uint32{proto_tcp, proto_udp, proto_sctp} {
+		next := f
+		if proto != proto_sctp {
+			next = g.newLabel()
+		}
+		g.jump(bpf_jeq, proto, found, next)
+		if proto != proto_sctp {
+			g.place(next)
+		}
+	}
+	g.place(found)
+	if v6 {
+		g.emit(bpf_ld|bpf_h|bpf_abs, nh+ip6_header_len+off)
+	} else {
+		g.emit(bpf_ldx|bpf_b|bpf_msh, nh)
+		g.emit(bpf_ld|bpf_h|bpf_ind, nh+off)
+	}
+	if ports.lo == ports.hi {
+		g.jump(bpf_jeq, uint32(ports.lo), t, f)
+		return
+	}
+	low := g.newLabel()
+	g.jump(bpf_jge, uint32(ports.lo), low, f)
+	g.place(low)
+	g.jump(bpf_jgt, uint32(ports.hi), f, t)
+}
+
+// proto matches the protocol of the packet, an ipv6 packet with a v4-mapped
+// src address counts as ipv4, as pktT.isV4 does
+func (g *bpfGenT) proto(token tokenT, v6 bool, t, f int) {
+	if token.kind == kind_proto6 && !v6 {
+		g.ja(f)
+		return
+	}
+	if v6 {
+		found := g.newLabel()
+		g.emit(bpf_ld|bpf_b|bpf_abs, g.nh+6)
+		g.jump(bpf_jeq, uint32(token.proto), found, f)
+		g.place(found)
+		switch token.kind {
+		case kind_proto4:
+			g.mapped(g.nh+8, t, f)
+		case kind_proto6:
+			g.mapped(g.nh+8, f, t)
+		default:
+			g.ja(t)
+		}
+		return
+	}
+	g.emit(bpf_ld|bpf_b|bpf_abs, g.nh+9)
+	g.jump(bpf_jeq, uint32(token.proto), t, f)
+}
+
+// mapped jumps to t if the ipv6 address at off is v4-mapped, to f otherwise
+func (g *bpfGenT) mapped(off uint32, t, f int) {
+	for i, word := range []uint32{0, 0, v4_mapped_prefix} {
+		if i == 2 {
+			g.emit(bpf_ld|bpf_w|bpf_abs, off+uint32(4*i))
+			g.jump(bpf_jeq, word, t, f)
+			break
+		}
+		next := g.newLabel()
+		g.emit(bpf_ld|bpf_w|bpf_abs, off+uint32(4*i))
+		g.jump(bpf_jeq, word, next, f)
+		g.place(next)
+	}
+}
@@ -0,0 +1,291 @@
+package filter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// runBPF interprets prog over data as the kernel does, a load out of the
+// packet rejects it
+func runBPF(t *testing.T, prog []BPFInsn, data []byte) uint32 {
+	var a, x uint32
+	var mem [16]uint32
+	load := func(off uint32, size uint32) (uint32, bool) {
+		if uint64(off)+uint64(size) > uint64(len(data)) {
+			return 0, false
+		}
+		switch size {
+		case 1:
+			return uint32(data[off]), true
+		case 2:
+			return uint32(binary.BigEndian.Uint16(data[off:])), true
+		}
+		return binary.BigEndian.Uint32(data[off:]), true
+	}
+	sizes := map[uint16]uint32{bpf_w: 4, bpf_h: 2, bpf_b: 1}
+	for pc := 0; pc < len(prog); pc++ {
+		insn := prog[pc]
+		var ok = true
+		switch insn.Op & 0x07 {
+		case bpf_ld:
+			switch insn.Op & 0xe0 {
+			case bpf_imm:
+				a = insn.K
+			case bpf_abs:
+				a, ok = load(insn.K, sizes[insn.Op&0x18])
+			case bpf_ind:
+				a, ok = load(x+insn.K, sizes[insn.Op&0x18])
+			case bpf_mem:
+				a = mem[insn.K]
+			case bpf_len:
+				a = uint32(len(data))
+			}
+		case bpf_ldx:
+			switch insn.Op & 0xe0 {
+			case bpf_imm:
+				x = insn.K
+			case bpf_mem:
+				x = mem[insn.K]
+			case bpf_len:
+				x = uint32(len(data))
+			case bpf_msh:
+				x, ok = load(insn.K, 1)
+				x = (x & 0xf) * 4
+			}
+		case bpf_st:
+			mem[insn.K] = a
+		case bpf_stx:
+			mem[insn.K] = x
+		case bpf_alu:
+			v := insn.K
+			if insn.Op&bpf_x != 0 {
+				v = x
+			}
+			switch insn.Op & 0xf0 {
+			case bpf_add:
+				a += v
+			case bpf_sub:
+				a -= v
+			case bpf_and:
+				a &= v
+			case bpf_or:
+				a |= v
+			default:
+				t.Fatalf("unexpected alu op 0x%x", insn.Op)
+			}
+		case bpf_jmp:
+			v := insn.K
+			if insn.Op&bpf_x != 0 {
+				v = x
+			}
+			var cond bool
+			switch insn.Op & 0xf0 {
+			case bpf_ja:
+				pc += int(insn.K)
+				continue
+			case bpf_jeq:
+				cond = a == v
+			case bpf_jgt:
+				cond = a > v
+			case bpf_jge:
+				cond = a >= v
+			case bpf_jset:
+				cond = a&v != 0
+			}
+			if cond {
+				pc += int(insn.Jt)
+			} else {
+				pc += int(insn.Jf)
+			}
+		case bpf_ret:
+			return insn.K
+		default:
+			t.Fatalf("unexpected op 0x%x", insn.Op)
+		}
+		if !ok {
+			return 0
+		}
+	}
+	t.Fatal("bpf program falls off its end")
+	return 0
+}
+
+func bpfPackets() map[string][]byte {
+	pkts := map[string][]byte{}
+	for _, src := range []string{"10.0.0.1", "192.168.1.1", "1.2.3.4"} {
+		for _, dst := range []string{"10.1.2.3", "172.16.0.1"} {
+			for _, proto := range []int{proto_tcp, proto_udp, proto_sctp} {
+				pkts["ip4 "+src+" "+dst+" "+protoNames[proto]] = newEthernet(ether_type_ip4, newIP4Packet(src, dst, proto, newTransport(proto, 53, 443)))
+			}
+		}
+	}
+	pkts["icmp4"] = newEthernet(ether_type_ip4, newIP4Packet("10.0.0.2", "10.0.0.3", proto_icmp, []byte{8, 0, 0, 0, 0, 0, 0, 0}))
+	options := newIP4Packet("10.0.0.1", "192.168.1.1", proto_tcp, append(make([]byte, 4), newTransport(proto_tcp, 22, 8080)...))
+	options[0] = 0x46
+	pkts["options"] = newEthernet(ether_type_ip4, options)
+	fragment := newIP4Packet("10.0.0.1", "192.168.1.1", proto_tcp, []byte{0, 53, 1, 187})
+	binary.BigEndian.PutUint16(fragment[6:8], 100)
+	pkts["fragment"] = newEthernet(ether_type_ip4, fragment)
+	for _, src := range []string{"2001:db8::1", "fe80::1", "::ffff:10.0.0.1", "::1"} {
+		for _, proto := range []int{proto_tcp, proto_udp} {
+			pkts["ip6 "+src+" "+protoNames[proto]] = newEthernet(ether_type_ip6, newIP6Packet(src, "2001:db8:1::2", proto, newTransport(proto, 5353, 53)))
+		}
+	}
+	pkts["icmp6"] = newEthernet(ether_type_ip6, newIP6Packet("fe80::2", "ff02::1", proto_icmp6, []byte{128, 0, 0, 0}))
+	pkts["arp"] = newEthernet(0x0806, make([]byte, 28))
+	return pkts
+}
+
+func TestCompileBPF(t *testing.T) {
+	f := FilterT{}
+	for _, filter := range []string{
+		"10.0.0.1",
+		"not 10.0.0.0/8",
+		"src net 10 and dst 172.16.0.1 or 192.168.1.1",
+		"10.0.0.0/8 and (tcp or udp) and not port 22",
+		"src port 53 or dst portrange 400-500",
+		"ip proto 6 or ip6 proto 17 or icmp or icmp6 or proto 132",
+		"2001:db8::/32 or fe80::/10",
+		"::/0",
+		"::/64 and not ::ffff:0:0/96",
+		"::ffff:10.0.0.0/104",
+		"::/0 or 0.0.0.0/0",
+		"dst ::1 or dst 2001:db8:1::2 and src port 5353",
+		"not (1.2.3.4 or 2001:db8::1) and not proto 132",
+		"src 10.0.0.1-10.0.0.2 or dst 1.2.3.4-1.2.3.4",
+		"::1-::2 or 2001:db8::-2001:db8::1:0 or ::fffe:0:0-::1:0:0:0",
+		"dst 10.*.*.1 or 2001:db8::1 mask ffff:ffff::ffff or ::ffff:1.2.3.4 mask ffff::ffff:ffff:ffff",
+	} {
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		prog, err := f.CompileBPF()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipProg, err := f.CompileIPBPF()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range bpfPackets() {
+			for i := 0; i <= len(data); i++ {
+				expect := f.CheckPacket(data[:i])
+				if got := runBPF(t, prog, data[:i]) != 0; got != expect {
+					t.Errorf("filter %q, %s truncated to %d: expect %v, got %v\n%s", filter, name, i, expect, got, BPFString(prog))
+				}
+				if i < ether_header_len {
+					continue
+				}
+				expect = f.CheckIPPacket(data[ether_header_len:i])
+				if got := runBPF(t, ipProg, data[ether_header_len:i]) != 0; got != expect {
+					t.Errorf("filter %q, raw %s truncated to %d: expect %v, got %v\n%s", filter, name, i, expect, got, BPFString(ipProg))
+				}
+			}
+		}
+	}
+}
+
+func TestCompileBPFMalformed(t *testing.T) {
+	f := FilterT{}
+	if err := f.Compile("not 1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	prog, _ := f.CompileIPBPF()
+	ip4 := newIP4Packet("10.0.0.1", "10.0.0.2", proto_udp, newTransport(proto_udp, 1, 2))
+	ip6 := newIP6Packet("::1", "::2", proto_tcp, newTransport(proto_tcp, 1, 2))
+	for _, corrupt := range []func() []byte{
+		func() []byte { b := append([]byte(nil), ip4...); b[0] = 0x44; return b },
+		func() []byte { b := append([]byte(nil), ip4...); b[0] = 0x47; return b },
+		func() []byte { b := append([]byte(nil), ip4...); binary.BigEndian.PutUint16(b[2:4], 19); return b },
+		func() []byte { b := append([]byte(nil), ip4...); binary.BigEndian.PutUint16(b[2:4], 24); return b },
+		func() []byte { b := append([]byte(nil), ip4...); binary.BigEndian.PutUint16(b[2:4], 100); return b },
+		func() []byte { b := append([]byte(nil), ip6...); binary.BigEndian.PutUint16(b[4:6], 4); return b },
+		func() []byte { b := append([]byte(nil), ip6...); binary.BigEndian.PutUint16(b[4:6], 100); return b },
+		func() []byte { b := append([]byte(nil), ip6...); b[0] = 0x50; return b },
+	} {
+		data := corrupt()
+		if expect, got := f.CheckIPPacket(data), runBPF(t, prog, data) != 0; expect != got {
+			t.Errorf("packet %x: expect %v, got %v", data, expect, got)
+		}
+	}
+}
+
+func TestCompileBPFSweep(t *testing.T) {
+	f := FilterT{}
+	for _, filter := range []string{
+		"src 10.1.0.0/16 and not src 10.1.128.0/17 or src 10.1.200.7",
+		"src 10.0.255.7-10.1.0.200 or src 10.1.200.7-10.1.200.7",
+		"src 10.*.1.* or src 10.0.0.7 wildcard 0.0.0.248",
+	} {
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		prog, _ := f.CompileIPBPF()
+		for ip := 0x0a00ff00; ip < 0x0a020100; ip += 0x7f {
+			data := newIP4Packet("0.0.0.0", "0.0.0.0", proto_icmp, nil)
+			binary.BigEndian.PutUint32(data[12:16], uint32(ip))
+			if expect, got := f.Check(ip), runBPF(t, prog, data) != 0; expect != got {
+				t.Errorf("%q, %s: expect %v, got %v", filter, outputIP4(ip), expect, got)
+			}
+		}
+	}
+}
+
+func TestCompileBPFLong(t *testing.T) {
+	f := FilterT{}
+	var terms []string
+	for i := 0; i < 100; i++ {
+		terms = append(terms, "2001:db8::"+strings.Repeat("1", 1+i%4)+"/"+[]string{"128", "64", "100"}[i%3])
+	}
+	filter := "tcp and (" + strings.Join(terms, " or ") + ")"
+	if err := f.Compile(filter); err != nil {
+		t.Fatal(err)
+	}
+	prog, err := f.CompileBPF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range bpfPackets() {
+		if expect, got := f.CheckPacket(data), runBPF(t, prog, data) != 0; expect != got {
+			t.Errorf("%s: expect %v, got %v", name, expect, got)
+		}
+	}
+
+	terms = terms[:0]
+	for i := 0; i < 1000; i++ {
+		terms = append(terms, fmt.Sprintf("2001:db8::%x", i))
+	}
+	if err := f.Compile(strings.Join(terms, " or ")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.CompileBPF(); err != ErrBPFTooLong {
+		t.Errorf("expect ErrBPFTooLong, got %v", err)
+	}
+
+	if _, err := (&FilterT{}).CompileBPF(); err != ErrNotCompiled {
+		t.Errorf("expect ErrNotCompiled, got %v", err)
+	}
+}
+
+func TestBPFString(t *testing.T) {
+	f := FilterT{}
+	if err := f.Compile("src 10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	prog, _ := f.CompileIPBPF()
+	s := BPFString(prog)
+	for _, expect := range []string{
+		"(000) ldb      [0]\n",
+		"ldxb     4*([0]&0xf)",
+		"ld       [12]\n",
+		"jeq      #0xa000001       jt ",
+		"ret      #262144\n",
+		"ret      #0\n",
+	} {
+		if !strings.Contains(s, expect) {
+			t.Errorf("expect %q in\n%s", expect, s)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+// Command ipfilter prints the lines of its input whose address matches a
+// filter expression, or formats filter expressions.
+//
+// Usage:
+//
+//	ipfilter [-v | -a] [-f field [-d delim] | -r regexp] expr [file ...]
+//	ipfilter fmt [-c] [-O] [expr ...]
+//	ipfilter cidrs [-r] expr
+//	ipfilter cmp old new
+//	ipfilter explain expr addr ...
+//
+// Each line is an address, unless -f picks the address out of a field or -r
+// out of a regular expression, whose first group is the address if it has
+// one. Lines without an address never match. The input is stdin if no file
+// is given.
+//
+// The exit code is 0 if a line is printed, 1 if none is, 2 on a usage or
+// read error and 3 if expr does not compile, every error of expr is printed.
+//
+// ipfilter fmt prints each expr in the canonical form of filter.Format, or
+// each line of stdin if no expr is given, blank lines are kept, optimized
+// by filter.Optimize with -O. With -c it prints nothing and exits with 1 if
+// an expression is not so formatted. The exit code is 3 if an expression
+// does not compile.
+//
+// ipfilter cidrs prints the fewest disjoint prefixes of the addresses expr
+// matches, one per line, or with -r their ranges as first-last. The exit
+// code is 3 if expr does not compile and 4 if it has a mask too scattered
+// for prefixes, as filter.ErrNotPrefix.
+//
+// ipfilter cmp prints nothing if the expressions old and new match the same
+// addresses, otherwise it prints "-" and an address old matches and new does
+// not, and "+" and one new matches and old does not, if there are such. The
+// exit code is 0 if they match the same addresses, 1 if not, 3 if one
+// does not compile and 4 if one has a mask too scattered to be compared.
+//
+// ipfilter explain prints how expr matches each addr or not, with the
+// result of each term marked under expr. The exit code is 0 if expr matches
+// every addr, 1 if not, 2 if an addr is malformed and 3 if expr does not
+// compile.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/GaoYusong/filter"
+)
+
+const (
+	exit_printed  = 0
+	exit_none     = 1
+	exit_usage    = 2
+	exit_compile  = 3
+	exit_hosts    = 4
+	annotate_sep  = "\t"
+	match_mark    = "match"
+	nomatch_mark  = "nomatch"
+	noaddr_mark   = "noaddr"
+	max_line_size = 1 << 20
+)
+
+// addrFunc picks the address out of a line
+type addrFunc func(line string) (netip.Addr, bool)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) != 0 && args[0] == "fmt" {
+		return runFmt(args[1:], stdin, stdout, stderr)
+	} else if len(args) != 0 && args[0] == "cidrs" {
+		return runCIDRs(args[1:], stdout, stderr)
+	} else if len(args) != 0 && args[0] == "cmp" {
+		return runCmp(args[1:], stdout, stderr)
+	} else if len(args) != 0 && args[0] == "explain" {
+		return runExplain(args[1:], stdout, stderr)
+	}
+	flags := flag.NewFlagSet("ipfilter", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	invert := flags.Bool("v", false, "print the lines which do not match")
+	annotate := flags.Bool("a", false, "print every line, prefixed with "+match_mark+", "+nomatch_mark+" or "+noaddr_mark)
+	field := flags.Int("f", 0, "take the address from the 1-based `field` of a line")
+	delim := flags.String("d", "", "split fields on `delim` instead of white space")
+	expr := flags.String("r", "", "take the address from the first match of `regexp`, or its first group")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: ipfilter [-v | -a] [-f field [-d delim] | -r regexp] expr [file ...]")
+		fmt.Fprintln(stderr, "       ipfilter fmt [-c] [-O] [expr ...]")
+		fmt.Fprintln(stderr, "       ipfilter cidrs [-r] expr")
+		fmt.Fprintln(stderr, "       ipfilter cmp old new")
+		fmt.Fprintln(stderr, "       ipfilter explain expr addr ...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exit_usage
+	}
+	if flags.NArg() < 1 || (*invert && *annotate) || (*field != 0 && *expr != "") || *field < 0 {
+		flags.Usage()
+		return exit_usage
+	}
+
+	f := filter.FilterT{}
+	if err := f.CompileAll(flags.Arg(0)); err != nil {
+		printCompileError(stderr, flags.Arg(0), err)
+		return exit_compile
+	}
+
+	addr := addrOfLine
+	if *field != 0 {
+		addr = addrOfField(*field, *delim)
+	} else if *expr != "" {
+		re, err := regexp.Compile(*expr)
+		if err != nil {
+			fmt.Fprintln(stderr, "ipfilter:", err)
+			return exit_usage
+		}
+		addr = addrOfRegexp(re)
+	}
+
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+	code := exit_none
+	process := func(name string, r io.Reader) bool {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, max_line_size)
+		for scanner.Scan() {
+			line := scanner.Text()
+			ip, ok := addr(line)
+			matched := ok && f.CheckAddr(ip)
+			switch {
+			case *annotate:
+				mark := match_mark
+				if !ok {
+					mark = noaddr_mark
+				} else if !matched {
+					mark = nomatch_mark
+				}
+				fmt.Fprintln(out, mark+annotate_sep+line)
+			case matched != *invert:
+				fmt.Fprintln(out, line)
+			default:
+				continue
+			}
+			code = exit_printed
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(stderr, "ipfilter: %s: %v\n", name, err)
+			return false
+		}
+		return true
+	}
+
+	if flags.NArg() == 1 {
+		if !process("stdin", stdin) {
+			return exit_usage
+		}
+		return code
+	}
+	failed := false
+	for _, name := range flags.Args()[1:] {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(stderr, "ipfilter:", err)
+			failed = true
+			continue
+		}
+		if !process(name, file) {
+			failed = true
+		}
+		file.Close()
+	}
+	if failed {
+		return exit_usage
+	}
+	return code
+}
+
+func runFmt(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("ipfilter fmt", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	check := flags.Bool("c", false, "print nothing, exit with 1 if an expression is not canonical")
+	optimize := flags.Bool("O", false, "optimize the expressions")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: ipfilter fmt [-c] [-O] [expr ...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exit_usage
+	}
+
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+	code := exit_printed
+	format := func(expr string) {
+		if strings.TrimSpace(expr) == "" {
+			if !*check {
+				fmt.Fprintln(out, expr)
+			}
+			return
+		}
+		f := filter.FilterT{}
+		if err := f.Compile(expr); err != nil {
+			printCompileError(stderr, expr, err)
+			code = exit_compile
+			return
+		}
+		if *optimize {
+			f.Optimize()
+		}
+		if formatted := f.String(); !*check {
+			fmt.Fprintln(out, formatted)
+		} else if formatted != expr && code == exit_printed {
+			code = exit_none
+		}
+	}
+
+	if flags.NArg() != 0 {
+		for _, expr := range flags.Args() {
+			format(expr)
+		}
+		return code
+	}
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(nil, max_line_size)
+	for scanner.Scan() {
+		format(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(stderr, "ipfilter: stdin:", err)
+		return exit_usage
+	}
+	return code
+}
+
+func runCIDRs(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("ipfilter cidrs", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	ranges := flags.Bool("r", false, "print the ranges of the addresses instead")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: ipfilter cidrs [-r] expr")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exit_usage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exit_usage
+	}
+
+	f := filter.FilterT{}
+	if err := f.CompileAll(flags.Arg(0)); err != nil {
+		printCompileError(stderr, flags.Arg(0), err)
+		return exit_compile
+	}
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+	if *ranges {
+		addrRanges, err := f.Ranges()
+		if err != nil {
+			return hostsError(stderr, err)
+		}
+		for _, r := range addrRanges {
+			fmt.Fprintf(out, "%s-%s\n", r.First, r.Last)
+		}
+		return exit_printed
+	}
+	prefixes, err := f.CIDRs()
+	if err != nil {
+		return hostsError(stderr, err)
+	}
+	for _, p := range prefixes {
+		fmt.Fprintln(out, p)
+	}
+	return exit_printed
+}
+
+func runCmp(args []string, stdout, stderr io.Writer) int {
+	if len(args) != 2 {
+		fmt.Fprintln(stderr, "usage: ipfilter cmp old new")
+		return exit_usage
+	}
+	filters := make([]filter.FilterT, 2)
+	for i, expr := range args {
+		if err := filters[i].CompileAll(expr); err != nil {
+			printCompileError(stderr, expr, err)
+			return exit_compile
+		}
+	}
+
+	code := exit_printed
+	for _, c := range []struct {
+		mark     string
+		from, to *filter.FilterT
+	}{{"-", &filters[0], &filters[1]}, {"+", &filters[1], &filters[0]}} {
+		subset, addr, err := c.from.Subset(c.to)
+		if err != nil {
+			return hostsError(stderr, err)
+		}
+		if !subset {
+			fmt.Fprintln(stdout, c.mark+addr.String())
+			code = exit_none
+		}
+	}
+	return code
+}
+
+// hostsError prints the error of the addresses of a compiled expression,
+// whose masks may be too scattered for prefixes
+func hostsError(stderr io.Writer, err error) int {
+	if errors.Is(err, filter.ErrNotPrefix) {
+		fmt.Fprintln(stderr, "ipfilter: the expression compiles, but its addresses cannot be represented as prefixes:", err)
+		return exit_hosts
+	}
+	fmt.Fprintln(stderr, "ipfilter:", err)
+	return exit_compile
+}
+
+func runExplain(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 2 {
+		fmt.Fprintln(stderr, "usage: ipfilter explain expr addr ...")
+		return exit_usage
+	}
+	f := filter.FilterT{}
+	if err := f.CompileAll(args[0]); err != nil {
+		printCompileError(stderr, args[0], err)
+		return exit_compile
+	}
+
+	code := exit_printed
+	for i, arg := range args[1:] {
+		ip, ok := parseAddr(arg)
+		if !ok {
+			fmt.Fprintf(stderr, "ipfilter: malformed address %q\n", arg)
+			return exit_usage
+		}
+		e, err := f.Explain(ip)
+		if err != nil {
+			fmt.Fprintln(stderr, "ipfilter:", err)
+			return exit_usage
+		}
+		if i != 0 {
+			fmt.Fprintln(stdout)
+		}
+		fmt.Fprintln(stdout, e)
+		if !e.Matched() {
+			code = exit_none
+		}
+	}
+	return code
+}
+
+// printCompileError prints every error of err, with a caret under the token
+// it is about
+func printCompileError(w io.Writer, expr string, err error) {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, err := range errs {
+		fmt.Fprintln(w, "ipfilter:", err)
+		var parseErr *filter.ParseError
+		if errors.As(err, &parseErr) {
+			for _, line := range strings.Split(parseErr.Diagnostic(expr), "\n") {
+				fmt.Fprintln(w, "\t"+line)
+			}
+		}
+	}
+}
+
+// parseAddr parses an address, with or without a port
+func parseAddr(s string) (netip.Addr, bool) {
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return ip, true
+	}
+	if ipPort, err := netip.ParseAddrPort(s); err == nil {
+		return ipPort.Addr(), true
+	}
+	return netip.Addr{}, false
+}
+
+func addrOfLine(line string) (netip.Addr, bool) {
+	return parseAddr(strings.TrimSpace(line))
+}
+
+func addrOfField(field int, delim string) addrFunc {
+	return func(line string) (netip.Addr, bool) {
+		var fields []string
+		if delim == "" {
+			fields = strings.Fields(line)
+		} else {
+			fields = strings.Split(line, delim)
+		}
+		if field > len(fields) {
+			return netip.Addr{}, false
+		}
+		return parseAddr(strings.TrimSpace(fields[field-1]))
+	}
+}
+
+func addrOfRegexp(re *regexp.Regexp) addrFunc {
+	return func(line string) (netip.Addr, bool) {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			return netip.Addr{}, false
+		} else if len(m) > 1 {
+			return parseAddr(m[1])
+		}
+		return parseAddr(m[0])
+	}
+}
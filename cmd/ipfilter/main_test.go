@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const input = `10.0.0.1
+192.168.1.1
+2001:db8::1
+not an address
+172.16.0.1:8080
+`
+
+const log = `2024-01-01T00:00:00 GET /index.html client=10.0.0.1 status=200
+2024-01-01T00:00:01 GET /admin client=8.8.8.8 status=403
+2024-01-01T00:00:02 GET /health client=[2001:db8::7]:443 status=200
+`
+
+func runArgs(t *testing.T, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRun(t *testing.T) {
+	for _, c := range []struct {
+		args  []string
+		stdin string
+		code  int
+		out   string
+	}{
+		{[]string{"10 or 172.16"}, input, 0, "10.0.0.1\n172.16.0.1:8080\n"},
+		{[]string{"-v", "10 or 172.16"}, input, 0, "192.168.1.1\n2001:db8::1\nnot an address\n"},
+		{[]string{"-a", "2001:db8::/32"}, input, 0, "nomatch\t10.0.0.1\nnomatch\t192.168.1.1\nmatch\t2001:db8::1\nnoaddr\tnot an address\nnomatch\t172.16.0.1:8080\n"},
+		{[]string{"1.2.3.4"}, input, 1, ""},
+		{[]string{"-f", "2", "-d", ",", "not 10"}, "a,10.0.0.1,x\nb, 8.8.8.8 ,y\nc\n", 0, "b, 8.8.8.8 ,y\n"},
+		{[]string{"-r", `client=\[?([0-9a-f.:]+?)\]?(:\d+)? `, "10 or 2001:db8::/32"}, log, 0, strings.SplitAfter(log, "\n")[0] + strings.SplitAfter(log, "\n")[2]},
+		{[]string{"-r", `\d+\.\d+\.\d+\.\d+`, "8.8.8.8"}, log, 0, strings.SplitAfter(log, "\n")[1]},
+		{[]string{"-f", "1", "10"}, "10.0.0.1 a\n 10.0.0.2\nx 10.0.0.3\n", 0, "10.0.0.1 a\n 10.0.0.2\n"},
+	} {
+		code, out, stderr := runArgs(t, c.stdin, c.args...)
+		if code != c.code || out != c.out {
+			t.Errorf("ipfilter %q: expect %d %q, got %d %q, stderr %q", c.args, c.code, c.out, code, out, stderr)
+		}
+	}
+}
+
+func TestRunFields(t *testing.T) {
+	code, out, _ := runArgs(t, "", "-f", "4", "net 10")
+	if code != 1 || out != "" {
+		t.Errorf("expect no output, got %d %q", code, out)
+	}
+	code, out, _ = runArgs(t, log, "-f", "4", "-r", "x", "10")
+	if code != exit_usage || out != "" {
+		t.Errorf("expect a usage error, got %d %q", code, out)
+	}
+}
+
+func TestRunFiles(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if err := os.WriteFile(a, []byte("10.0.0.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("10.0.0.2\n11.0.0.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if code, out, _ := runArgs(t, "", "10", a, b); code != 0 || out != "10.0.0.1\n10.0.0.2\n" {
+		t.Errorf("expect both files, got %d %q", code, out)
+	}
+	if code, out, stderr := runArgs(t, "", "10", a, filepath.Join(dir, "missing")); code != exit_usage || out != "10.0.0.1\n" || stderr == "" {
+		t.Errorf("expect a read error, got %d %q %q", code, out, stderr)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	code, out, stderr := runArgs(t, input, "10 and 300.1")
+	if code != exit_compile || out != "" {
+		t.Errorf("expect a compile error, got %d %q", code, out)
+	}
+	if !strings.Contains(stderr, "[1008]") || !strings.Contains(stderr, "\t10 and 300.1\n\t       ^ [1008] ip domain must be 0~255\n") {
+		t.Errorf("expect a caret under the token, got %q", stderr)
+	}
+	if code, _, stderr := runArgs(t, input, ""); code != exit_compile || !strings.Contains(stderr, "\t\n\t^ [1000]") {
+		t.Errorf("expect a caret after the end, got %d %q", code, stderr)
+	}
+	if code, _, stderr := runArgs(t, input, "300.1 or 10/40"); code != exit_compile || strings.Count(stderr, "^") != 2 {
+		t.Errorf("expect every error, got %d %q", code, stderr)
+	}
+	for _, args := range [][]string{{}, {"-v", "-a", "10"}, {"-x", "10"}, {"-r", "(", "10"}, {"-f", "-1", "10"}} {
+		if code, _, _ := runArgs(t, input, args...); code != exit_usage {
+			t.Errorf("ipfilter %q: expect %d, got %d", args, exit_usage, code)
+		}
+	}
+}
+
+func TestRunFmt(t *testing.T) {
+	for _, c := range []struct {
+		args  []string
+		stdin string
+		code  int
+		out   string
+	}{
+		{[]string{"fmt", "10 AND (172.16)", "!tcp"}, "", 0, "10.0.0.0/8 and 172.16.0.0/16\nnot tcp\n"},
+		{[]string{"fmt"}, "10 || 11\n\n(12)\n", 0, "10.0.0.0/8 or 11.0.0.0/8\n\n12.0.0.0/8\n"},
+		{[]string{"fmt", "-c", "10.0.0.0/8 or 11.0.0.0/8"}, "", 0, ""},
+		{[]string{"fmt", "-c"}, "10.0.0.0/8\n11\n", 1, ""},
+		{[]string{"fmt", "-c", "private and not src loopback"}, "", 0, ""},
+		{[]string{"fmt", "Private OR 10"}, "", 0, "private or 10.0.0.0/8\n"},
+		{[]string{"fmt", "10", "10 and"}, "", 3, "10.0.0.0/8\n"},
+		{[]string{"fmt", "-O", "10 or 10.1.2.3", "not not 11"}, "", 0, "10.0.0.0/8\n11.0.0.0/8\n"},
+		{[]string{"fmt", "-c", "-O", "10.0.0.0/9 or 10.128.0.0/9"}, "", 1, ""},
+		{[]string{"fmt", "-x"}, "", 2, ""},
+	} {
+		code, out, stderr := runArgs(t, c.stdin, c.args...)
+		if code != c.code || out != c.out {
+			t.Errorf("ipfilter %q: expect %d %q, got %d %q, stderr %q", c.args, c.code, c.out, code, out, stderr)
+		}
+	}
+}
+
+func TestRunCIDRs(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		code int
+		out  string
+	}{
+		{[]string{"cidrs", "10 and not 10.128.0.0/9 and not 10.0.0.0/10"}, 0, "10.64.0.0/10\n"},
+		{[]string{"cidrs", "(10 or 2001:db8::/32) and not 10.1.0.0/16"}, 0, "10.0.0.0/16\n10.2.0.0/15\n10.4.0.0/14\n10.8.0.0/13\n10.16.0.0/12\n10.32.0.0/11\n10.64.0.0/10\n10.128.0.0/9\n2001:db8::/32\n"},
+		{[]string{"cidrs", "-r", "10 and not 10.1"}, 0, "10.0.0.0-10.0.255.255\n10.2.0.0-10.255.255.255\n"},
+		{[]string{"cidrs", "port 80"}, 0, ""},
+		{[]string{"cidrs", "10 and"}, 3, ""},
+		{[]string{"cidrs", "10.*.3.* and 10.0.0.0/15"}, 0, "10.0.3.0/24\n10.1.3.0/24\n"},
+		{[]string{"cidrs", "2001:db8::1 mask ffff:ffff::ffff"}, 4, ""},
+		{[]string{"cidrs", "-r", "2001:db8::1 mask ffff:ffff::ffff"}, 4, ""},
+		{[]string{"cidrs"}, 2, ""},
+	} {
+		code, out, stderr := runArgs(t, "", c.args...)
+		if code != c.code || out != c.out {
+			t.Errorf("ipfilter %q: expect %d %q, got %d %q, stderr %q", c.args, c.code, c.out, code, out, stderr)
+		}
+	}
+	_, _, stderr := runArgs(t, "", "cidrs", "2001:db8::1 mask ffff:ffff::ffff")
+	if !strings.Contains(stderr, "compiles, but its addresses cannot be represented as prefixes") {
+		t.Errorf("unexpected stderr %q", stderr)
+	}
+}
+
+func TestRunCmp(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		code int
+		out  string
+	}{
+		{[]string{"cmp", "10", "10.0.0.0/9 or 10.128.0.0/9"}, 0, ""},
+		{[]string{"cmp", "10", "10 and not 10.1"}, 1, "-10.1.0.0\n"},
+		{[]string{"cmp", "10 or 2001:db8::/32", "11 or 2001:db8::/32"}, 1, "-10.0.0.0\n+11.0.0.0\n"},
+		{[]string{"cmp", "10", "(10"}, 3, ""},
+		{[]string{"cmp", "10.*.3.*", "10.0.3.0 wildcard 0.255.0.255"}, 0, ""},
+		{[]string{"cmp", "10", "2001:db8::1 mask ffff:ffff::ffff"}, 4, ""},
+		{[]string{"cmp", "10"}, 2, ""},
+	} {
+		code, out, stderr := runArgs(t, "", c.args...)
+		if code != c.code || out != c.out {
+			t.Errorf("ipfilter %q: expect %d %q, got %d %q, stderr %q", c.args, c.code, c.out, code, out, stderr)
+		}
+	}
+}
+
+func TestRunExplain(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		code int
+		out  string
+	}{
+		{[]string{"explain", "10 or 11", "10.0.0.1"}, 0, "10.0.0.1 matches\n10 or 11\n^~~~~~~~ true\n^~ true\n      ^~ false\n"},
+		{[]string{"explain", "not 10", "10.0.0.1", "11.0.0.1:80"}, 1,
+			"10.0.0.1 does not match\nnot 10\n^~~~~~ false\n    ^~ true\n\n11.0.0.1 matches\nnot 10\n^~~~~~ true\n    ^~ false\n"},
+		{[]string{"explain", "10", "x"}, 2, ""},
+		{[]string{"explain", "10"}, 2, ""},
+		{[]string{"explain", "10 or", "10.0.0.1"}, 3, ""},
+	} {
+		code, out, stderr := runArgs(t, "", c.args...)
+		if code != c.code || out != c.out {
+			t.Errorf("ipfilter %q: expect %d %q, got %d %q, stderr %q", c.args, c.code, c.out, code, out, stderr)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package filter
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// builtinSets are the sets of the IANA special-purpose address registries,
+// used as keywords or as @name if an env does not define name
+var builtinSets map[string][]netip.Prefix = map[string][]netip.Prefix{
+	"private":       prefixes("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"),
+	"loopback":      prefixes("127.0.0.0/8", "::1/128"),
+	"linklocal":     prefixes("169.254.0.0/16", "fe80::/10"),
+	"multicast":     prefixes("224.0.0.0/4", "ff00::/8"),
+	"broadcast":     prefixes("255.255.255.255/32"),
+	"reserved":      prefixes("0.0.0.0/8", "240.0.0.0/4", "::/128", "100::/64", "2001::/23"),
+	"cgnat":         prefixes("100.64.0.0/10"),
+	"documentation": prefixes("192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "2001:db8::/32", "3fff::/20"),
+}
+
+func prefixes(cidrs ...string) []netip.Prefix {
+	var list []netip.Prefix
+	for _, cidr := range cidrs {
+		list = append(list, netip.MustParsePrefix(cidr))
+	}
+	return list
+}
+
+// EnvT defines the names a filter may use. A set, used as @name, matches a
+// host in any of its networks, and a macro, used as $name, is a filter which
+// may use names itself. A qualifier of a name qualifies each value of it, as
+// "src @office" is "src 10.1.0.0/16 or src 10.2.0.0/16" for a set office of
+// those networks. The built-in sets private, loopback, linklocal,
+// multicast, broadcast, reserved, cgnat and documentation are keywords, and
+// are @name too unless the env defines a set of that name.
+type EnvT struct {
+	Sets   map[string][]netip.Prefix
+	Macros map[string]string
+}
+
+// compile compiles filter to its rpn with the names expanded, macros are
+// the macros being expanded, for a cycle is an error
+func compile(filter string, mode HostMode, env *EnvT, macros []string) ([]tokenT, error) {
+	tokens, err := tokenize(filter, mode)
+	if err != nil {
+		return nil, err
+	}
+	rpn, err := toRPN(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return expandNames(rpn, filter, mode, env, macros)
+}
+
+// expandNames replaces each name of rpn by the rpn of its definition
+func expandNames(rpn []tokenT, filter string, mode HostMode, env *EnvT, macros []string) ([]tokenT, error) {
+	var expanded []tokenT
+	for _, token := range rpn {
+		if token.t == token_value || !isValue(token.t) {
+			expanded = append(expanded, token)
+			continue
+		}
+		values, err := expandName(token, filter, mode, env, macros)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, values...)
+	}
+	return expanded, nil
+}
+
+// expandName returns the rpn of the definition of the name token, qualified
+// by its qualifiers, every token of it is in the position of the name, a
+// macro is compiled in mode too
+func expandName(token tokenT, filter string, mode HostMode, env *EnvT, macros []string) ([]tokenT, error) {
+	_, end, _ := lex(&filter, token.pos, mode)
+	name := filter[token.pos:end]
+
+	var rpn []tokenT
+	if token.t == token_set {
+		var prefixes []netip.Prefix
+		found := false
+		if name[0] != '@' {
+			prefixes, found = builtinSets[strings.ToLower(name)]
+		} else if env != nil {
+			prefixes, found = env.Sets[name[1:]]
+		}
+		if !found && name[0] == '@' {
+			prefixes, found = builtinSets[name[1:]]
+		}
+		if !found {
+			return nil, nameError(err_code_undefined, token, name)
+		} else if len(prefixes) == 0 {
+			return nil, nameError(err_code_definition, token, name+": empty set")
+		}
+		for i, p := range prefixes {
+			if !p.IsValid() {
+				return nil, nameError(err_code_definition, token, name+": "+p.String())
+			}
+			rpn = append(rpn, tokenT{t: token_value, cidr: cidrFromPrefix(p)})
+			if i != 0 {
+				rpn = append(rpn, tokenT{t: token_or})
+			}
+		}
+	} else {
+		var macro string
+		found := false
+		if env != nil {
+			macro, found = env.Macros[name[1:]]
+		}
+		if !found {
+			return nil, nameError(err_code_undefined, token, name)
+		}
+		for _, expanding := range macros {
+			if expanding == name {
+				return nil, nameError(err_code_cycle, token, name)
+			}
+		}
+		var err error
+		rpn, err = compile(macro, mode, env, append(macros[:len(macros):len(macros)], name))
+		if err != nil {
+			return nil, definitionError(token, name, err)
+		}
+	}
+
+	for i := range rpn {
+		rpn[i].pos = token.pos
+		if rpn[i].t != token_value {
+			continue
+		}
+		if err := qualifyValue(&rpn[i], token); err != nil {
+			return nil, err
+		}
+	}
+	return rpn, nil
+}
+
+// qualifyName records the qualifier q of a name in its token
+func qualifyName(name *tokenT, q tokenT) error {
+	switch q.t {
+	case token_src, token_dst:
+		if name.dir != dir_any {
+			return NewErrorToken(err_code_dup_qualifier, q.t, q.pos)
+		}
+		name.dir = dir_src
+		if q.t == token_dst {
+			name.dir = dir_dst
+		}
+	case token_host, token_net:
+		if name.kind != kind_any {
+			return NewErrorToken(err_code_dup_qualifier, q.t, q.pos)
+		}
+		name.kind = kind_net
+		if q.t == token_host {
+			name.kind = kind_host
+		}
+	}
+	return nil
+}
+
+// qualifyValue qualifies a value of a name as the name is qualified
+func qualifyValue(value *tokenT, name tokenT) error {
+	if name.dir != dir_any {
+		if !isCidr(*value) && value.kind != kind_port && value.kind != kind_portrange {
+			return NewErrorToken(err_code_qualifier, name.t, name.pos)
+		} else if value.dir != dir_any {
+			return NewErrorToken(err_code_dup_qualifier, name.t, name.pos)
+		}
+		value.dir = name.dir
+	}
+	if name.kind != kind_any {
+		if !isCidr(*value) {
+			return NewErrorToken(err_code_qualifier, name.t, name.pos)
+		} else if value.kind != kind_any {
+			return NewErrorToken(err_code_dup_qualifier, name.t, name.pos)
+		} else if n, _ := maskLen(value.cidr.mask); name.kind == kind_host && n != 128 {
+			return NewErrorToken(err_code_host, name.t, name.pos)
+		}
+		value.kind = name.kind
+	}
+	return nil
+}
+
+func nameError(code int, token tokenT, detail string) error {
+	return &ParseError{Code: code, Token: tokenOut[token.t], Pos: token.pos, Msg: errorTokenMsg[code] + " " + detail}
+}
+
+// definitionError moves err of the definition of name to the position of
+// name, the error keeps its code
+func definitionError(token tokenT, name string, err error) error {
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		return err
+	}
+	in := "in " + name
+	if parseErr.Pos >= 0 && parseErr.Token != "" {
+		in += " at " + strconv.Itoa(parseErr.Pos)
+	}
+	return &ParseError{Code: parseErr.Code, Token: tokenOut[token.t], Pos: token.pos, Msg: in + ": " + parseErr.Msg}
+}
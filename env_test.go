@@ -0,0 +1,156 @@
+package filter
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func testEnv() *EnvT {
+	return &EnvT{
+		Sets: map[string][]netip.Prefix{
+			"private": {netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("172.16.0.0/12"), netip.MustParsePrefix("192.168.0.0/16")},
+			"office":  {netip.MustParsePrefix("203.0.113.0/24"), netip.MustParsePrefix("2001:db8:1::/48")},
+			"gateway": {netip.MustParsePrefix("203.0.113.1/32")},
+			"empty":   {},
+		},
+		Macros: map[string]string{
+			"web":         "tcp and (port 80 or port 443)",
+			"internal":    "@private or @office",
+			"office-web":  "$web and src @office",
+			"a":           "10 or $b",
+			"b":           "11 and $c",
+			"c":           "$a",
+			"self":        "$self",
+			"bad":         "10 and 300.1",
+			"undef":       "$nothing",
+			"ports":       "port 22",
+			"from-office": "src @office",
+		},
+	}
+}
+
+func TestCompileEnv(t *testing.T) {
+	env := testEnv()
+	for filter, expect := range map[string]string{
+		"@private":                      "10.0.0.0/8 or 172.16.0.0/12 or 192.168.0.0/16",
+		"src @office and not $web":      "src 203.0.113.0/24 or src 2001:db8:1::/48 and not (tcp and (port 80 or port 443))",
+		"$internal":                     "10.0.0.0/8 or 172.16.0.0/12 or 192.168.0.0/16 or (203.0.113.0/24 or 2001:db8:1::/48)",
+		"$office-web":                   "tcp and (port 80 or port 443) and (src 203.0.113.0/24 or src 2001:db8:1::/48)",
+		"dst $ports":                    "dst port 22",
+		"host @gateway or net @private": "host 203.0.113.1/32 or (net 10.0.0.0/8 or net 172.16.0.0/12 or net 192.168.0.0/16)",
+	} {
+		f := FilterT{}
+		if err := f.CompileEnv(filter, env); err != nil {
+			t.Fatal(filter, err)
+		}
+		if f.GetFilter() != filter || f.Expr().String() != expect {
+			t.Errorf("CompileEnv(%q): expect %q, got %q", filter, expect, f.Expr().String())
+		}
+		if f.String() != filter {
+			t.Errorf("String() of %q: expect the names kept, got %q", filter, f.String())
+		}
+		g := FilterT{}
+		if err := g.Compile(expect); err != nil {
+			t.Fatal(err)
+		}
+		if !compareTokens(clearPos(f.rpn), clearPos(g.rpn)) {
+			t.Errorf("CompileEnv(%q): expect rpn %s, got %s", filter, g.GetRPN(), f.GetRPN())
+		}
+	}
+
+	f := FilterT{}
+	if err := f.CompileEnv("src @office", env); err != nil {
+		t.Fatal(err)
+	}
+	e := f.Expr()
+	Walk(e, func(e Expr) bool {
+		if e.Source() != (Span{0, 11}) {
+			t.Errorf("span of %s is %v", e, e.Source())
+		}
+		return true
+	})
+	if !f.CheckPair(netip.MustParseAddr("203.0.113.9"), netip.MustParseAddr("1.1.1.1")) ||
+		f.CheckPair(netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("203.0.113.9")) {
+		t.Error("unexpected check of src @office")
+	}
+}
+
+func TestCompileEnvErrors(t *testing.T) {
+	env := testEnv()
+	for _, c := range []struct {
+		filter string
+		err    error
+		pos    int
+		msg    string
+	}{
+		{"10 or @nothing", ErrUndefined, 6, "undefined name @nothing"},
+		{"10 or $nothing", ErrUndefined, 6, "undefined name $nothing"},
+		{"10 and $undef", ErrUndefined, 7, "in $undef at 0: undefined name $nothing"},
+		{"$a", ErrCycle, 0, "in $a at 6: in $b at 7: in $c at 0: cyclic definition $a"},
+		{"not $self", ErrCycle, 4, "in $self at 0: cyclic definition $self"},
+		{"$bad", ErrIPDomain, 0, "in $bad at 7: ip domain must be 0~255"},
+		{"@empty", ErrDefinition, 0, "malformed definition @empty: empty set"},
+		{"host @private", ErrHost, 5, "host must be a full address"},
+		{"src src @office", ErrDupQualifier, 0, "duplicate qualifier"},
+		{"src $web", ErrQualifier, 4, "qualifier must be followed by an address"},
+		{"dst $from-office", ErrDupQualifier, 4, "duplicate qualifier"},
+		{"10 or @", ErrToken, 6, "malformed token"},
+	} {
+		f := FilterT{}
+		err := f.CompileEnv(c.filter, env)
+		var parseErr *ParseError
+		if !errors.Is(err, c.err) || !errors.As(err, &parseErr) || parseErr.Pos != c.pos || parseErr.Msg != c.msg {
+			t.Errorf("CompileEnv(%q): expect %v in %d %q, got %v", c.filter, c.err, c.pos, c.msg, err)
+		}
+	}
+
+	f := FilterT{}
+	if err := f.Compile("@office"); !errors.Is(err, ErrUndefined) {
+		t.Errorf("expect ErrUndefined without env, got %v", err)
+	}
+	err := f.CompileAll("10 or @nothing or (11 and $nothing)")
+	if !errors.Is(err, ErrUndefined) || f.String() != "10.0.0.0/8 or 11.0.0.0/8" {
+		t.Errorf("CompileAll: got %v, %q", err, f.String())
+	}
+}
+
+func TestBuiltinSets(t *testing.T) {
+	for filter, expect := range map[string]string{
+		"private":                         "10.0.0.0/8 or 172.16.0.0/12 or 192.168.0.0/16 or fc00::/7",
+		"@private":                        "10.0.0.0/8 or 172.16.0.0/12 or 192.168.0.0/16 or fc00::/7",
+		"Loopback or linklocal":           "127.0.0.0/8 or ::1/128 or (169.254.0.0/16 or fe80::/10)",
+		"src private and not dst private": "src 10.0.0.0/8 or src 172.16.0.0/12 or src 192.168.0.0/16 or src fc00::/7 and not (dst 10.0.0.0/8 or dst 172.16.0.0/12 or dst 192.168.0.0/16 or dst fc00::/7)",
+		"multicast or broadcast":          "224.0.0.0/4 or ff00::/8 or 255.255.255.255/32",
+		"cgnat":                           "100.64.0.0/10",
+		"not reserved":                    "not (0.0.0.0/8 or 240.0.0.0/4 or ::/128 or 100::/64 or 2001::/23)",
+		"documentation and port 80":       "192.0.2.0/24 or 198.51.100.0/24 or 203.0.113.0/24 or 2001:db8::/32 or 3fff::/20 and port 80",
+		"dst documentation or dst 10":     "dst 192.0.2.0/24 or dst 198.51.100.0/24 or dst 203.0.113.0/24 or dst 2001:db8::/32 or dst 3fff::/20 or dst 10.0.0.0/8",
+	} {
+		f := FilterT{}
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(filter, err)
+		}
+		if f.Expr().String() != expect {
+			t.Errorf("Compile(%q): expect %q, got %q", filter, expect, f.Expr().String())
+		}
+	}
+
+	f := FilterT{}
+	for addr, expect := range map[string]bool{"10.1.2.3": true, "fd00::1": true, "11.0.0.1": false, "2001:db8::1": false} {
+		if err := f.Compile("private"); err != nil {
+			t.Fatal(err)
+		}
+		if f.CheckAddr(netip.MustParseAddr(addr)) != expect {
+			t.Errorf("private, %s: expect %v", addr, expect)
+		}
+	}
+	if err := f.CompileEnv("@private", testEnv()); err != nil || f.CheckAddr(netip.MustParseAddr("fd00::1")) {
+		t.Errorf("expect @private of the env, got %v, %q", err, f.String())
+	}
+	for _, filter := range []string{"privates", "loop", "cgnat1", "multi"} {
+		if err := f.Compile(filter); !errors.Is(err, ErrToken) {
+			t.Errorf("Compile(%q): expect ErrToken, got %v", filter, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Trace is the result of a node of the filter for a host, with the traces
+// of its operands.
+type Trace struct {
+	Expr     Expr // the node, spanning its text in the filter
+	Result   bool
+	Operands []*Trace
+}
+
+// Explanation is how a filter matches a host or not, as CheckAddr does.
+type Explanation struct {
+	Filter string
+	Addr   netip.Addr
+	Trace  *Trace
+}
+
+// Explain evaluates the filter for addr node by node, every operand is
+// evaluated even if the result is decided without it.
+func (f *FilterT) Explain(addr netip.Addr) (*Explanation, error) {
+	if !f.OK() {
+		return nil, ErrNotCompiled
+	} else if !addr.IsValid() {
+		return nil, &HostError{Host: addr.String(), Err: ErrHostMalformed}
+	}
+	ip := HostFromAddr(addr).ip
+	pkt := &pktT{src: ip, dst: ip, hasSrc: true, hasDst: true}
+	return &Explanation{Filter: f.filter, Addr: HostT{ip: ip}.Addr(), Trace: trace(f.Expr(), pkt)}, nil
+}
+
+// Matched reports whether the filter matches the host.
+func (e *Explanation) Matched() bool {
+	return e.Trace.Result
+}
+
+// String renders the trace under the filter, a line for each node, in
+// preorder, with its text marked and its result:
+//
+//	10.1.2.3 does not match
+//	10 and not 10.1.0.0/16
+//	^~~~~~~~~~~~~~~~~~~~~~ false
+//	^~ true
+//	       ^~~~~~~~~~~~~~~ false
+//	           ^~~~~~~~~~~ true
+func (e *Explanation) String() string {
+	var b strings.Builder
+	b.WriteString(e.Addr.String())
+	if e.Matched() {
+		b.WriteString(" matches\n")
+	} else {
+		b.WriteString(" does not match\n")
+	}
+	b.WriteString(e.Filter)
+	var write func(t *Trace)
+	write = func(t *Trace) {
+		span := t.Expr.Source()
+		b.WriteByte('\n')
+		for i := 0; i < span.End && i < len(e.Filter); i++ {
+			switch {
+			case e.Filter[i] == '\t':
+				b.WriteByte('\t')
+			case i < span.Pos:
+				b.WriteByte(' ')
+			case i == span.Pos:
+				b.WriteByte('^')
+			default:
+				b.WriteByte('~')
+			}
+		}
+		if t.Result {
+			b.WriteString(" true")
+		} else {
+			b.WriteString(" false")
+		}
+		for _, operand := range t.Operands {
+			write(operand)
+		}
+	}
+	write(e.Trace)
+	return b.String()
+}
+
+func trace(e Expr, pkt *pktT) *Trace {
+	t := &Trace{Expr: e}
+	switch n := e.(type) {
+	case *And:
+		x, y := trace(n.X, pkt), trace(n.Y, pkt)
+		t.Result, t.Operands = x.Result && y.Result, []*Trace{x, y}
+	case *Or:
+		x, y := trace(n.X, pkt), trace(n.Y, pkt)
+		t.Result, t.Operands = x.Result || y.Result, []*Trace{x, y}
+	case *Not:
+		x := trace(n.X, pkt)
+		t.Result, t.Operands = !x.Result, []*Trace{x}
+	default:
+		token, _ := tokenOf(e)
+		t.Result = checkValue(pkt, token)
+	}
+	return t
+}
@@ -0,0 +1,66 @@
+package filter
+
+import (
+	"errors"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	f := FilterT{}
+	if err := f.Compile("10 and not (10.1 or\tsrc port 80)"); err != nil {
+		t.Fatal(err)
+	}
+	e, err := f.Explain(netip.MustParseAddr("::ffff:10.1.2.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "10.1.2.3 does not match\n" +
+		"10 and not (10.1 or\tsrc port 80)\n" +
+		"^~~~~~~~~~~~~~~~~~~\t~~~~~~~~~~~~ false\n" +
+		"^~ true\n" +
+		"       ^~~~~~~~~~~~\t~~~~~~~~~~~~ false\n" +
+		"           ^~~~~~~~\t~~~~~~~~~~~~ true\n" +
+		"            ^~~~ true\n" +
+		"                   \t^~~~~~~~~~~ false"
+	if e.String() != expect {
+		t.Errorf("expect\n%s\ngot\n%s", expect, e.String())
+	}
+	if e.Matched() {
+		t.Error("expect no match")
+	}
+	leaf := e.Trace.Operands[1].Operands[0].Operands[0]
+	if p, ok := leaf.Expr.(*Prefix); !ok || leaf.Expr.Source() != (Span{12, 16}) || p.Prefix != netip.MustParsePrefix("10.1.0.0/16") || !leaf.Result {
+		t.Errorf("unexpected trace of 10.1: %+v", leaf)
+	}
+
+	if _, err := f.Explain(netip.Addr{}); !errors.Is(err, ErrHostMalformed) {
+		t.Errorf("expect ErrHostMalformed, got %v", err)
+	}
+	if _, err := (&FilterT{}).Explain(netip.MustParseAddr("10.0.0.1")); !errors.Is(err, ErrNotCompiled) {
+		t.Errorf("expect ErrNotCompiled, got %v", err)
+	}
+}
+
+func TestExplainRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	probes := tableProbes(r)[:500]
+	for n := 0; n < 100; n++ {
+		filter := randomFilter(r, 4)
+		f := FilterT{}
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		for _, ip := range probes {
+			addr := HostT{ip: ip}.Addr()
+			e, err := f.Explain(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Matched() != f.CheckAddr(addr) {
+				t.Fatalf("Explain(%s) of %q: expect %v", addr, filter, f.CheckAddr(addr))
+			}
+		}
+	}
+}
@@ -3,28 +3,48 @@ package filter
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+// cidrT is an ipv4 or ipv6 network, ipv4 networks are kept v4-mapped. A
+// range is the hosts ip~last of one family instead, its mask is zero
 type cidrT struct {
-	ip   int
-	mask int
+	ip      ipT
+	mask    ipT
+	last    ipT
+	isRange bool
+}
+
+// portsT is an inclusive port range
+type portsT struct {
+	lo int
+	hi int
 }
 
 type tokenT struct {
-	t    int
-	cidr cidrT
-	pos  int
+	t     int
+	cidr  cidrT
+	pos   int
+	dir   int // direction qualifier of a value
+	kind  int // type qualifier of a value
+	ports portsT
+	proto int // ip protocol number of a protocol value
 }
 
 type FilterT struct {
-	filter string
-	rpn    []tokenT
+	Mode    HostMode // how Compile reads the ipv4 addresses of a filter
+	filter  string
+	rpn     []tokenT
+	table   *tableT // hosts matched, nil if the rpn must be walked
+	partial bool    // the rpn is what CompileAll left of the filter
 }
 
 const (
-	token_not_exsits = -2 // for errorTokenT
+	token_not_exsits = -2 // for ParseError
 	token_space      = -1
 	token_unknown    = 0
 	token_value      = 1
@@ -34,18 +54,71 @@ const (
 	token_left       = 5
 	token_right      = 6
 	token_border     = 7
+	token_src        = 8
+	token_dst        = 9
+	token_host       = 10
+	token_net        = 11
+	token_port       = 12 // lexed into a port value
+	token_portrange  = 13 // lexed into a port range value
+	token_proto      = 14 // lexed into a protocol value
+	token_set        = 15 // @name, a value expanded to a set of networks
+	token_macro      = 16 // $name, a value expanded to a filter
 )
 
+// direction qualifiers, a value without one matches either side
+const (
+	dir_any = 0
+	dir_src = 1
+	dir_dst = 2
+)
+
+// type qualifiers, a host value must be a full address, port values
+// carry ports and protocol values carry proto instead of a cidr
+const (
+	kind_any       = 0
+	kind_host      = 1
+	kind_net       = 2
+	kind_port      = 3
+	kind_portrange = 4
+	kind_proto     = 5
+	kind_proto4    = 6 // ip proto N, ipv4 only
+	kind_proto6    = 7 // ip6 proto N, ipv6 only
+)
+
+const (
+	proto_icmp  = 1
+	proto_tcp   = 6
+	proto_udp   = 17
+	proto_icmp6 = 58
+	proto_sctp  = 132
+)
+
+var protoNames map[int]string = map[int]string{
+	proto_icmp:  "icmp",
+	proto_tcp:   "tcp",
+	proto_udp:   "udp",
+	proto_icmp6: "icmp6",
+}
+
 var tokenOut map[int]string = map[int]string{
-	token_border:  "#",
-	token_left:    "(",
-	token_right:   ")",
-	token_and:     "and",
-	token_or:      "or",
-	token_not:     "not",
-	token_space:   "SPACE",
-	token_unknown: "UNKNOWN",
-	token_value:   "CIDR",
+	token_border:    "#",
+	token_left:      "(",
+	token_right:     ")",
+	token_and:       "and",
+	token_or:        "or",
+	token_not:       "not",
+	token_space:     "SPACE",
+	token_unknown:   "UNKNOWN",
+	token_value:     "CIDR",
+	token_src:       "src",
+	token_dst:       "dst",
+	token_host:      "host",
+	token_net:       "net",
+	token_port:      "port",
+	token_portrange: "portrange",
+	token_proto:     "proto",
+	token_set:       "SET",
+	token_macro:     "MACRO",
 }
 
 const (
@@ -57,13 +130,20 @@ const (
 
 /*
  *  Priority Table
- *      #  and  or  not  (  )
- * #    =  <    <   <    <  *
- * and  >  >    >   <    <  >
- * or   >  >    >   <    <  >
- * not  >  >    >   <    <  >
- * (    *  <    <   <    <  =
- * )    *  *    *   *    *  *
+ *       #    and  or   not  (    )    src  dst  host net
+ * #     =    <    <    <    <    *    <    <    <    <
+ * and   >    >    >    <    <    >    <    <    <    <
+ * or    >    >    >    <    <    >    <    <    <    <
+ * not   >    >    >    <    <    >    <    <    <    <
+ * (     *    <    <    <    <    =    <    <    <    <
+ * )     *    *    *    *    *    *    *    *    *    *
+ * src   >    >    >    <    <    >    <    <    <    <
+ * dst   >    >    >    <    <    >    <    <    <    <
+ * host  >    >    >    <    <    >    <    <    <    <
+ * net   >    >    >    <    <    >    <    <    <    <
+ *
+ * src, dst, host and net qualify the value that follows them, they are
+ * folded into that value instead of being output to the rpn
  */
 
 var ranks map[int]map[int]int = map[int]map[int]int{
@@ -74,6 +154,10 @@ var ranks map[int]map[int]int = map[int]map[int]int{
 		token_not:    rank_less,
 		token_left:   rank_less,
 		token_right:  rank_illegal,
+		token_src:    rank_less,
+		token_dst:    rank_less,
+		token_host:   rank_less,
+		token_net:    rank_less,
 	},
 	token_and: map[int]int{
 		token_border: rank_greater,
@@ -82,6 +166,10 @@ var ranks map[int]map[int]int = map[int]map[int]int{
 		token_not:    rank_less,
 		token_left:   rank_less,
 		token_right:  rank_greater,
+		token_src:    rank_less,
+		token_dst:    rank_less,
+		token_host:   rank_less,
+		token_net:    rank_less,
 	},
 	token_or: map[int]int{
 		token_border: rank_greater,
@@ -90,6 +178,10 @@ var ranks map[int]map[int]int = map[int]map[int]int{
 		token_not:    rank_less,
 		token_left:   rank_less,
 		token_right:  rank_greater,
+		token_src:    rank_less,
+		token_dst:    rank_less,
+		token_host:   rank_less,
+		token_net:    rank_less,
 	},
 	token_not: map[int]int{
 		token_border: rank_greater,
@@ -98,6 +190,10 @@ var ranks map[int]map[int]int = map[int]map[int]int{
 		token_not:    rank_less,
 		token_left:   rank_less,
 		token_right:  rank_greater,
+		token_src:    rank_less,
+		token_dst:    rank_less,
+		token_host:   rank_less,
+		token_net:    rank_less,
 	},
 	token_left: map[int]int{
 		token_border: rank_illegal,
@@ -106,6 +202,10 @@ var ranks map[int]map[int]int = map[int]map[int]int{
 		token_not:    rank_less,
 		token_left:   rank_less,
 		token_right:  rank_equal,
+		token_src:    rank_less,
+		token_dst:    rank_less,
+		token_host:   rank_less,
+		token_net:    rank_less,
 	},
 	token_right: map[int]int{
 		token_border: rank_illegal,
@@ -114,14 +214,70 @@ var ranks map[int]map[int]int = map[int]map[int]int{
 		token_not:    rank_illegal,
 		token_left:   rank_illegal,
 		token_right:  rank_illegal,
+		token_src:    rank_illegal,
+		token_dst:    rank_illegal,
+		token_host:   rank_illegal,
+		token_net:    rank_illegal,
+	},
+	token_src: map[int]int{
+		token_border: rank_greater,
+		token_and:    rank_greater,
+		token_or:     rank_greater,
+		token_not:    rank_less,
+		token_left:   rank_less,
+		token_right:  rank_greater,
+		token_src:    rank_less,
+		token_dst:    rank_less,
+		token_host:   rank_less,
+		token_net:    rank_less,
+	},
+	token_dst: map[int]int{
+		token_border: rank_greater,
+		token_and:    rank_greater,
+		token_or:     rank_greater,
+		token_not:    rank_less,
+		token_left:   rank_less,
+		token_right:  rank_greater,
+		token_src:    rank_less,
+		token_dst:    rank_less,
+		token_host:   rank_less,
+		token_net:    rank_less,
+	},
+	token_host: map[int]int{
+		token_border: rank_greater,
+		token_and:    rank_greater,
+		token_or:     rank_greater,
+		token_not:    rank_less,
+		token_left:   rank_less,
+		token_right:  rank_greater,
+		token_src:    rank_less,
+		token_dst:    rank_less,
+		token_host:   rank_less,
+		token_net:    rank_less,
+	},
+	token_net: map[int]int{
+		token_border: rank_greater,
+		token_and:    rank_greater,
+		token_or:     rank_greater,
+		token_not:    rank_less,
+		token_left:   rank_less,
+		token_right:  rank_greater,
+		token_src:    rank_less,
+		token_dst:    rank_less,
+		token_host:   rank_less,
+		token_net:    rank_less,
 	},
 }
 
-type errorTokenT struct {
-	msg  string
-	code int
-	t    int // token type
-	pos  int
+// ParseError is the error Compile returns. Code is the number in brackets
+// of Error, Token names the token in error, as "CIDR", "and" or "src", and
+// Pos is its offset in the filter string, Token is empty and Pos -1 if the
+// error is not about a token. Msg describes the error without them.
+type ParseError struct {
+	Code  int
+	Token string
+	Pos   int
+	Msg   string
 }
 
 const (
@@ -145,6 +301,38 @@ const (
 	err_code_ip_domain     = 1008
 	err_msg_token          = "malformed token"
 	err_code_token         = 1009
+	err_msg_mask6          = "malformed mask, valid is 0~128"
+	err_code_mask6         = 1010
+	err_msg_ip6            = "malformed ipv6 address"
+	err_code_ip6           = 1011
+	err_msg_qualifier      = "qualifier must be followed by an address"
+	err_code_qualifier     = 1012
+	err_msg_dup_qualifier  = "duplicate qualifier"
+	err_code_dup_qualifier = 1013
+	err_msg_host           = "host must be a full address"
+	err_code_host          = 1014
+	err_msg_port           = "malformed port, valid is 0~65535"
+	err_code_port          = 1015
+	err_msg_portrange      = "malformed port range, must be low-high"
+	err_code_portrange     = 1016
+	err_msg_proto          = "malformed protocol, valid is 0~255"
+	err_code_proto         = 1017
+	err_msg_undefined      = "undefined name"
+	err_code_undefined     = 1018
+	err_msg_cycle          = "cyclic definition"
+	err_code_cycle         = 1019
+	err_msg_definition     = "malformed definition"
+	err_code_definition    = 1020
+	err_msg_range          = "malformed address range, must be low-high of one family"
+	err_code_range         = 1021
+	err_msg_netmask        = "malformed netmask, must be an address of the family of the network"
+	err_code_netmask       = 1022
+	err_msg_wildcard       = "malformed wildcard, must be a dotted quad of numbers or *"
+	err_code_wildcard      = 1023
+	err_msg_leading_zero   = "leading zero is ambiguous, octal or decimal"
+	err_code_leading_zero  = 1024
+	err_msg_ip_integer     = "malformed integer address, valid is 0~4294967295"
+	err_code_ip_integer    = 1025
 )
 
 var errorTokenMsg map[int]string = map[int]string{
@@ -158,41 +346,255 @@ var errorTokenMsg map[int]string = map[int]string{
 	err_code_too_many_mask: err_msg_too_many_mask,
 	err_code_ip_domain:     err_msg_ip_domain,
 	err_code_token:         err_msg_token,
+	err_code_mask6:         err_msg_mask6,
+	err_code_ip6:           err_msg_ip6,
+	err_code_qualifier:     err_msg_qualifier,
+	err_code_dup_qualifier: err_msg_dup_qualifier,
+	err_code_host:          err_msg_host,
+	err_code_port:          err_msg_port,
+	err_code_portrange:     err_msg_portrange,
+	err_code_proto:         err_msg_proto,
+	err_code_undefined:     err_msg_undefined,
+	err_code_cycle:         err_msg_cycle,
+	err_code_definition:    err_msg_definition,
+	err_code_range:         err_msg_range,
+	err_code_netmask:       err_msg_netmask,
+	err_code_wildcard:      err_msg_wildcard,
+	err_code_leading_zero:  err_msg_leading_zero,
+	err_code_ip_integer:    err_msg_ip_integer,
+}
+
+// sentinels of the parse errors, a ParseError unwraps to the one of its Code
+var (
+	ErrFilter       = errors.New(err_msg_filter)
+	ErrNoValues     = errors.New(err_msg_no_values)
+	ErrBrackets     = errors.New(err_msg_brackets)
+	ErrCharactor    = errors.New(err_msg_charactor)
+	ErrMask         = errors.New(err_msg_mask)
+	ErrSetMask      = errors.New(err_msg_set_mask)
+	ErrIP           = errors.New(err_msg_ip)
+	ErrTooManyMask  = errors.New(err_msg_too_many_mask)
+	ErrIPDomain     = errors.New(err_msg_ip_domain)
+	ErrToken        = errors.New(err_msg_token)
+	ErrMask6        = errors.New(err_msg_mask6)
+	ErrIP6          = errors.New(err_msg_ip6)
+	ErrQualifier    = errors.New(err_msg_qualifier)
+	ErrDupQualifier = errors.New(err_msg_dup_qualifier)
+	ErrHost         = errors.New(err_msg_host)
+	ErrPort         = errors.New(err_msg_port)
+	ErrPortRange    = errors.New(err_msg_portrange)
+	ErrProto        = errors.New(err_msg_proto)
+	ErrUndefined    = errors.New(err_msg_undefined)
+	ErrCycle        = errors.New(err_msg_cycle)
+	ErrDefinition   = errors.New(err_msg_definition)
+	ErrRange        = errors.New(err_msg_range)
+	ErrNetmask      = errors.New(err_msg_netmask)
+	ErrWildcard     = errors.New(err_msg_wildcard)
+	ErrLeadingZero  = errors.New(err_msg_leading_zero)
+	ErrIPInteger    = errors.New(err_msg_ip_integer)
+)
+
+var errorTokenSentinel map[int]error = map[int]error{
+	err_code_filter:        ErrFilter,
+	err_code_no_values:     ErrNoValues,
+	err_code_brackets:      ErrBrackets,
+	err_code_charactor:     ErrCharactor,
+	err_code_mask:          ErrMask,
+	err_code_set_mask:      ErrSetMask,
+	err_code_ip:            ErrIP,
+	err_code_too_many_mask: ErrTooManyMask,
+	err_code_ip_domain:     ErrIPDomain,
+	err_code_token:         ErrToken,
+	err_code_mask6:         ErrMask6,
+	err_code_ip6:           ErrIP6,
+	err_code_qualifier:     ErrQualifier,
+	err_code_dup_qualifier: ErrDupQualifier,
+	err_code_host:          ErrHost,
+	err_code_port:          ErrPort,
+	err_code_portrange:     ErrPortRange,
+	err_code_proto:         ErrProto,
+	err_code_undefined:     ErrUndefined,
+	err_code_cycle:         ErrCycle,
+	err_code_definition:    ErrDefinition,
+	err_code_range:         ErrRange,
+	err_code_netmask:       ErrNetmask,
+	err_code_wildcard:      ErrWildcard,
+	err_code_leading_zero:  ErrLeadingZero,
+	err_code_ip_integer:    ErrIPInteger,
 }
 
 func NewErrorToken(code, t, pos int) error {
-	msg := "[" + strconv.FormatInt(int64(code), 10) + "]"
-	if t != token_not_exsits {
-		msg += " token \"" + tokenOut[t] + "\" in pos " + strconv.FormatInt(int64(pos), 10)
+	if t == token_not_exsits {
+		return &ParseError{Code: code, Pos: -1, Msg: errorTokenMsg[code]}
+	}
+	return &ParseError{Code: code, Token: tokenOut[t], Pos: pos, Msg: errorTokenMsg[code]}
+}
+
+func (e *ParseError) Error() string {
+	msg := "[" + strconv.FormatInt(int64(e.Code), 10) + "]"
+	if e.Token != "" {
+		msg += " token \"" + e.Token + "\" in pos " + strconv.FormatInt(int64(e.Pos), 10)
 	}
-	msg += ", " + errorTokenMsg[code]
-	return &errorTokenT{msg: msg, code: code, t: t, pos: pos}
+	return msg + ", " + e.Msg
 }
 
-func (e *errorTokenT) Error() string {
-	return e.msg
+func (e *ParseError) Unwrap() error {
+	return errorTokenSentinel[e.Code]
+}
+
+// Diagnostic renders the error under filter, the string that failed to
+// compile, with a caret under the token in error, or after the end of filter
+// if the error is not about a token:
+//
+//	10 and 300.1
+//	       ^ [1008] ip domain must be 0~255
+func (e *ParseError) Diagnostic(filter string) string {
+	pos := e.Pos
+	if pos < 0 || pos > len(filter) {
+		pos = len(filter)
+	}
+	caret := []rune{}
+	for _, ch := range filter[:pos] {
+		if ch != '\t' {
+			ch = ' '
+		}
+		caret = append(caret, ch)
+	}
+	code := "[" + strconv.FormatInt(int64(e.Code), 10) + "] "
+	return filter + "\n" + string(caret) + "^ " + code + e.Msg
 }
 
 const (
-	err_msg_parse_host_ip_domain = "ip domain must be 0~255"
-	err_msg_parse_host_malformed = "malformed"
+	err_msg_parse_host_ip_domain    = "ip domain must be 0~255"
+	err_msg_parse_host_malformed    = "malformed"
+	err_msg_parse_host_leading_zero = "leading zero is ambiguous"
 )
 
+var (
+	ErrHostIPDomain    = errors.New(err_msg_parse_host_ip_domain)
+	ErrHostMalformed   = errors.New(err_msg_parse_host_malformed)
+	ErrHostLeadingZero = errors.New(err_msg_parse_host_leading_zero)
+)
+
+// HostMode is how ipv4 addresses are read, by ParseHostMode and
+// ParseHostTMode and by Compile from the filter of a FilterT of that Mode.
+type HostMode int
+
+const (
+	// HostDefault reads dotted quads, and abbreviated networks in a filter.
+	HostDefault HostMode = 0
+	// HostStrict reads them as HostDefault does, but rejects a number with
+	// a leading zero, which some parsers take for octal.
+	HostStrict HostMode = 1
+	// HostLenient reads 32 bit integers as 167772161, hex as 0x0a000001 and
+	// v4-mapped ipv6 addresses as ::ffff:10.0.0.1 too, a leading zero is
+	// never octal. In a filter an integer is an address only if it is over
+	// 255, as 10 is the network 10.0.0.0/8 still.
+	HostLenient HostMode = 2
+)
+
+// HostError records a failed host parse, Err is one of the ErrHost* values.
+type HostError struct {
+	Host string
+	Err  error
+}
+
+func (e *HostError) Error() string {
+	return "parse host " + strconv.Quote(e.Host) + ": " + e.Err.Error()
+}
+
+func (e *HostError) Unwrap() error {
+	return e.Err
+}
+
 func ParseHost(rawIP string) (int, error) {
+	return ParseHostMode(rawIP, HostDefault)
+}
+
+// ParseHostMode parses the ipv4 host rawIP as mode reads it.
+func ParseHostMode(rawIP string, mode HostMode) (int, error) {
+	switch {
+	case mode == HostLenient && strings.Contains(rawIP, ":"):
+		ip, ok := parseIP6(rawIP)
+		if !ok || !ip.isV4() {
+			return 0, &HostError{Host: rawIP, Err: ErrHostMalformed}
+		}
+		return ip.v4(), nil
+	case mode == HostLenient && !strings.Contains(rawIP, "."):
+		ip, ok := parseIP4Integer(rawIP)
+		if !ok {
+			return 0, &HostError{Host: rawIP, Err: ErrHostMalformed}
+		}
+		return ip, nil
+	case mode == HostStrict && hasLeadingZero(rawIP):
+		return 0, &HostError{Host: rawIP, Err: ErrHostLeadingZero}
+	}
 	ip := strings.Split(rawIP, ".")
 	if len(ip) == 4 {
 		r := 0
 		for i := 0; i < 4; i++ {
 			ipInt, err := strconv.ParseInt(ip[i], 10, 0)
 			if err != nil || ipInt < 0 || ipInt > 255 {
-				return 0, errors.New(err_msg_parse_host_ip_domain)
+				return 0, &HostError{Host: rawIP, Err: ErrHostIPDomain}
 			}
 			r = (r << 8) | int(ipInt)
 		}
 		return r, nil
 	} else {
-		return 0, errors.New(err_msg_parse_host_malformed)
+		return 0, &HostError{Host: rawIP, Err: ErrHostMalformed}
+	}
+}
+
+// parseIP4Integer parses an ipv4 address written as a 32 bit integer, in
+// decimal or in hex after 0x
+func parseIP4Integer(rawIP string) (int, bool) {
+	base := 10
+	if len(rawIP) > 2 && (rawIP[:2] == "0x" || rawIP[:2] == "0X") {
+		rawIP, base = rawIP[2:], 16
 	}
+	ip, err := strconv.ParseUint(rawIP, base, 32)
+	return int(ip), err == nil
+}
+
+// hasLeadingZero reports whether a number of s has a leading zero, as 010
+// or 00 has
+func hasLeadingZero(s string) bool {
+	for i := 0; i+1 < len(s); i++ {
+		if s[i] == '0' && s[i+1] >= '0' && s[i+1] <= '9' && (i == 0 || s[i-1] < '0' || s[i-1] > '9') {
+			return true
+		}
+	}
+	return false
+}
+
+// continuesHex reports whether ch continues a hex number 0x... at the end
+// of the ipv4 address, network or range cidr being lexed
+func continuesHex(cidr string, ch byte) bool {
+	number := cidr[strings.LastIndexAny(cidr, "-/")+1:]
+	if ch == 'x' || ch == 'X' {
+		return number == "0"
+	}
+	return isHex(ch) && len(number) >= 2 && (number[1] == 'x' || number[1] == 'X')
+}
+
+// lenientIP4 rewrites the 32 bit integer and hex addresses of the network
+// or range cidr as dotted quads, an integer of up to 255 is kept as the
+// abbreviation of a network
+func lenientIP4(cidr string) (string, bool) {
+	addrs := strings.Split(cidr, "-")
+	for k, addr := range addrs {
+		ip, _, _ := strings.Cut(addr, "/")
+		if ip == "" || strings.ContainsAny(ip, ".*") {
+			continue
+		}
+		n, ok := parseIP4Integer(ip)
+		if !ok {
+			return cidr, false
+		} else if n > 255 || len(ip) > 2 && (ip[1] == 'x' || ip[1] == 'X') {
+			addrs[k] = strings.Replace(addr, ip, outputIP4(n), 1)
+		}
+	}
+	return strings.Join(addrs, "-"), true
 }
 
 func (f *FilterT) GetFilter() string {
@@ -208,28 +610,203 @@ func (f *FilterT) OK() bool {
 }
 
 func (f *FilterT) Compile(filter string) error {
-	tokens, err := tokenize(filter)
+	return f.CompileEnv(filter, nil)
+}
+
+// CompileEnv compiles filter as Compile does, with the names of env, a nil
+// env defines none.
+func (f *FilterT) CompileEnv(filter string, env *EnvT) error {
+	rpn, err := compile(filter, f.Mode, env, nil)
 	if err != nil {
 		return err
 	}
 
-	//outputTokens(tokens)
+	f.filter = filter
+	f.rpn = rpn
+	f.table, _ = newTable(rpn)
+	f.partial = false
 
-	rpn, err := toRPN(tokens)
+	return nil
+}
 
-	if err != nil {
-		return err
-	}
+// CompileAll compiles filter as Compile does, but goes on after an error to
+// report every error of filter, joined with errors.Join in the order of
+// their positions. The filter is replaced even if there are errors, by what
+// is left when the malformed values and the misplaced tokens are dropped, and
+// operands missing an operator between them are and-ed, so OK reports false
+// if nothing is left.
+func (f *FilterT) CompileAll(filter string) error {
+	tokens, dropped, errs := tokenizeAll(filter, f.Mode)
+	tokens, joins, errs := joinJuxtaposed(tokens, dropped, errs)
 
-	//outputTokens(rpn)
+	var rpn []tokenT
+	for {
+		var err error
+		rpn, err = toRPN(tokens)
+		if err == nil {
+			break
+		}
+		i := indexOfError(tokens, err)
+		if i < 0 {
+			// nothing is left but what the errors so far dropped
+			if len(errs) == 0 {
+				errs = append(errs, err)
+			}
+			rpn = nil
+			break
+		}
+		if tokens[i].t != token_and || !joins[tokens[i].pos] {
+			errs = append(errs, err)
+		}
+		tokens = append(tokens[:i:i], tokens[i+1:]...)
+	}
+	for _, token := range rpn {
+		if token.t == token_set || token.t == token_macro {
+			if _, err := expandName(token, filter, f.Mode, nil, nil); err != nil {
+				errs = append(errs, err)
+				dropped[token.pos] = true
+			}
+		}
+	}
+	if len(rpn) != 0 {
+		if e := pruneExpr(toExpr(rpn), dropped); e != nil {
+			rpn, _ = expandNames(fromExpr(e, nil), filter, f.Mode, nil, nil)
+		} else {
+			rpn = nil
+		}
+	}
 
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errorPos(errs[i]) < errorPos(errs[j])
+	})
 	f.filter = filter
 	f.rpn = rpn
-
-	return nil
+	f.table, _ = newTable(rpn)
+	f.partial = len(errs) != 0
+	return errors.Join(errs...)
 }
 
+// Check reports whether the ipv4 host ip, as returned by ParseHost, matches the filter.
 func (f *FilterT) Check(ip int) bool {
+	return f.check(v4IP(ip))
+}
+
+// CheckHost reports whether host matches the filter. An ipv4 host never
+// matches an ipv6 network unless the network is v4-mapped (::ffff:0:0/96).
+func (f *FilterT) CheckHost(host HostT) bool {
+	return f.check(host.ip)
+}
+
+// CheckAddr reports whether addr matches the filter, an invalid addr never matches.
+func (f *FilterT) CheckAddr(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	return f.check(HostFromAddr(addr).ip)
+}
+
+// CheckIP reports whether ip matches the filter, a malformed ip never matches.
+func (f *FilterT) CheckIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	return f.CheckAddr(addr)
+}
+
+// Prefixes returns the networks of the filter values in rpn order, a
+// range is the fewest prefixes of its hosts and a network whose mask is not
+// a prefix mask is the prefix of the leading ones of its mask.
+func (f *FilterT) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, token := range f.rpn {
+		if !isCidr(token) {
+			continue
+		}
+		for _, cidr := range cidrsOf(token.cidr) {
+			prefixes = append(prefixes, cidr.prefix())
+		}
+	}
+	return prefixes
+}
+
+// CheckPair reports whether a packet from src to dst matches the filter. A
+// value without a src or dst qualifier matches if either side matches, an
+// invalid addr never matches.
+func (f *FilterT) CheckPair(src, dst netip.Addr) bool {
+	pkt := pktT{}
+	if src.IsValid() {
+		pkt.src, pkt.hasSrc = HostFromAddr(src).ip, true
+	}
+	if dst.IsValid() {
+		pkt.dst, pkt.hasDst = HostFromAddr(dst).ip, true
+	}
+	return f.eval(&pkt)
+}
+
+// ConnT describes a connection or flow to check, an invalid addr never
+// matches. Proto is the ip protocol number, 0 if unknown.
+type ConnT struct {
+	Src     netip.Addr
+	Dst     netip.Addr
+	SrcPort uint16
+	DstPort uint16
+	Proto   uint8
+}
+
+// CheckConn reports whether conn matches the filter. Port values are
+// checked against the ports of conn, which a tcp, udp or sctp conn, or a
+// conn of unknown protocol, has.
+func (f *FilterT) CheckConn(conn ConnT) bool {
+	pkt := pktT{sport: int(conn.SrcPort), dport: int(conn.DstPort), hasPorts: true}
+	if conn.Proto != 0 {
+		pkt.proto, pkt.hasProto = int(conn.Proto), true
+		switch pkt.proto {
+		case proto_tcp, proto_udp, proto_sctp:
+		default:
+			pkt.hasPorts = false
+		}
+	}
+	if conn.Src.IsValid() {
+		pkt.src, pkt.hasSrc = HostFromAddr(conn.Src).ip, true
+	}
+	if conn.Dst.IsValid() {
+		pkt.dst, pkt.hasDst = HostFromAddr(conn.Dst).ip, true
+	}
+	return f.eval(&pkt)
+}
+
+// pktT is what the rpn is evaluated against, port and protocol values
+// never match a pktT without ports or protocol
+type pktT struct {
+	src      ipT
+	dst      ipT
+	hasSrc   bool
+	hasDst   bool
+	sport    int
+	dport    int
+	hasPorts bool
+	proto    int
+	hasProto bool
+}
+
+// isV4 reports whether pkt is an ipv4 packet, judged by its addresses
+func (pkt *pktT) isV4() bool {
+	if pkt.hasSrc {
+		return pkt.src.isV4()
+	}
+	return pkt.hasDst && pkt.dst.isV4()
+}
+
+// check evaluates a single host, which is both the src and the dst
+func (f *FilterT) check(ip ipT) bool {
+	if f.table != nil {
+		return f.table.contains(ip)
+	}
+	return f.eval(&pktT{src: ip, dst: ip, hasSrc: true, hasDst: true})
+}
+
+func (f *FilterT) eval(pkt *pktT) bool {
 	var stack []bool
 
 	if len(f.rpn) == 0 {
@@ -240,7 +817,7 @@ func (f *FilterT) Check(ip int) bool {
 		top := len(stack)
 		switch token.t {
 		case token_value:
-			stack = append(stack, checkIn(ip, token.cidr))
+			stack = append(stack, checkValue(pkt, token))
 		case token_not:
 			stack[top-1] = !stack[top-1]
 		case token_and:
@@ -261,15 +838,74 @@ func (f *FilterT) Check(ip int) bool {
 	return stack[0]
 }
 
-func checkIn(ip int, cidr cidrT) bool {
-	return (ip & cidr.mask) == (cidr.ip & cidr.mask)
+func checkValue(pkt *pktT, token tokenT) bool {
+	switch token.kind {
+	case kind_port, kind_portrange:
+		return checkPorts(pkt, token)
+	case kind_proto, kind_proto4, kind_proto6:
+		return checkProto(pkt, token)
+	}
+	src := token.dir != dir_dst && pkt.hasSrc && checkIn(pkt.src, token.cidr)
+	return src || (token.dir != dir_src && pkt.hasDst && checkIn(pkt.dst, token.cidr))
+}
+
+func checkPorts(pkt *pktT, token tokenT) bool {
+	if !pkt.hasPorts {
+		return false
+	}
+	src := token.dir != dir_dst && inPorts(pkt.sport, token.ports)
+	return src || (token.dir != dir_src && inPorts(pkt.dport, token.ports))
+}
+
+func checkProto(pkt *pktT, token tokenT) bool {
+	if !pkt.hasProto || pkt.proto != token.proto {
+		return false
+	}
+	switch token.kind {
+	case kind_proto4:
+		return (pkt.hasSrc || pkt.hasDst) && pkt.isV4()
+	case kind_proto6:
+		return (pkt.hasSrc || pkt.hasDst) && !pkt.isV4()
+	}
+	return true
+}
+
+// isCidr reports whether token is an address value
+func isCidr(token tokenT) bool {
+	if token.t != token_value {
+		return false
+	}
+	switch token.kind {
+	case kind_any, kind_host, kind_net:
+		return true
+	}
+	return false
+}
+
+func inPorts(port int, ports portsT) bool {
+	return port >= ports.lo && port <= ports.hi
+}
+
+func checkIn(ip ipT, cidr cidrT) bool {
+	if cidr.isRange {
+		return ip.isV4() == cidr.ip.isV4() && !ip.less(cidr.ip) && !cidr.last.less(ip)
+	}
+	if ip.isV4() && !isV4Mask(cidr.mask) {
+		return false
+	}
+	return ip.and(cidr.mask) == cidr.ip.and(cidr.mask)
 }
 
-func tokenize(filter string) ([]tokenT, error) {
+// isV4Mask reports whether mask covers the whole ::ffff:0:0/96 prefix
+func isV4Mask(mask ipT) bool {
+	return mask.hi == ^uint64(0) && mask.lo>>32 == 0xffffffff
+}
+
+func tokenize(filter string, mode HostMode) ([]tokenT, error) {
 	var tokens []tokenT
 	filter_len := len(filter)
 	for i := 0; i < filter_len; {
-		token, next_i, err := lex(&filter, i)
+		token, next_i, err := lex(&filter, i, mode)
 		if err != nil {
 			return nil, err
 		}
@@ -281,6 +917,93 @@ func tokenize(filter string) ([]tokenT, error) {
 	return tokens, nil
 }
 
+// tokenizeAll tokenizes filter, a token which fails to lex is skipped up to
+// the next space, bracket or operator character and stands in as a value,
+// the positions of which are dropped
+func tokenizeAll(filter string, mode HostMode) ([]tokenT, map[int]bool, []error) {
+	var tokens []tokenT
+	var errs []error
+	dropped := map[int]bool{}
+	filter_len := len(filter)
+	for i := 0; i < filter_len; {
+		token, next_i, err := lex(&filter, i, mode)
+		if err != nil {
+			errs = append(errs, err)
+			dropped[i] = true
+			tokens = append(tokens, tokenT{t: token_value, cidr: cidrT{mask: maskOf(128)}, pos: i})
+			next_i = i + 1
+			for next_i < filter_len && !isDelimiter(filter[next_i]) {
+				next_i++
+			}
+		} else if token.t != token_space {
+			tokens = append(tokens, token)
+		}
+		i = next_i
+	}
+	return tokens, dropped, errs
+}
+
+// joinJuxtaposed puts an and just before an operand following another one
+// without an operator, which toRPN can not position, reporting it unless it
+// is a value already dropped, the positions of the ands put are returned
+func joinJuxtaposed(tokens []tokenT, dropped map[int]bool, errs []error) ([]tokenT, map[int]bool, []error) {
+	var joined []tokenT
+	joins := map[int]bool{}
+	for _, token := range tokens {
+		if len(joined) != 0 && endsOperand(joined[len(joined)-1]) && startsOperand(token) {
+			if !dropped[token.pos] {
+				errs = append(errs, NewErrorToken(err_code_filter, token.t, token.pos))
+			}
+			joins[token.pos-1] = true
+			joined = append(joined, tokenT{t: token_and, pos: token.pos - 1})
+		}
+		joined = append(joined, token)
+	}
+	return joined, joins, errs
+}
+
+func startsOperand(token tokenT) bool {
+	switch token.t {
+	case token_value, token_set, token_macro, token_left, token_not, token_src, token_dst, token_host, token_net:
+		return true
+	}
+	return false
+}
+
+func endsOperand(token tokenT) bool {
+	return isValue(token.t) || token.t == token_right
+}
+
+func isDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '&', '|', '!':
+		return true
+	}
+	return isSpace(c)
+}
+
+// indexOfError returns the index of the token err is about, or -1
+func indexOfError(tokens []tokenT, err error) int {
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Token == "" {
+		return -1
+	}
+	for i, token := range tokens {
+		if token.pos == parseErr.Pos && tokenOut[token.t] == parseErr.Token {
+			return i
+		}
+	}
+	return -1
+}
+
+func errorPos(err error) int {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) && parseErr.Token != "" {
+		return parseErr.Pos
+	}
+	return -1
+}
+
 func toRPN(tokens []tokenT) ([]tokenT, error) {
 	var rpn, stack []tokenT
 	var valsPos []int
@@ -289,7 +1012,7 @@ func toRPN(tokens []tokenT) ([]tokenT, error) {
 	tokens = append(tokens, tokenT{t: token_border})
 
 	for _, token := range tokens {
-		if token.t == token_value {
+		if isValue(token.t) {
 			rpn = append(rpn, token)
 			valsPos = append(valsPos, token.pos)
 		} else {
@@ -304,6 +1027,8 @@ func toRPN(tokens []tokenT) ([]tokenT, error) {
 					needVals = 2
 				case token_or:
 					needVals = 2
+				case token_src, token_dst, token_host, token_net:
+					needVals = 1
 				default:
 					panic("illegal token")
 				}
@@ -338,7 +1063,15 @@ func toRPN(tokens []tokenT) ([]tokenT, error) {
 				valsPos = valsPos[0 : valsLen-needVals]
 				valsPos = append(valsPos, valPos)
 
-				rpn = append(rpn, stack[top-1])
+				if isQualifier(t) {
+					var err error
+					rpn, err = qualify(rpn, stack[top-1], valPos)
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					rpn = append(rpn, stack[top-1])
+				}
 			}
 
 			switch ranks[stack[top-1].t][token.t] {
@@ -370,14 +1103,136 @@ func toRPN(tokens []tokenT) ([]tokenT, error) {
 	return rpn, nil
 }
 
+// isValue reports whether t is a value or a name of values
+func isValue(t int) bool {
+	return t == token_value || t == token_set || t == token_macro
+}
+
+func isQualifier(t int) bool {
+	switch t {
+	case token_src, token_dst, token_host, token_net:
+		return true
+	}
+	return false
+}
+
+// qualify folds qualifier q into the value at the top of rpn, which must
+// be the single value in pos valPos
+func qualify(rpn []tokenT, q tokenT, valPos int) ([]tokenT, error) {
+	top := len(rpn)
+	if !isValue(rpn[top-1].t) || rpn[top-1].pos != valPos {
+		return toRPNError(q, err_code_qualifier)
+	}
+	value := &rpn[top-1]
+	if value.t != token_value {
+		// a name is qualified when it is expanded
+		return rpn, qualifyName(value, q)
+	}
+	switch q.t {
+	case token_src, token_dst:
+		if !isCidr(*value) && value.kind != kind_port && value.kind != kind_portrange {
+			return toRPNError(q, err_code_qualifier)
+		}
+		if value.dir != dir_any {
+			return toRPNError(q, err_code_dup_qualifier)
+		}
+		value.dir = dir_src
+		if q.t == token_dst {
+			value.dir = dir_dst
+		}
+	case token_host, token_net:
+		if value.kind != kind_any {
+			return toRPNError(q, err_code_dup_qualifier)
+		}
+		value.kind = kind_net
+		if q.t == token_host {
+			if n, _ := maskLen(value.cidr.mask); n != 128 {
+				return toRPNError(q, err_code_host)
+			}
+			value.kind = kind_host
+		}
+	}
+	return rpn, nil
+}
+
 func toRPNError(token tokenT, code int) ([]tokenT, error) {
 	return nil, NewErrorToken(code, token.t, token.pos)
 }
 
-func lex(filter *string, i int) (tokenT, int, error) {
+// exprT is the tree of an rpn, x and y are the operands of an operator
+type exprT struct {
+	token tokenT
+	x     *exprT
+	y     *exprT
+}
+
+// fromExpr appends the rpn of e to rpn
+func fromExpr(e *exprT, rpn []tokenT) []tokenT {
+	if e.x != nil {
+		rpn = fromExpr(e.x, rpn)
+	}
+	if e.y != nil {
+		rpn = fromExpr(e.y, rpn)
+	}
+	return append(rpn, e.token)
+}
+
+// pruneExpr removes the values at the dropped positions from e, with the not
+// above them, an and or or left with one operand is replaced by it
+func pruneExpr(e *exprT, dropped map[int]bool) *exprT {
+	switch e.token.t {
+	case token_value, token_set, token_macro:
+		if dropped[e.token.pos] {
+			return nil
+		}
+	case token_not:
+		if x := pruneExpr(e.x, dropped); x == nil {
+			return nil
+		} else {
+			e.x = x
+		}
+	case token_and, token_or:
+		x, y := pruneExpr(e.x, dropped), pruneExpr(e.y, dropped)
+		if x == nil {
+			return y
+		} else if y == nil {
+			return x
+		}
+		e.x, e.y = x, y
+	}
+	return e
+}
+
+func toExpr(rpn []tokenT) *exprT {
+	var stack []*exprT
+	for _, token := range rpn {
+		e := &exprT{token: token}
+		top := len(stack)
+		switch token.t {
+		case token_value, token_set, token_macro:
+		case token_not:
+			e.x = stack[top-1]
+			stack = stack[0 : top-1]
+		case token_and, token_or:
+			e.x, e.y = stack[top-2], stack[top-1]
+			stack = stack[0 : top-2]
+		default:
+			panic("illegal token")
+		}
+		stack = append(stack, e)
+	}
+	if len(stack) != 1 {
+		panic("illegal rpn")
+	}
+	return stack[0]
+}
+
+func lex(filter *string, i int, mode HostMode) (tokenT, int, error) {
 	ch := (*filter)[i]
-	if ch >= '0' && ch <= '9' {
-		return lexCIDR(filter, i)
+	if isIP6(filter, i) {
+		return lexCIDR6(filter, i, mode)
+	} else if (ch >= '0' && ch <= '9') || ch == '*' {
+		return lexCIDR(filter, i, mode)
 	} else if isSpace(ch) {
 		return tokenT{t: token_space}, i + 1, nil
 	} else {
@@ -393,7 +1248,29 @@ func lex(filter *string, i int) (tokenT, int, error) {
 		case 'o', 'O':
 			return lexOP(filter, i, "or")
 		case 'n', 'N':
-			return lexOP(filter, i, "not")
+			return lexOP(filter, i, "not", "net")
+		case 's', 'S':
+			return lexOP(filter, i, "src")
+		case 'd', 'D':
+			if equal(filter, i, "documentation") {
+				return lexBuiltin(filter, i)
+			}
+			return lexOP(filter, i, "dst")
+		case 'h', 'H':
+			return lexOP(filter, i, "host")
+		case 'p', 'P':
+			if equal(filter, i, "proto") {
+				return lexProto(filter, i)
+			} else if equal(filter, i, "private") {
+				return lexBuiltin(filter, i)
+			}
+			return lexPorts(filter, i)
+		case 't', 'T', 'u', 'U', 'i', 'I':
+			return lexProto(filter, i)
+		case '@', '$':
+			return lexName(filter, i)
+		case 'l', 'L', 'm', 'M', 'b', 'B', 'r', 'R', 'c', 'C':
+			return lexBuiltin(filter, i)
 		case '(':
 			return lexOP(filter, i, "(")
 		case ')':
@@ -405,17 +1282,32 @@ func lex(filter *string, i int) (tokenT, int, error) {
 }
 
 // must not start a space charactor
-func lexCIDR(filter *string, pos int) (tokenT, int, error) {
+func lexCIDR(filter *string, pos int, mode HostMode) (tokenT, int, error) {
 	cidr := ""
 	i := pos
 	for ; i < len(*filter); i++ {
 		ch := (*filter)[i]
-		if (ch >= '0' && ch <= '9') || ch == '.' || ch == '/' {
+		if (ch >= '0' && ch <= '9') || ch == '.' || ch == '/' || ch == '-' || ch == '*' ||
+			(mode == HostLenient && continuesHex(cidr, ch)) {
 			cidr += string(ch)
 		} else {
 			break
 		}
 	}
+	if mode == HostStrict && hasLeadingZero(cidr) {
+		return lexCIDRError(pos, err_code_leading_zero)
+	} else if mode == HostLenient {
+		var ok bool
+		if cidr, ok = lenientIP4(cidr); !ok {
+			return lexCIDRError(pos, err_code_ip_integer)
+		}
+	}
+	if strings.Contains(cidr, "*") {
+		return lexWildcard(cidr, pos, i)
+	}
+	if first, last, found := strings.Cut(cidr, "-"); found && !strings.Contains(first, "/") {
+		return lexRange(first, last, pos, i)
+	}
 	ipmask := strings.Split(cidr, "/")
 	if len(ipmask) == 2 {
 		ip := strings.Split(ipmask[0], ".")
@@ -431,7 +1323,11 @@ func lexCIDR(filter *string, pos int) (tokenT, int, error) {
 	} else if len(ipmask) == 1 {
 		ip := strings.Split(ipmask[0], ".")
 		if len(ip) >= 1 && len(ip) <= 4 {
-			return cidrToken(ip, len(ip)*8, pos, i)
+			token, next_i, err := cidrToken(ip, len(ip)*8, pos, i)
+			if err != nil {
+				return token, next_i, err
+			}
+			return lexNetmask(filter, token, mode, true, len(ip) == 4, next_i)
 		} else {
 			return lexCIDRError(pos, err_code_ip)
 		}
@@ -440,22 +1336,91 @@ func lexCIDR(filter *string, pos int) (tokenT, int, error) {
 	}
 }
 
+// isIP6 reports whether an ipv6 address starts at pos, that is the run of
+// hex digits, dots and colons there contains a colon
+func isIP6(filter *string, pos int) bool {
+	for i := pos; i < len(*filter); i++ {
+		ch := (*filter)[i]
+		if ch == ':' {
+			return true
+		} else if !isHex(ch) && ch != '.' {
+			return false
+		}
+	}
+	return false
+}
+
+func lexCIDR6(filter *string, pos int, mode HostMode) (tokenT, int, error) {
+	i := pos
+	for ; i < len(*filter); i++ {
+		ch := (*filter)[i]
+		if !isHex(ch) && ch != '.' && ch != ':' {
+			break
+		}
+	}
+	ip, ok := parseIP6((*filter)[pos:i])
+	if !ok {
+		return lexCIDRError(pos, err_code_ip6)
+	}
+	mask := 128
+	prefixed := i < len(*filter) && (*filter)[i] == '/'
+	if prefixed {
+		start := i + 1
+		for i = start; i < len(*filter); i++ {
+			ch := (*filter)[i]
+			if !(ch >= '0' && ch <= '9') && ch != '/' {
+				break
+			}
+		}
+		rawMask := (*filter)[start:i]
+		if strings.Contains(rawMask, "/") {
+			return lexCIDRError(pos, err_code_too_many_mask)
+		}
+		m, err := strconv.ParseInt(rawMask, 10, 0)
+		if err != nil || m < 0 || m > 128 {
+			return lexCIDRError(pos, err_code_mask6)
+		}
+		mask = int(m)
+	} else if i < len(*filter) && (*filter)[i] == '-' {
+		start := i + 1
+		for i = start; i < len(*filter); i++ {
+			ch := (*filter)[i]
+			if !isHex(ch) && ch != '.' && ch != ':' {
+				break
+			}
+		}
+		last, ok := parseIP6((*filter)[start:i])
+		if !ok {
+			return lexCIDRError(pos, err_code_range)
+		}
+		return rangeToken(ip, last, pos, i)
+	}
+	token := tokenT{
+		t:    token_value,
+		cidr: cidrFromPrefix(netip.PrefixFrom(netip.AddrFrom16(ip.as16()), mask)),
+		pos:  pos,
+	}
+	if prefixed {
+		return token, i, nil
+	}
+	return lexNetmask(filter, token, mode, false, true, i)
+}
+
 func cidrToken(rawIP []string, mask, pos, next_i int) (tokenT, int, error) {
-	cidr := cidrT{}
-	cidr.ip = 0
+	ip := 0
 
 	for i := 0; i < 4; i++ {
-		cidr.ip <<= 8
+		ip <<= 8
 		if i < len(rawIP) {
-			ip, err := strconv.ParseInt(rawIP[i], 10, 0)
-			if err != nil || ip < 0 || ip > 255 {
+			domain, err := strconv.ParseInt(rawIP[i], 10, 0)
+			if err != nil || domain < 0 || domain > 255 {
 				return lexCIDRError(pos, err_code_ip_domain)
 			}
-			cidr.ip |= int(ip)
+			ip |= int(domain)
 		}
 	}
 
-	cidr.mask = (-1) << uint(32-mask)
+	cidr := cidrT{ip: v4IP(ip), mask: maskOf(v4_mapped_len + mask)}
 
 	return tokenT{
 		t:    token_value,
@@ -464,16 +1429,237 @@ func cidrToken(rawIP []string, mask, pos, next_i int) (tokenT, int, error) {
 	}, next_i, nil
 }
 
+// lexWildcard lexes a dotted quad with a * for each octet of any value, as
+// 10.*.3.*, into the network of the other octets
+func lexWildcard(rawIP string, pos, next_i int) (tokenT, int, error) {
+	ip := strings.Split(rawIP, ".")
+	if len(ip) != 4 || strings.ContainsAny(rawIP, "/-") {
+		return lexCIDRError(pos, err_code_wildcard)
+	}
+	mask := uint64(0)
+	for k := range ip {
+		mask <<= 8
+		if ip[k] == "*" {
+			ip[k] = "0"
+		} else if strings.Contains(ip[k], "*") {
+			return lexCIDRError(pos, err_code_wildcard)
+		} else {
+			mask |= 255
+		}
+	}
+	token, _, err := cidrToken(ip, 32, pos, next_i)
+	if err != nil {
+		return lexError(err)
+	}
+	token.cidr.mask = maskOf(v4_mapped_len).or(ipT{lo: mask})
+	return token, next_i, nil
+}
+
+// lexNetmask lexes the "mask M" or "wildcard W" which may follow the
+// address of token, ending in next_i, into the mask of token. W is the
+// inverse of the mask, as in the access lists of routers, and neither needs
+// to be a prefix mask. An ipv4 mask is read in mode, v4 tells whether the
+// address is an ipv4 one and full whether it is a dotted quad or an ipv6
+// address, as it must be to be masked.
+func lexNetmask(filter *string, token tokenT, mode HostMode, v4, full bool, next_i int) (tokenT, int, error) {
+	i := skipSpaces(filter, next_i)
+	keyword := "mask"
+	if equal(filter, i, "wildcard") {
+		keyword = "wildcard"
+	} else if !equal(filter, i, keyword) {
+		return token, next_i, nil
+	}
+	if !full {
+		return lexCIDRError(token.pos, err_code_set_mask)
+	} else if end := i + len(keyword); end == len(*filter) || !isSpace((*filter)[end]) {
+		// the mask is a separate word, as in "10.0.0.0 mask 255.0.0.0"
+		return lexCIDRError(token.pos, err_code_netmask)
+	}
+	start := skipSpaces(filter, i+len(keyword))
+	for i = start; i < len(*filter); i++ {
+		ch := (*filter)[i]
+		if v4 && mode == HostLenient && continuesHex((*filter)[start:i], ch) {
+			continue
+		} else if !(ch >= '0' && ch <= '9') && ch != '.' && (v4 || (!isHex(ch) && ch != ':')) {
+			break
+		}
+	}
+	var mask ipT
+	if v4 {
+		m, err := ParseHostMode((*filter)[start:i], mode)
+		if errors.Is(err, ErrHostLeadingZero) {
+			return lexCIDRError(token.pos, err_code_leading_zero)
+		} else if err != nil {
+			return lexCIDRError(token.pos, err_code_netmask)
+		}
+		mask = ipT{lo: uint64(uint32(m))}
+	} else {
+		m, ok := parseIP6((*filter)[start:i])
+		if !ok {
+			return lexCIDRError(token.pos, err_code_netmask)
+		}
+		mask = m
+	}
+	if keyword == "wildcard" {
+		mask = ipT{hi: ^mask.hi, lo: ^mask.lo}
+	}
+	if v4 {
+		mask = maskOf(v4_mapped_len).or(ipT{lo: mask.lo & 0xffffffff})
+	}
+	token.cidr.mask = mask
+	return token, i, nil
+}
+
+// lexRange lexes the ipv4 range first-last, both must be dotted quads
+func lexRange(first, last string, pos, next_i int) (tokenT, int, error) {
+	var ips [2]ipT
+	for k, rawIP := range []string{first, last} {
+		ip := strings.Split(rawIP, ".")
+		if len(ip) != 4 || strings.ContainsAny(rawIP, "/-") {
+			return lexCIDRError(pos, err_code_range)
+		}
+		token, _, err := cidrToken(ip, 32, pos, next_i)
+		if err != nil {
+			return lexError(err)
+		}
+		ips[k] = token.cidr.ip
+	}
+	return rangeToken(ips[0], ips[1], pos, next_i)
+}
+
+// rangeToken returns the value of the range first-last, which must be of
+// one family and not end before it starts
+func rangeToken(first, last ipT, pos, next_i int) (tokenT, int, error) {
+	if first.isV4() != last.isV4() || last.less(first) {
+		return lexCIDRError(pos, err_code_range)
+	}
+	return tokenT{
+		t:    token_value,
+		cidr: cidrT{ip: first, last: last, isRange: true},
+		pos:  pos,
+	}, next_i, nil
+}
+
+// lexPorts lexes a whole "port N" or "portrange N-M" primitive into a value
+func lexPorts(filter *string, pos int) (tokenT, int, error) {
+	op, t, kind := "portrange", token_portrange, kind_portrange
+	if !equal(filter, pos, op) {
+		op, t, kind = "port", token_port, kind_port
+		if !equal(filter, pos, op) {
+			return lexError(NewErrorToken(err_code_token, t, pos))
+		}
+	}
+	i := skipSpaces(filter, pos+len(op))
+	start := i
+	for ; i < len(*filter); i++ {
+		ch := (*filter)[i]
+		if !(ch >= '0' && ch <= '9') && ch != '-' {
+			break
+		}
+	}
+	rawPorts := strings.Split((*filter)[start:i], "-")
+	if t == token_port && len(rawPorts) != 1 {
+		return lexError(NewErrorToken(err_code_port, t, pos))
+	} else if t == token_portrange && len(rawPorts) != 2 {
+		return lexError(NewErrorToken(err_code_portrange, t, pos))
+	}
+	var ports [2]int
+	for j, rawPort := range rawPorts {
+		port, err := strconv.ParseInt(rawPort, 10, 0)
+		if err != nil || port < 0 || port > 65535 {
+			return lexError(NewErrorToken(err_code_port, t, pos))
+		}
+		ports[j] = int(port)
+	}
+	if t == token_port {
+		ports[1] = ports[0]
+	} else if ports[0] > ports[1] {
+		return lexError(NewErrorToken(err_code_portrange, t, pos))
+	}
+	return tokenT{
+		t:     token_value,
+		pos:   pos,
+		kind:  kind,
+		ports: portsT{lo: ports[0], hi: ports[1]},
+	}, i, nil
+}
+
+// lexProto lexes a protocol name, or a whole "[ip|ip6] proto N" primitive,
+// into a value
+func lexProto(filter *string, pos int) (tokenT, int, error) {
+	for _, proto := range []int{proto_icmp6, proto_icmp, proto_tcp, proto_udp} {
+		if name := protoNames[proto]; equal(filter, pos, name) {
+			return tokenT{t: token_value, pos: pos, kind: kind_proto, proto: proto}, pos + len(name), nil
+		}
+	}
+	i, kind := pos, kind_proto
+	if equal(filter, i, "ip6") {
+		i, kind = skipSpaces(filter, i+len("ip6")), kind_proto6
+	} else if equal(filter, i, "ip") {
+		i, kind = skipSpaces(filter, i+len("ip")), kind_proto4
+	}
+	if !equal(filter, i, "proto") {
+		return lexError(NewErrorToken(err_code_token, token_proto, pos))
+	}
+	i = skipSpaces(filter, i+len("proto"))
+	start := i
+	for ; i < len(*filter) && (*filter)[i] >= '0' && (*filter)[i] <= '9'; i++ {
+	}
+	proto, err := strconv.ParseInt((*filter)[start:i], 10, 0)
+	if err != nil || proto < 0 || proto > 255 {
+		return lexError(NewErrorToken(err_code_proto, token_proto, pos))
+	}
+	return tokenT{t: token_value, pos: pos, kind: kind, proto: int(proto)}, i, nil
+}
+
+// lexName lexes a name, its sigil followed by letters, digits, '_', '-' and '.'
+func lexName(filter *string, pos int) (tokenT, int, error) {
+	t := token_set
+	if (*filter)[pos] == '$' {
+		t = token_macro
+	}
+	i := pos + 1
+	for ; i < len(*filter) && isNameChar((*filter)[i]); i++ {
+	}
+	if i == pos+1 {
+		return lexError(NewErrorToken(err_code_token, t, pos))
+	}
+	return tokenT{t: t, pos: pos}, i, nil
+}
+
+// lexBuiltin lexes the keyword of a built-in set, which must end there
+func lexBuiltin(filter *string, pos int) (tokenT, int, error) {
+	for name := range builtinSets {
+		end := pos + len(name)
+		if equal(filter, pos, name) && (end == len(*filter) || !isNameChar((*filter)[end])) {
+			return tokenT{t: token_set, pos: pos}, end, nil
+		}
+	}
+	return lexError(NewErrorToken(err_code_token, token_set, pos))
+}
+
+func isNameChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-' || c == '.'
+}
+
+func skipSpaces(filter *string, i int) int {
+	for ; i < len(*filter) && isSpace((*filter)[i]); i++ {
+	}
+	return i
+}
+
 func lexCIDRError(pos, code int) (tokenT, int, error) {
 	return lexError(NewErrorToken(code, token_value, pos))
 }
 
-func lexOP(filter *string, pos int, op string) (tokenT, int, error) {
-	if equal(filter, pos, op) {
-		return tokenT{t: toOP(op), pos: pos}, (pos + len(op)), nil
-	} else {
-		return lexError(NewErrorToken(err_code_token, toOP(op), pos))
+// lexOP lexes the first of ops found in pos, the error reports ops[0]
+func lexOP(filter *string, pos int, ops ...string) (tokenT, int, error) {
+	for _, op := range ops {
+		if equal(filter, pos, op) {
+			return tokenT{t: toOP(op), pos: pos}, (pos + len(op)), nil
+		}
 	}
+	return lexError(NewErrorToken(err_code_token, toOP(ops[0]), pos))
 }
 
 func toOP(op string) int {
@@ -488,10 +1674,22 @@ func toOP(op string) int {
 		return token_left
 	case ")":
 		return token_right
+	case "src":
+		return token_src
+	case "dst":
+		return token_dst
+	case "host":
+		return token_host
+	case "net":
+		return token_net
 	}
 	panic("unknown op")
 }
 
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
 func isSpace(c byte) bool {
 	switch c {
 	case ' ', '\t', '\n', '\r':
@@ -526,7 +1724,7 @@ func outputToken(token tokenT) string {
 	pos := "[" + strconv.FormatInt(int64(token.pos), 10) + "]"
 	switch token.t {
 	case token_value:
-		return outputCidr(token.cidr) + pos
+		return outputValue(token) + pos
 	default:
 		val, found := tokenOut[token.t]
 		if !found {
@@ -536,16 +1734,83 @@ func outputToken(token tokenT) string {
 	}
 }
 
-func outputCidr(cidr cidrT) string {
-	i := 0
-	for ; i <= 32; i++ {
-		if cidr.mask == (-1)<<uint32(32-i) {
-			break
+func outputValue(token tokenT) string {
+	out := outputQualifiers(token)
+	switch token.kind {
+	case kind_port:
+		return out + tokenOut[token_port] + " " + strconv.FormatInt(int64(token.ports.lo), 10)
+	case kind_portrange:
+		return out + tokenOut[token_portrange] + " " + strconv.FormatInt(int64(token.ports.lo), 10) +
+			"-" + strconv.FormatInt(int64(token.ports.hi), 10)
+	case kind_proto:
+		if name, found := protoNames[token.proto]; found {
+			return name
 		}
+		return tokenOut[token_proto] + " " + strconv.FormatInt(int64(token.proto), 10)
+	case kind_proto4:
+		return "ip " + tokenOut[token_proto] + " " + strconv.FormatInt(int64(token.proto), 10)
+	case kind_proto6:
+		return "ip6 " + tokenOut[token_proto] + " " + strconv.FormatInt(int64(token.proto), 10)
+	}
+	return out + outputCidr(token.cidr)
+}
+
+// outputQualifiers outputs the direction and host or net qualifiers of a
+// value or a name
+func outputQualifiers(token tokenT) string {
+	out := ""
+	switch token.dir {
+	case dir_src:
+		out += tokenOut[token_src] + " "
+	case dir_dst:
+		out += tokenOut[token_dst] + " "
+	}
+	switch token.kind {
+	case kind_host:
+		out += tokenOut[token_host] + " "
+	case kind_net:
+		out += tokenOut[token_net] + " "
+	}
+	return out
+}
+
+func outputCidr(cidr cidrT) string {
+	if cidr.isRange {
+		return outputIP(cidr.ip) + "-" + outputIP(cidr.last)
+	}
+	n, ok := maskLen(cidr.mask)
+	if !ok {
+		return outputNetmask(cidr)
+	}
+	if cidr.ip.isV4() && n >= v4_mapped_len {
+		return outputIP4(cidr.ip.v4()) + "/" + strconv.FormatInt(int64(n-v4_mapped_len), 10)
+	}
+	return outputIP6(cidr.ip) + "/" + strconv.FormatInt(int64(n), 10)
+}
+
+// outputNetmask outputs a network whose mask is not a prefix mask, as a
+// wildcard if it is an ipv4 network of whole octets, as 10.*.3.*, or with
+// its mask otherwise
+func outputNetmask(cidr cidrT) string {
+	if !cidr.ip.isV4() || !isV4Mask(cidr.mask) {
+		return outputIP6(cidr.ip) + " mask " + outputIP6(cidr.mask)
 	}
-	if i > 32 {
-		panic(fmt.Sprint("malformed value token ", cidr))
+	ip, mask := cidr.ip.v4(), cidr.mask.v4()
+	octets := make([]string, 4)
+	for k := range octets {
+		shift := 24 - 8*k
+		switch {
+		case (mask>>shift)&255 == 255:
+			octets[k] = strconv.Itoa((ip >> shift) & 255)
+		case (mask>>shift)&255 == 0 && (ip>>shift)&255 == 0:
+			octets[k] = "*"
+		default:
+			return outputIP4(ip) + " mask " + outputIP4(mask)
+		}
 	}
-	return fmt.Sprintf("%d.%d.%d.%d/%d",
-		(cidr.ip>>24)&255, (cidr.ip>>16)&255, (cidr.ip>>8)&255, cidr.ip&255, i)
+	return strings.Join(octets, ".")
+}
+
+func outputIP4(ip int) string {
+	return fmt.Sprintf("%d.%d.%d.%d", (ip>>24)&255, (ip>>16)&255, (ip>>8)&255, ip&255)
 }
@@ -1,6 +1,8 @@
 package filter
 
 import (
+	"errors"
+	"net/netip"
 	"testing"
 )
 
@@ -81,6 +83,46 @@ func TestErrorToken(t *testing.T) {
 	}
 }
 
+func TestParseError(t *testing.T) {
+	f := FilterT{}
+	for filter, expect := range map[string]struct {
+		sentinel   error
+		err        ParseError
+		diagnostic string
+	}{
+		"10 and 300.1": {ErrIPDomain, ParseError{Code: 1008, Token: "CIDR", Pos: 7, Msg: err_msg_ip_domain},
+			"10 and 300.1\n       ^ [1008] ip domain must be 0~255"},
+		"10 and": {ErrNoValues, ParseError{Code: 1001, Token: "and", Pos: 3, Msg: err_msg_no_values},
+			"10 and\n   ^ [1001] no values"},
+		"": {ErrFilter, ParseError{Code: 1000, Pos: -1, Msg: err_msg_filter},
+			"\n^ [1000] imcompleted filter string"},
+		"\tsrc dst 10": {ErrDupQualifier, ParseError{Code: 1013, Token: "src", Pos: 1, Msg: err_msg_dup_qualifier},
+			"\tsrc dst 10\n\t^ [1013] duplicate qualifier"},
+		"port 65536": {ErrPort, ParseError{Code: 1015, Token: "port", Pos: 0, Msg: err_msg_port},
+			"port 65536\n^ [1015] malformed port, valid is 0~65535"},
+	} {
+		err := f.Compile(filter)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Fatalf("Compile(%q): expect a ParseError, got %v", filter, err)
+		}
+		if *parseErr != expect.err {
+			t.Errorf("Compile(%q): expect %+v, got %+v", filter, expect.err, *parseErr)
+		}
+		if !errors.Is(err, expect.sentinel) || errors.Is(err, ErrBrackets) {
+			t.Errorf("Compile(%q): expect %v only", filter, expect.sentinel)
+		}
+		if got := parseErr.Diagnostic(filter); got != expect.diagnostic {
+			t.Errorf("Compile(%q): expect diagnostic %q, got %q", filter, expect.diagnostic, got)
+		}
+	}
+	for code := range errorTokenMsg {
+		if !errors.Is(NewErrorToken(code, token_value, 0), errorTokenSentinel[code]) || errorTokenSentinel[code] == nil {
+			t.Errorf("no sentinel of code %d", code)
+		}
+	}
+}
+
 func TestParseHost(t *testing.T) {
 	for host, expect := range map[string]int{
 		"127.0.0.1":   0x7f000001,
@@ -96,23 +138,116 @@ func TestParseHost(t *testing.T) {
 }
 
 func TestFailParseHost(t *testing.T) {
-	for host, expect := range map[string]string{
-		"288.0.0.1":    err_msg_parse_host_ip_domain,
-		"127":          err_msg_parse_host_malformed,
-		"127.0.0.1/10": err_msg_parse_host_ip_domain,
-		"127.0.0.1.1":  err_msg_parse_host_malformed,
+	for host, expect := range map[string]error{
+		"288.0.0.1":    ErrHostIPDomain,
+		"127":          ErrHostMalformed,
+		"127.0.0.1/10": ErrHostIPDomain,
+		"127.0.0.1.1":  ErrHostMalformed,
 	} {
 		_, err := ParseHost(host)
-		if err == nil || err.Error() != expect {
-			var err_msg string
-			if err == nil {
-				err_msg = "nil"
-			} else {
-				err_msg = err.Error()
+		if !errors.Is(err, expect) {
+			t.Errorf("ParseHost(%q): expected %q, got %v", host, expect, err)
+		}
+	}
+
+	_, err := ParseHost("288.0.0.1")
+	var hostErr *HostError
+	if !errors.As(err, &hostErr) || hostErr.Host != "288.0.0.1" {
+		t.Errorf("ParseHost: expected a *HostError, got %v", err)
+	}
+	if err.Error() != `parse host "288.0.0.1": ip domain must be 0~255` {
+		t.Errorf("ParseHost: unexpected error message %q", err.Error())
+	}
+}
+
+func TestParseHostMode(t *testing.T) {
+	for _, c := range []struct {
+		host   string
+		mode   HostMode
+		expect int
+		err    error
+	}{
+		{"10.0.0.1", HostStrict, 0x0a000001, nil},
+		{"10.0.0.10", HostStrict, 0x0a00000a, nil},
+		{"10.0.0.0", HostStrict, 0x0a000000, nil},
+		{"10.0.0.010", HostDefault, 0x0a00000a, nil},
+		{"10.0.0.010", HostStrict, 0, ErrHostLeadingZero},
+		{"010.0.0.1", HostStrict, 0, ErrHostLeadingZero},
+		{"10.0.0.00", HostStrict, 0, ErrHostLeadingZero},
+		{"167772161", HostLenient, 0x0a000001, nil},
+		{"0x0a000001", HostLenient, 0x0a000001, nil},
+		{"0XFFFFFFFF", HostLenient, 0xffffffff, nil},
+		{"0", HostLenient, 0, nil},
+		{"::ffff:10.0.0.1", HostLenient, 0x0a000001, nil},
+		{"10.0.0.010", HostLenient, 0x0a00000a, nil},
+		{"167772161", HostDefault, 0, ErrHostMalformed},
+		{"4294967296", HostLenient, 0, ErrHostMalformed},
+		{"0x1ffffffff", HostLenient, 0, ErrHostMalformed},
+		{"0xg", HostLenient, 0, ErrHostMalformed},
+		{"::1", HostLenient, 0, ErrHostMalformed},
+		{"::ffff:10.0.0.1", HostDefault, 0, ErrHostIPDomain},
+	} {
+		r, err := ParseHostMode(c.host, c.mode)
+		if c.err != nil {
+			if !errors.Is(err, c.err) {
+				t.Errorf("ParseHostMode(%q, %d): expected %q, got %v", c.host, c.mode, c.err, err)
+			}
+		} else if err != nil || r != c.expect {
+			t.Errorf("ParseHostMode(%q, %d): expected %d, got %d, %v", c.host, c.mode, c.expect, r, err)
+		}
+	}
+}
+
+func TestCompileHostMode(t *testing.T) {
+	for _, c := range []struct {
+		filter string
+		mode   HostMode
+		expect string
+		err    error
+	}{
+		{"10.0.0.1 or 172.16", HostStrict, "10.0.0.1/32 or 172.16.0.0/16", nil},
+		{"10.0.0.0/8", HostStrict, "10.0.0.0/8", nil},
+		{"10.0.0.1-10.0.0.20", HostStrict, "10.0.0.1-10.0.0.20", nil},
+		{"10.0.0.010", HostDefault, "10.0.0.10/32", nil},
+		{"10.0.0.1 or 10.0.0.010", HostStrict, "", NewErrorToken(err_code_leading_zero, token_value, 12)},
+		{"10.0.0.0/08", HostStrict, "", NewErrorToken(err_code_leading_zero, token_value, 0)},
+		{"10.0.0.0 mask 255.255.0.00", HostStrict, "", NewErrorToken(err_code_leading_zero, token_value, 0)},
+		{"167772161", HostLenient, "10.0.0.1/32", nil},
+		{"0x0a000001 or 0XA000002", HostLenient, "10.0.0.1/32 or 10.0.0.2/32", nil},
+		{"0x0a000000/8 and not 10", HostLenient, "10.0.0.0/8 and not 10.0.0.0/8", nil},
+		{"src net 167772161-167772170", HostLenient, "src net 10.0.0.1-10.0.0.10", nil},
+		{"0x0a000000 mask 0xff00ff00", HostLenient, "10.*.0.*", nil},
+		{"::ffff:10.0.0.1", HostLenient, "10.0.0.1/32", nil},
+		{"10.0.0.010", HostLenient, "10.0.0.10/32", nil},
+		{"4294967296", HostLenient, "", NewErrorToken(err_code_ip_integer, token_value, 0)},
+		{"10 or 0xfg", HostLenient, "", NewErrorToken(err_code_charactor, token_unknown, 9)},
+		{"167772161", HostDefault, "", NewErrorToken(err_code_ip_domain, token_value, 0)},
+	} {
+		f := FilterT{Mode: c.mode}
+		err := f.Compile(c.filter)
+		if c.err != nil {
+			if err == nil || err.Error() != c.err.Error() {
+				t.Errorf("Compile(%q) in mode %d: expected %v, got %v", c.filter, c.mode, c.err, err)
 			}
-			t.Errorf("ParseHost(%q): expected %q, got %q", host, expect, err_msg)
+		} else if err != nil {
+			t.Errorf("Compile(%q) in mode %d: %v", c.filter, c.mode, err)
+		} else if f.String() != c.expect {
+			t.Errorf("Compile(%q) in mode %d: expected %q, got %q", c.filter, c.mode, c.expect, f.String())
 		}
 	}
+	var parseErr *ParseError
+	f := FilterT{Mode: HostStrict}
+	if err := f.Compile("010"); !errors.As(err, &parseErr) || !errors.Is(err, ErrLeadingZero) {
+		t.Errorf("expect ErrLeadingZero, got %v", err)
+	}
+	f = FilterT{Mode: HostLenient}
+	if err := f.Compile("0x0a000001 or 167772161"); err != nil {
+		t.Fatal(err)
+	}
+	f.Optimize()
+	if f.Mode != HostLenient || f.GetFilter() != "10.0.0.1/32" {
+		t.Errorf("expect Optimize to keep the mode, got %d, %q", f.Mode, f.GetFilter())
+	}
 }
 
 func TestFailCompile(t *testing.T) {
@@ -169,18 +304,92 @@ func TestFailCompile(t *testing.T) {
 		// err_msg_ip_domain
 		"256.0.0.1/20": NewErrorToken(err_code_ip_domain, token_value, 0),
 
+		// err_msg_mask6
+		"fe80::/129":     NewErrorToken(err_code_mask6, token_value, 0),
+		"10 or fe80::/a": NewErrorToken(err_code_mask6, token_value, 6),
+
+		// err_msg_ip6
+		"2001:db8:::1":             NewErrorToken(err_code_ip6, token_value, 0),
+		"10 and 1:2:3:4:5:6:7:8:9": NewErrorToken(err_code_ip6, token_value, 7),
+		"::ffff:10.0.0.256":        NewErrorToken(err_code_ip6, token_value, 0),
+
+		// err_msg_too_many_mask, ipv6
+		"fe80::/10/12": NewErrorToken(err_code_too_many_mask, token_value, 0),
+
+		// address ranges
+		"10.0.0.9-10.0.0.5":          NewErrorToken(err_code_range, token_value, 0),
+		"10 or 10.0.0.5-10.0.0":      NewErrorToken(err_code_range, token_value, 6),
+		"10.0.0.5-":                  NewErrorToken(err_code_range, token_value, 0),
+		"10.0.0.5-10.0.0.6-10.0.0.7": NewErrorToken(err_code_range, token_value, 0),
+		"10.0.0.5-10.0.0.6/24":       NewErrorToken(err_code_range, token_value, 0),
+		"10.0.0.5-10.0.0.256":        NewErrorToken(err_code_ip_domain, token_value, 0),
+		"10.0.0.5-::1":               NewErrorToken(err_code_range, token_value, 0),
+		"::1-10.0.0.5":               NewErrorToken(err_code_range, token_value, 0),
+		"::1-::ffff:10.0.0.5":        NewErrorToken(err_code_range, token_value, 0),
+		"2001:db8::2-2001:db8::1":    NewErrorToken(err_code_range, token_value, 0),
+		"host 10.0.0.5-10.0.0.5":     NewErrorToken(err_code_host, token_host, 0),
+
+		// netmasks and wildcards
+		"10.*.3":                       NewErrorToken(err_code_wildcard, token_value, 0),
+		"10.*.3.0/24":                  NewErrorToken(err_code_wildcard, token_value, 0),
+		"10.1*.3.*":                    NewErrorToken(err_code_wildcard, token_value, 0),
+		"10 or *.*.*.256":              NewErrorToken(err_code_ip_domain, token_value, 6),
+		"10.0.0.0 mask 255.255.0":      NewErrorToken(err_code_netmask, token_value, 0),
+		"10.0.0.0 mask":                NewErrorToken(err_code_netmask, token_value, 0),
+		"10.0.0.1 mask255.255.0.0":     NewErrorToken(err_code_netmask, token_value, 0),
+		"10.0.0.1 wildcard0.0.255.255": NewErrorToken(err_code_netmask, token_value, 0),
+		"::1 mask(ffff::)":             NewErrorToken(err_code_netmask, token_value, 0),
+		"10.0.0.0 wildcard ::ff":       NewErrorToken(err_code_netmask, token_value, 0),
+		"2001:db8:: mask 255.255.0.0":  NewErrorToken(err_code_netmask, token_value, 0),
+		"10 mask 255.0.0.0":            NewErrorToken(err_code_set_mask, token_value, 0),
+		"host 10.0.0.0 mask 255.0.0.0": NewErrorToken(err_code_host, token_host, 0),
+		"10.0.0.0/8 mask 255.0.0.0":    NewErrorToken(err_code_token, token_set, 11),
+
+		// qualifiers
+		"src":                  NewErrorToken(err_code_no_values, token_src, 0),
+		"10 src":               NewErrorToken(err_code_no_values, token_src, 3),
+		"src not 10":           NewErrorToken(err_code_qualifier, token_src, 0),
+		"1 and src (10 or 11)": NewErrorToken(err_code_qualifier, token_src, 6),
+		"src dst 10":           NewErrorToken(err_code_dup_qualifier, token_src, 0),
+		"host net 1.2.3.4":     NewErrorToken(err_code_dup_qualifier, token_host, 0),
+		"dst host 10":          NewErrorToken(err_code_host, token_host, 4),
+		"host fe80::/64":       NewErrorToken(err_code_host, token_host, 0),
+		"sr 10":                NewErrorToken(err_code_token, token_src, 0),
+		"10 or hots 1":         NewErrorToken(err_code_token, token_host, 6),
+
+		// ports
+		"port":            NewErrorToken(err_code_port, token_port, 0),
+		"port 65536":      NewErrorToken(err_code_port, token_port, 0),
+		"port -1":         NewErrorToken(err_code_port, token_port, 0),
+		"10 or port 1-2":  NewErrorToken(err_code_port, token_port, 6),
+		"portrange 10-5":  NewErrorToken(err_code_portrange, token_portrange, 0),
+		"portrange 10":    NewErrorToken(err_code_portrange, token_portrange, 0),
+		"portrange 1-2-3": NewErrorToken(err_code_portrange, token_portrange, 0),
+		"portrange 1-ab":  NewErrorToken(err_code_port, token_portrange, 0),
+		"pot 1":           NewErrorToken(err_code_token, token_port, 0),
+		"net port 80":     NewErrorToken(err_code_dup_qualifier, token_net, 0),
+
+		// protocols
+		"proto":           NewErrorToken(err_code_proto, token_proto, 0),
+		"ip proto 256":    NewErrorToken(err_code_proto, token_proto, 0),
+		"10 or ip6 proto": NewErrorToken(err_code_proto, token_proto, 6),
+		"ip 47":           NewErrorToken(err_code_token, token_proto, 0),
+		"tcq":             NewErrorToken(err_code_token, token_proto, 0),
+		"src tcp":         NewErrorToken(err_code_qualifier, token_src, 0),
+		"net udp":         NewErrorToken(err_code_dup_qualifier, token_net, 0),
+
 		// err_msg_token
 		"127.0.0.1 Oer": NewErrorToken(err_code_token, token_or, 10),
 		"127.0.0.1 Noe": NewErrorToken(err_code_token, token_not, 10),
 		"127.0.0.1 Ad":  NewErrorToken(err_code_token, token_and, 10),
 		"127.0.0.1 ad":  NewErrorToken(err_code_token, token_and, 10),
 	} {
-		expect := *(rawExpect.(*errorTokenT))
+		expect := *(rawExpect.(*ParseError))
 		err := filter.Compile(content)
 		if err == nil {
 			t.Errorf("Compile(%q): expected %v, got nil", content, expect)
-		} else if *(err.(*errorTokenT)) != expect {
-			t.Errorf("Compile(%q): expected %v, got %v", content, expect, *(err.(*errorTokenT)))
+		} else if *(err.(*ParseError)) != expect {
+			t.Errorf("Compile(%q): expected %v, got %v", content, expect, *(err.(*ParseError)))
 		}
 	}
 
@@ -210,6 +419,66 @@ func TestFailCompile(t *testing.T) {
 
 }
 
+func TestCompileAll(t *testing.T) {
+	f := FilterT{}
+	for content, expect := range map[string]struct {
+		errs []error
+		rpn  string
+	}{
+		"10 or 11": {nil, "10.0.0.0/8[0] 11.0.0.0/8[6] or[3]"},
+		"10 and 300.1 or 11 # x": {[]error{
+			NewErrorToken(err_code_ip_domain, token_value, 7),
+			NewErrorToken(err_code_charactor, token_unknown, 19),
+			NewErrorToken(err_code_charactor, token_unknown, 21),
+		}, "10.0.0.0/8[0] 11.0.0.0/8[16] or[13]"},
+		"10 or 1.2.3.4/40 or fe80::/200 and not x": {[]error{
+			NewErrorToken(err_code_mask, token_value, 6),
+			NewErrorToken(err_code_mask6, token_value, 20),
+			NewErrorToken(err_code_charactor, token_unknown, 39),
+		}, "10.0.0.0/8[0]"},
+		"src not 10 and 12 )": {[]error{
+			NewErrorToken(err_code_qualifier, token_src, 0),
+			NewErrorToken(err_code_brackets, token_right, 18),
+		}, "10.0.0.0/8[8] not[4] 12.0.0.0/8[15] and[11]"},
+		"10 (11) or 12": {[]error{
+			NewErrorToken(err_code_filter, token_left, 3),
+		}, "10.0.0.0/8[0] 11.0.0.0/8[4] and[2] 12.0.0.0/8[11] or[8]"},
+		"10 and and 11": {[]error{
+			NewErrorToken(err_code_no_values, token_and, 3),
+		}, "10.0.0.0/8[0] 11.0.0.0/8[11] and[7]"},
+		"not": {[]error{
+			NewErrorToken(err_code_no_values, token_not, 0),
+		}, ""},
+		"": {[]error{
+			NewErrorToken(err_code_filter, token_not_exsits, -1),
+		}, ""},
+	} {
+		err := f.CompileAll(content)
+		var errs []error
+		if err != nil {
+			errs = err.(interface{ Unwrap() []error }).Unwrap()
+		}
+		if len(errs) != len(expect.errs) {
+			t.Errorf("CompileAll(%q): expected %v, got %v", content, expect.errs, err)
+		} else {
+			for i := range errs {
+				if *(errs[i].(*ParseError)) != *(expect.errs[i].(*ParseError)) {
+					t.Errorf("CompileAll(%q): expected %v, got %v", content, expect.errs[i], errs[i])
+				}
+			}
+		}
+		if got := f.GetRPN(); got != expect.rpn || f.OK() != (expect.rpn != "") {
+			t.Errorf("CompileAll(%q): expected rpn %q, got %q", content, expect.rpn, got)
+		}
+		if f.GetFilter() != content {
+			t.Errorf("CompileAll(%q): filter not replaced", content)
+		}
+		if first := (&FilterT{}).Compile(content); (first == nil) != (err == nil) {
+			t.Errorf("CompileAll(%q): Compile returns %v", content, first)
+		}
+	}
+}
+
 func TestCompile(t *testing.T) {
 
 	f := FilterT{}
@@ -280,6 +549,39 @@ func TestCompile(t *testing.T) {
 		"() 1 ()": {newV("1.0.0.0", 8, 3)},
 		// ) )
 		"(1 and (2 or 3))": {newV("1.0.0.0", 8, 1), newV("2.0.0.0", 8, 8), newV("3.0.0.0", 8, 13), newOP(token_or, 10), newOP(token_and, 3)},
+
+		// ipv6
+		"2001:db8::/32 or fe80::/10 or 10": {newV6("2001:db8::", 32, 0), newV6("fe80::", 10, 17), newOP(token_or, 14),
+			newV("10.0.0.0", 8, 30), newOP(token_or, 27)},
+		"::1 and not ::ffff:10.0.0.1/120": {newV6("::1", 128, 0), newV6("::ffff:10.0.0.1", 120, 12), newOP(token_not, 8), newOP(token_and, 4)},
+		// qualifiers
+		"src net 10 and not dst host 192.168.1.1": {newQ(newV("10.0.0.0", 8, 8), dir_src, kind_net),
+			newQ(newV("192.168.1.1", 32, 28), dir_dst, kind_host), newOP(token_not, 15), newOP(token_and, 11)},
+		"Host 1.2.3.4":           {newQ(newV("1.2.3.4", 32, 5), dir_any, kind_host)},
+		"dst fe80::1 or SRC ::1": {newQ(newV6("fe80::1", 128, 4), dir_dst, kind_any), newQ(newV6("::1", 128, 19), dir_src, kind_any), newOP(token_or, 12)},
+		"net(src 10)":            {newQ(newV("10.0.0.0", 8, 8), dir_src, kind_net)},
+		// ports
+		"dst portrange 8000-8100 and src 10": {newQ(newP(kind_portrange, 8000, 8100, 4), dir_dst, kind_portrange),
+			newQ(newV("10.0.0.0", 8, 32), dir_src, kind_any), newOP(token_and, 24)},
+		"port 443 or not port 80": {newP(kind_port, 443, 443, 0), newP(kind_port, 80, 80, 16), newOP(token_not, 12), newOP(token_or, 9)},
+		"src port 53":             {newQ(newP(kind_port, 53, 53, 4), dir_src, kind_port)},
+		"Port  22and 10":          {newP(kind_port, 22, 22, 0), newV("10.0.0.0", 8, 12), newOP(token_and, 8)},
+		// protocols
+		"tcp or UDP and not icmp":     {newProto(kind_proto, proto_tcp, 0), newProto(kind_proto, proto_udp, 7), newOP(token_or, 4), newProto(kind_proto, proto_icmp, 19), newOP(token_not, 15), newOP(token_and, 11)},
+		"ip proto 47 or ip6 proto 58": {newProto(kind_proto4, 47, 0), newProto(kind_proto6, 58, 15), newOP(token_or, 12)},
+		"proto  6andicmp6":            {newProto(kind_proto, proto_tcp, 0), newProto(kind_proto, proto_icmp6, 11), newOP(token_and, 8)},
+		"(add::1)and!DEAD:beef::/64":  {newV6("add::1", 128, 1), newV6("dead:beef::", 64, 12), newOP(token_not, 11), newOP(token_and, 8)},
+		// netmasks and wildcards
+		"10.*.3.* or *.*.*.*": {newM("10.0.3.0", "255.0.255.0", 0), newV("0.0.0.0", 0, 12), newOP(token_or, 9)},
+		"10.1.2.3 mask 255.255.0.0 and 10.1.0.0  WILDCARD  0.255.0.7": {newV("10.1.2.3", 16, 0), newM("10.1.0.0", "255.0.255.248", 30),
+			newOP(token_and, 26)},
+		"dst 2001:db8::1 mask ffff:ffff::ffff or 10.0.0.0 mask 255.0.0.0": {newQ(newM6("2001:db8::1", "ffff:ffff::ffff"), dir_dst, kind_any),
+			newV("10.0.0.0", 8, 40), newOP(token_or, 37)},
+		// address ranges
+		"10.0.0.5-10.0.0.77 or src net ::1-::2:0": {newR("10.0.0.5", "10.0.0.77", 0), newQ(newR("::1", "::2:0", 30), dir_src, kind_net),
+			newOP(token_or, 19)},
+		"::ffff:1.2.3.4-::ffff:1.2.3.4 and not 2001:DB8::-2001:db8::ffff": {newR("1.2.3.4", "1.2.3.4", 0), newR("2001:db8::", "2001:db8::ffff", 38),
+			newOP(token_not, 34), newOP(token_and, 30)},
 	} {
 		err := f.Compile(content)
 		if err != nil {
@@ -323,23 +625,211 @@ func TestCheck(t *testing.T) {
 			"192.168.0.2": false,
 			"191.168.0.1": true,
 		},
+		"2001:db8::/32 or fe80::/10 or 10": map[string]bool{
+			"2001:db8::1":     true,
+			"2001:db9::1":     false,
+			"fe80::1":         true,
+			"febf:ffff::1":    true,
+			"fec0::1":         false,
+			"10.1.2.3":        true,
+			"::ffff:10.1.2.3": true,
+			"11.1.2.3":        false,
+			"::a01:203":       false,
+			"::ffff:11.1.2.3": false,
+		},
+		"::/0": map[string]bool{
+			"::1":       true,
+			"2001::1":   true,
+			"10.0.0.1":  false,
+			"127.0.0.1": false,
+		},
+		"::ffff:0:0/96 and not ::ffff:10.0.0.0/104": map[string]bool{
+			"10.0.0.1": false,
+			"11.0.0.1": true,
+			"::1":      false,
+			"2001::1":  false,
+		},
+		"0.0.0.0/0": map[string]bool{
+			"10.0.0.1":        true,
+			"::ffff:10.0.0.1": true,
+			"::1":             false,
+		},
+		"10.*.3.* or 2001:db8::1 mask ffff:ffff::ffff": map[string]bool{
+			"10.0.3.0":        true,
+			"10.200.3.77":     true,
+			"10.200.4.77":     false,
+			"11.0.3.1":        false,
+			"2001:db8:1::1":   true,
+			"2001:db8:1::2":   false,
+			"2001:db9::1":     false,
+			"::ffff:10.1.3.1": true,
+		},
+		"10.0.0.5-10.0.1.77 or ::fffe:0:0-::1:0:0:0": map[string]bool{
+			"10.0.0.4":         false,
+			"10.0.0.5":         true,
+			"10.0.0.255":       true,
+			"::ffff:10.0.1.0":  true,
+			"10.0.1.77":        true,
+			"10.0.1.78":        false,
+			"::fffe:0:1":       true,
+			"11.0.0.1":         false,
+			"::1:0:0:0":        true,
+			"::1:0:0:1":        false,
+			"::fffd:ffff:ffff": false,
+		},
 	} {
 		err := f.Compile(filter)
 		if err != nil {
 			panic(err)
 		}
 		for host, expect := range checks {
-			ip, err := ParseHost(host)
+			ip, err := ParseHostT(host)
 			if err != nil {
 				panic(err)
 			}
-			if got := f.Check(ip); got != expect {
+			if got := f.CheckHost(ip); got != expect {
 				t.Errorf("Check(%q): expect %v, got %v, filter \"%s\"", host, expect, got, filter)
 			}
 		}
 	}
 }
 
+func TestCheckPair(t *testing.T) {
+	f := FilterT{}
+	for filter, checks := range map[string]map[[2]string]bool{
+		"src net 10 and not dst host 192.168.1.1": {
+			{"10.0.0.1", "192.168.1.2"}: true,
+			{"10.0.0.1", "192.168.1.1"}: false,
+			{"11.0.0.1", "192.168.1.2"}: false,
+			{"192.168.1.2", "10.0.0.1"}: false,
+			{"10.0.0.1", ""}:            true,
+			{"", "192.168.1.2"}:         false,
+		},
+		"10 and host 2001:db8::1": {
+			{"10.0.0.1", "2001:db8::1"}: true,
+			{"2001:db8::1", "10.0.0.1"}: true,
+			{"2001:db8::1", "11.0.0.1"}: false,
+			{"10.0.0.1", ""}:            false,
+		},
+		"not src 10": {
+			{"10.0.0.1", "11.0.0.1"}: false,
+			{"11.0.0.1", "10.0.0.1"}: true,
+			{"", "10.0.0.1"}:         true,
+		},
+	} {
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		for pair, expect := range checks {
+			var src, dst netip.Addr
+			if pair[0] != "" {
+				src = netip.MustParseAddr(pair[0])
+			}
+			if pair[1] != "" {
+				dst = netip.MustParseAddr(pair[1])
+			}
+			if got := f.CheckPair(src, dst); got != expect {
+				t.Errorf("CheckPair(%q, %q): expect %v, got %v, filter %q", pair[0], pair[1], expect, got, filter)
+			}
+		}
+	}
+
+	if err := f.Compile("src 10 and dst 11"); err != nil {
+		t.Fatal(err)
+	}
+	if f.GetRPN() != "src 10.0.0.0/8[4] dst 11.0.0.0/8[15] and[7]" {
+		t.Errorf("get rpn fail, got %q", f.GetRPN())
+	}
+}
+
+func TestCheckConn(t *testing.T) {
+	f := FilterT{}
+	if err := f.Compile("src net 10 and (dst port 443 or dst portrange 8000-8100) and not port 22"); err != nil {
+		t.Fatal(err)
+	}
+	src, dst := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.168.1.1")
+	for conn, expect := range map[ConnT]bool{
+		{Src: src, Dst: dst, SrcPort: 40000, DstPort: 443}:  true,
+		{Src: src, Dst: dst, SrcPort: 40000, DstPort: 8000}: true,
+		{Src: src, Dst: dst, SrcPort: 40000, DstPort: 8100}: true,
+		{Src: src, Dst: dst, SrcPort: 40000, DstPort: 8101}: false,
+		{Src: src, Dst: dst, SrcPort: 443, DstPort: 80}:     false,
+		{Src: src, Dst: dst, SrcPort: 22, DstPort: 443}:     false,
+		{Src: dst, Dst: src, SrcPort: 40000, DstPort: 443}:  false,
+		{Dst: dst, SrcPort: 40000, DstPort: 443}:            false,
+	} {
+		if got := f.CheckConn(conn); got != expect {
+			t.Errorf("CheckConn(%v): expect %v, got %v", conn, expect, got)
+		}
+	}
+
+	if err := f.Compile("10 or port 80"); err != nil {
+		t.Fatal(err)
+	}
+	ip, _ := ParseHost("11.0.0.1")
+	if f.Check(ip) {
+		t.Error("port value matches a host without ports")
+	}
+	if f.GetRPN() != "10.0.0.0/8[0] port 80[6] or[3]" {
+		t.Errorf("get rpn fail, got %q", f.GetRPN())
+	}
+	if len(f.Prefixes()) != 1 {
+		t.Errorf("Prefixes: expect 1 prefix, got %v", f.Prefixes())
+	}
+}
+
+func TestCheckFlow(t *testing.T) {
+	f := FilterT{}
+	v4, v4b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	v6, v6b := netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")
+	for filter, checks := range map[string]map[ConnT]bool{
+		"tcp and dst port 443": {
+			{Src: v4, Dst: v4b, DstPort: 443, Proto: proto_tcp}: true,
+			{Src: v4, Dst: v4b, DstPort: 443, Proto: proto_udp}: false,
+			{Src: v4, Dst: v4b, DstPort: 443}:                   false,
+		},
+		"udp or icmp": {
+			{Src: v4, Dst: v4b, Proto: proto_udp}:   true,
+			{Src: v4, Dst: v4b, Proto: proto_icmp}:  true,
+			{Src: v6, Dst: v6b, Proto: proto_icmp6}: false,
+			{Src: v4, Dst: v4b, Proto: proto_tcp}:   false,
+		},
+		"ip proto 47": {
+			{Src: v4, Dst: v4b, Proto: 47}: true,
+			{Src: v6, Dst: v6b, Proto: 47}: false,
+			{Dst: v4b, Proto: 47}:          true,
+			{Proto: 47}:                    false,
+		},
+		"ip6 proto 47 or proto 50": {
+			{Src: v4, Dst: v4b, Proto: 47}: false,
+			{Src: v6, Dst: v6b, Proto: 47}: true,
+			{Src: v4, Dst: v4b, Proto: 50}: true,
+		},
+		"port 53": {
+			{Src: v4, Dst: v4b, DstPort: 53, Proto: proto_udp}:  true,
+			{Src: v4, Dst: v4b, DstPort: 53, Proto: proto_sctp}: true,
+			{Src: v4, Dst: v4b, DstPort: 53, Proto: proto_icmp}: false,
+			{Src: v4, Dst: v4b, DstPort: 53}:                    true,
+		},
+	} {
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		for conn, expect := range checks {
+			if got := f.CheckConn(conn); got != expect {
+				t.Errorf("CheckConn(%v): expect %v, got %v, filter %q", conn, expect, got, filter)
+			}
+		}
+	}
+
+	if err := f.Compile("proto 6 or proto 17 or icmp6 or ip proto 1"); err != nil {
+		t.Fatal(err)
+	}
+	if f.GetRPN() != "tcp[0] udp[11] or[8] icmp6[23] or[20] ip proto 1[32] or[29]" {
+		t.Errorf("get rpn fail, got %q", f.GetRPN())
+	}
+}
+
 func newOP(t, pos int) tokenT {
 	return tokenT{t: t, pos: pos}
 }
@@ -349,7 +839,61 @@ func newV(ip string, mask, pos int) tokenT {
 	if err != nil {
 		panic(err)
 	}
-	return tokenT{t: token_value, cidr: cidrT{ip: ip1, mask: (-1) << uint(32-mask)}, pos: pos}
+	return tokenT{t: token_value, cidr: cidrT{ip: v4IP(ip1), mask: maskOf(v4_mapped_len + mask)}, pos: pos}
+}
+
+func newQ(token tokenT, dir, kind int) tokenT {
+	token.dir = dir
+	token.kind = kind
+	return token
+}
+
+func newP(kind, lo, hi, pos int) tokenT {
+	return tokenT{t: token_value, kind: kind, ports: portsT{lo: lo, hi: hi}, pos: pos}
+}
+
+func newProto(kind, proto, pos int) tokenT {
+	return tokenT{t: token_value, kind: kind, proto: proto, pos: pos}
+}
+
+func newV6(ip string, mask, pos int) tokenT {
+	ip1, err := ParseHostT(ip)
+	if err != nil {
+		panic(err)
+	}
+	return tokenT{t: token_value, cidr: cidrT{ip: ip1.ip, mask: maskOf(mask)}, pos: pos}
+}
+
+func newM(ip, mask string, pos int) tokenT {
+	token := newV(ip, 32, pos)
+	m, err := ParseHost(mask)
+	if err != nil {
+		panic(err)
+	}
+	token.cidr.mask = maskOf(v4_mapped_len).or(ipT{lo: uint64(uint32(m))})
+	return token
+}
+
+func newM6(ip, mask string) tokenT {
+	token := newV6(ip, 128, 4)
+	m, err := ParseHostT(mask)
+	if err != nil {
+		panic(err)
+	}
+	token.cidr.mask = m.ip
+	return token
+}
+
+func newR(first, last string, pos int) tokenT {
+	ip1, err := ParseHostT(first)
+	if err != nil {
+		panic(err)
+	}
+	ip2, err := ParseHostT(last)
+	if err != nil {
+		panic(err)
+	}
+	return tokenT{t: token_value, cidr: cidrT{ip: ip1.ip, last: ip2.ip, isRange: true}, pos: pos}
 }
 
 func compareTokens(t1, t2 []tokenT) bool {
@@ -0,0 +1,66 @@
+package filter
+
+import "strings"
+
+// Format formats filter in the canonical form, with lowercase keywords,
+// protocol names, masked prefixes in full cidr notation and only the
+// brackets precedence needs. Sets and macros are kept as they are written,
+// only a built-in set is in lowercase. The canonical form compiles to the
+// same filter.
+func Format(filter string) (string, error) {
+	if _, err := Parse(filter); err != nil {
+		return "", err
+	}
+	e, err := namedExpr(filter, HostDefault)
+	if err != nil {
+		return "", err
+	}
+	return canonical(e).String(), nil
+}
+
+// String returns the compiled filter in the canonical form of Format, with
+// the names it is compiled with, or the empty string if it is not compiled.
+func (f *FilterT) String() string {
+	if !f.OK() {
+		return ""
+	}
+	if f.partial {
+		// the names CompileAll dropped are not in the tree of the rpn
+		return canonical(f.Expr()).String()
+	}
+	e, _ := namedExpr(f.filter, f.Mode)
+	return canonical(e).String()
+}
+
+// canonical masks the host bits of the prefixes and netmasks of e, and
+// lowercases the keywords of the built-in sets
+func canonical(e Expr) Expr {
+	return Rewrite(e, func(e Expr) Expr {
+		switch n := e.(type) {
+		case *Name:
+			if lower := strings.ToLower(n.Name); lower != n.Name && n.Name[0] != '@' && n.Name[0] != '$' {
+				named := *n
+				named.Name = lower
+				return &named
+			}
+		case *Prefix:
+			if n.Prefix != n.Prefix.Masked() {
+				masked := *n
+				masked.Prefix = n.Prefix.Masked()
+				return &masked
+			}
+		case *Netmask:
+			if _, err := tokenOf(n); err != nil {
+				return e
+			}
+			cidr := cidrFromNetmask(n.Addr, n.Mask)
+			cidr.ip = cidr.ip.and(cidr.mask)
+			if addr, mask := cidr.netmask(); addr != n.Addr || mask != n.Mask {
+				masked := *n
+				masked.Addr, masked.Mask = addr, mask
+				return &masked
+			}
+		}
+		return e
+	})
+}
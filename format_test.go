@@ -0,0 +1,95 @@
+package filter
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	for filter, expect := range map[string]string{
+		"10":                                   "10.0.0.0/8",
+		"127.0.0.1/24 AND 172.16 || !!192.168": "127.0.0.0/24 and 172.16.0.0/16 or not not 192.168.0.0/16",
+		"(10 or 11) and (12 or (13))":          "10.0.0.0/8 or 11.0.0.0/8 and (12.0.0.0/8 or 13.0.0.0/8)",
+		"not (10 and 11)":                      "not (10.0.0.0/8 and 11.0.0.0/8)",
+		"SRC Host 1.2.3.4 or Dst NET 2001:DB8::1/32": "src host 1.2.3.4/32 or dst net 2001:db8::/32",
+		"PROTO 6 or ip proto 17 or proto 58":         "tcp or ip proto 17 or icmp6",
+		"src port 80 && dst portrange 1-1024":        "src port 80 and dst portrange 1-1024",
+		"::ffff:10.1.2.3/104":                        "10.0.0.0/8",
+		"::ffff:0:0/95":                              "::fffe:0:0/95",
+		"src NET 10.0.0.5-10.0.0.77 or ::A-::ffff":   "src net 10.0.0.5-10.0.0.77 or ::a-::ffff",
+		"10.1.3.4 mask 255.0.255.0 or 10.*.*.*":      "10.*.3.* or 10.0.0.0/8",
+		"10.0.0.0 Wildcard 0.0.255.255":              "10.0.0.0/16",
+		"10.1.2.3 mask 255.0.255.1":                  "10.0.2.1 mask 255.0.255.1",
+		"2001:db8::1:1 mask ffff:ffff::ffff":         "2001:db8::1 mask ffff:ffff::ffff",
+		"::ffff:10.1.2.3 mask ffff::ffff:ff00:ff":    "::ffff:10.0.0.3 mask ffff::ffff:ff00:ff",
+		"private":                          "private",
+		"PRIVATE and (Src Loopback or 10)": "private and (src loopback or 10.0.0.0/8)",
+		"not (cgnat) or dst net @private":  "not cgnat or dst net @private",
+	} {
+		got, err := Format(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expect {
+			t.Errorf("Format(%q): expect %q, got %q", filter, expect, got)
+		}
+		f := FilterT{}
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		if f.String() != expect {
+			t.Errorf("String() of %q: expect %q, got %q", filter, expect, f.String())
+		}
+	}
+	if _, err := Format("10 and"); err == nil {
+		t.Error("expect an error")
+	}
+	if _, err := Format("@office"); !errors.Is(err, ErrUndefined) {
+		t.Errorf("expect ErrUndefined, got %v", err)
+	}
+	if (&FilterT{}).String() != "" {
+		t.Error("expect the empty string of a filter not compiled")
+	}
+}
+
+func TestFormatEquivalent(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	probes := tableProbes(r)
+	var pkts []pktT
+	for i := 0; i < 500; i++ {
+		pkt := pktT{src: probes[r.Intn(len(probes))], dst: probes[r.Intn(len(probes))], hasSrc: true, hasDst: true,
+			proto: []int{proto_tcp, proto_udp, proto_icmp}[r.Intn(3)], hasProto: true}
+		if pkt.proto != proto_icmp {
+			pkt.sport, pkt.dport, pkt.hasPorts = r.Intn(100), 80, true
+		}
+		pkts = append(pkts, pkt)
+	}
+	for n := 0; n < 200; n++ {
+		filter := randomFilter(r, 5)
+		formatted, err := Format(filter)
+		if err != nil {
+			t.Fatal(filter, err)
+		}
+		again, err := Format(formatted)
+		if err != nil || again != formatted {
+			t.Fatalf("Format(%q) is not stable: %q, %v", formatted, again, err)
+		}
+		f, g := FilterT{}, FilterT{}
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Compile(formatted); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(f.table, g.table) {
+			t.Fatalf("Format(%q) = %q matches other hosts", filter, formatted)
+		}
+		for i := range pkts {
+			if f.eval(&pkts[i]) != g.eval(&pkts[i]) {
+				t.Fatalf("Format(%q) = %q matches other packets", filter, formatted)
+			}
+		}
+	}
+}
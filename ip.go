@@ -0,0 +1,188 @@
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net/netip"
+	"strings"
+)
+
+// ipT is a 128 bit address, ipv4 addresses are kept v4-mapped (::ffff:a.b.c.d)
+type ipT struct {
+	hi uint64
+	lo uint64
+}
+
+// HostT is an ipv4 or ipv6 host address to check against a filter
+type HostT struct {
+	ip ipT
+}
+
+const (
+	v4_mapped_prefix = 0xffff
+	v4_mapped_len    = 96
+)
+
+const (
+	err_msg_parse_host_ip6 = "malformed ipv6 address"
+)
+
+var ErrHostIP6 = errors.New(err_msg_parse_host_ip6)
+
+// ParseHostT parses a dotted quad ipv4 address or an ipv6 address.
+func ParseHostT(rawIP string) (HostT, error) {
+	return ParseHostTMode(rawIP, HostDefault)
+}
+
+// ParseHostTMode parses an ipv6 address, or an ipv4 address as mode reads
+// it.
+func ParseHostTMode(rawIP string, mode HostMode) (HostT, error) {
+	if !strings.Contains(rawIP, ":") {
+		ip, err := ParseHostMode(rawIP, mode)
+		if err != nil {
+			return HostT{}, err
+		}
+		return HostT{ip: v4IP(ip)}, nil
+	}
+	ip, ok := parseIP6(rawIP)
+	if !ok {
+		return HostT{}, &HostError{Host: rawIP, Err: ErrHostIP6}
+	}
+	return HostT{ip: ip}, nil
+}
+
+// HostFromAddr converts addr to a host, the zone of addr is dropped.
+// A v4-mapped ipv6 addr is the same host as the ipv4 addr it maps.
+func HostFromAddr(addr netip.Addr) HostT {
+	return HostT{ip: ipFrom16(addr.As16())}
+}
+
+// Addr converts h to an ipv4 or ipv6 netip.Addr.
+func (h HostT) Addr() netip.Addr {
+	return netip.AddrFrom16(h.ip.as16()).Unmap()
+}
+
+func (h HostT) String() string {
+	return outputIP(h.ip)
+}
+
+// cidrFromPrefix converts p, ipv4 prefixes become v4-mapped
+func cidrFromPrefix(p netip.Prefix) cidrT {
+	n := p.Bits()
+	if p.Addr().Is4() {
+		n += v4_mapped_len
+	}
+	return cidrT{ip: ipFrom16(p.Addr().As16()), mask: maskOf(n)}
+}
+
+// prefix converts cidr to an ipv4 prefix if it is v4-mapped, to an ipv6
+// prefix otherwise. The host bits of cidr are kept.
+func (cidr cidrT) prefix() netip.Prefix {
+	n, _ := maskLen(cidr.mask)
+	addr := netip.AddrFrom16(cidr.ip.as16())
+	if cidr.ip.isV4() && n >= v4_mapped_len {
+		return netip.PrefixFrom(addr.Unmap(), n-v4_mapped_len)
+	}
+	return netip.PrefixFrom(addr, n)
+}
+
+// cidrFromNetmask converts the network of addr and mask, which are of one
+// family, ipv4 networks become v4-mapped
+func cidrFromNetmask(addr, mask netip.Addr) cidrT {
+	if addr.Is4() {
+		m := mask.As4()
+		return cidrT{ip: ipFrom16(addr.As16()), mask: maskOf(v4_mapped_len).or(ipT{lo: uint64(binary.BigEndian.Uint32(m[:]))})}
+	}
+	return cidrT{ip: ipFrom16(addr.As16()), mask: ipFrom16(mask.As16())}
+}
+
+// netmask converts cidr to its address and mask, ipv4 ones if it is a
+// v4-mapped network with an ipv4 mask. The host bits of cidr are kept.
+func (cidr cidrT) netmask() (netip.Addr, netip.Addr) {
+	if cidr.ip.isV4() && isV4Mask(cidr.mask) {
+		var m [4]byte
+		binary.BigEndian.PutUint32(m[:], uint32(cidr.mask.lo))
+		return netip.AddrFrom16(cidr.ip.as16()).Unmap(), netip.AddrFrom4(m)
+	}
+	return netip.AddrFrom16(cidr.ip.as16()), netip.AddrFrom16(cidr.mask.as16())
+}
+
+func parseIP6(rawIP string) (ipT, bool) {
+	addr, err := netip.ParseAddr(rawIP)
+	if err != nil || !addr.Is6() || addr.Zone() != "" {
+		return ipT{}, false
+	}
+	return ipFrom16(addr.As16()), true
+}
+
+func v4IP(ip int) ipT {
+	return ipT{lo: v4_mapped_prefix<<32 | uint64(uint32(ip))}
+}
+
+func ipFrom16(b [16]byte) ipT {
+	return ipT{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+func (ip ipT) as16() [16]byte {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], ip.hi)
+	binary.BigEndian.PutUint64(b[8:], ip.lo)
+	return b
+}
+
+func (ip ipT) and(m ipT) ipT {
+	return ipT{hi: ip.hi & m.hi, lo: ip.lo & m.lo}
+}
+
+func (ip ipT) or(m ipT) ipT {
+	return ipT{hi: ip.hi | m.hi, lo: ip.lo | m.lo}
+}
+
+func (ip ipT) xor(m ipT) ipT {
+	return ipT{hi: ip.hi ^ m.hi, lo: ip.lo ^ m.lo}
+}
+
+// isV4 reports whether ip lies in ::ffff:0:0/96
+func (ip ipT) isV4() bool {
+	return ip.hi == 0 && ip.lo>>32 == v4_mapped_prefix
+}
+
+// v4 returns the low 32 bits of ip
+func (ip ipT) v4() int {
+	return int(uint32(ip.lo))
+}
+
+// maskOf returns a mask with the n leading bits set
+func maskOf(n int) ipT {
+	switch {
+	case n <= 0:
+		return ipT{}
+	case n <= 64:
+		return ipT{hi: ^uint64(0) << uint(64-n)}
+	case n < 128:
+		return ipT{hi: ^uint64(0), lo: ^uint64(0) << uint(128-n)}
+	default:
+		return ipT{hi: ^uint64(0), lo: ^uint64(0)}
+	}
+}
+
+// maskLen returns the prefix length of m, ok is false if m is not a prefix mask
+func maskLen(m ipT) (int, bool) {
+	n := bits.LeadingZeros64(^m.hi)
+	if n == 64 {
+		n += bits.LeadingZeros64(^m.lo)
+	}
+	return n, maskOf(n) == m
+}
+
+func outputIP(ip ipT) string {
+	if ip.isV4() {
+		return outputIP4(ip.v4())
+	}
+	return outputIP6(ip)
+}
+
+func outputIP6(ip ipT) string {
+	return netip.AddrFrom16(ip.as16()).String()
+}
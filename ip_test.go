@@ -0,0 +1,131 @@
+package filter
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseHostT(t *testing.T) {
+	for host, expect := range map[string]string{
+		"127.0.0.1":            "127.0.0.1",
+		"::1":                  "::1",
+		"2001:DB8::1":          "2001:db8::1",
+		"::ffff:192.168.1.1":   "192.168.1.1",
+		"fe80:0:0:0:0:0:0:1":   "fe80::1",
+		"2001:db8:0:0:1::ffff": "2001:db8::1:0:0:ffff",
+	} {
+		r, err := ParseHostT(host)
+		if err != nil {
+			t.Errorf("ParseHostT(%q): err %s", host, err.Error())
+		} else if r.String() != expect {
+			t.Errorf("ParseHostT(%q): expected %s, got %s", host, expect, r.String())
+		}
+	}
+}
+
+func TestParseHostTMode(t *testing.T) {
+	for host, expect := range map[string]string{
+		"167772161":       "10.0.0.1",
+		"0x0a000001":      "10.0.0.1",
+		"::ffff:10.0.0.1": "10.0.0.1",
+		"2001:db8::1":     "2001:db8::1",
+	} {
+		r, err := ParseHostTMode(host, HostLenient)
+		if err != nil || r.String() != expect {
+			t.Errorf("ParseHostTMode(%q): expected %s, got %s, %v", host, expect, r.String(), err)
+		}
+	}
+	if _, err := ParseHostTMode("10.0.0.01", HostStrict); !errors.Is(err, ErrHostLeadingZero) {
+		t.Errorf("ParseHostTMode: expected %q, got %v", ErrHostLeadingZero, err)
+	}
+}
+
+func TestFailParseHostT(t *testing.T) {
+	for host, expect := range map[string]error{
+		"288.0.0.1":  ErrHostIPDomain,
+		"127":        ErrHostMalformed,
+		"fe80::1%lo": ErrHostIP6,
+		"::1/128":    ErrHostIP6,
+		"1:2:3":      ErrHostIP6,
+	} {
+		_, err := ParseHostT(host)
+		if !errors.Is(err, expect) {
+			t.Errorf("ParseHostT(%q): expected %q, got %v", host, expect, err)
+		}
+	}
+}
+
+func TestHostAddr(t *testing.T) {
+	for _, raw := range []string{"10.0.0.1", "::1", "2001:db8::1", "::ffff:10.0.0.1"} {
+		addr := netip.MustParseAddr(raw)
+		if got := HostFromAddr(addr).Addr(); got != addr.Unmap() {
+			t.Errorf("HostFromAddr(%s).Addr(): got %s", addr, got)
+		}
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	f := FilterT{}
+	if err := f.Compile("10 or 2001:db8::/32"); err != nil {
+		t.Fatal(err)
+	}
+	for raw, expect := range map[string]bool{
+		"10.1.1.1":         true,
+		"::ffff:10.1.1.1":  true,
+		"11.1.1.1":         false,
+		"2001:db8::1":      true,
+		"2001:db8::1%eth0": true,
+		"2001:db9::1":      false,
+	} {
+		addr := netip.MustParseAddr(raw)
+		if got := f.CheckAddr(addr); got != expect {
+			t.Errorf("CheckAddr(%s): expect %v, got %v", raw, expect, got)
+		}
+		if got := f.CheckIP(net.IP(addr.AsSlice())); got != expect {
+			t.Errorf("CheckIP(%s): expect %v, got %v", raw, expect, got)
+		}
+	}
+	if f.CheckAddr(netip.Addr{}) {
+		t.Error("CheckAddr of an invalid addr return true")
+	}
+	if f.CheckIP(net.IP{1, 2, 3}) {
+		t.Error("CheckIP of a malformed ip return true")
+	}
+	if f.CheckIP(net.ParseIP("10.0.0.1")) != true {
+		t.Error("CheckIP of a 16 byte ipv4 return false")
+	}
+}
+
+func TestPrefixes(t *testing.T) {
+	f := FilterT{}
+	if err := f.Compile("10.1.2.3/8 and not (::ffff:10.0.0.0/104 or fe80::1/10 or ::/0)"); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range f.Prefixes() {
+		got = append(got, p.String())
+	}
+	expect := "10.1.2.3/8 10.0.0.0/8 fe80::1/10 ::/0"
+	if strings.Join(got, " ") != expect {
+		t.Errorf("Prefixes: expect %s, got %v", expect, got)
+	}
+	for _, p := range f.Prefixes() {
+		if cidrFromPrefix(p).prefix() != p {
+			t.Errorf("cidrFromPrefix(%s).prefix(): got %s", p, cidrFromPrefix(p).prefix())
+		}
+	}
+}
+
+func TestMaskLen(t *testing.T) {
+	for n := 0; n <= 128; n++ {
+		if got, ok := maskLen(maskOf(n)); !ok || got != n {
+			t.Errorf("maskLen(maskOf(%d)): got %d, %v", n, got, ok)
+		}
+	}
+	if _, ok := maskLen(ipT{hi: 1}); ok {
+		t.Error("maskLen of a non prefix mask return ok")
+	}
+}
@@ -0,0 +1,406 @@
+package filter
+
+// constants an expression folds to
+const (
+	fold_none  = 0
+	fold_true  = 1
+	fold_false = 2
+)
+
+// Optimize replaces the filter with an equivalent one which is no larger. It
+// removes double negations, folds operands which are always true or false,
+// drops the operands of an and or or absorbed by the others, as 10.1.2.3 is
+// by 10 in "10 or 10.1.2.3", and merges adjacent networks or-ed together
+// into the network of both. The filter becomes the canonical form of the
+// optimized one, so GetFilter and Expr return it. Optimize does nothing if
+// the filter is not compiled.
+func (f *FilterT) Optimize() {
+	if !f.OK() {
+		return
+	}
+	e, c := optimize(toExpr(f.rpn))
+	if c != fold_none {
+		e = constantExpr(f.rpn, c)
+	}
+	if len(fromExpr(e, nil)) > len(f.rpn) {
+		// the constant is larger than the filter folded to it
+		e = toExpr(f.rpn)
+	}
+	optimized := FilterT{Mode: f.Mode}
+	if err := optimized.Compile(canonical(exprOf(e, nil)).String()); err == nil {
+		*f = optimized
+	}
+}
+
+// optimize returns e simplified, or nil and the constant e folds to
+func optimize(e *exprT) (*exprT, int) {
+	switch e.token.t {
+	case token_not:
+		x, c := optimize(e.x)
+		switch {
+		case c == fold_true:
+			return nil, fold_false
+		case c == fold_false:
+			return nil, fold_true
+		case x.token.t == token_not:
+			return x.x, fold_none
+		}
+		return &exprT{token: e.token, x: x}, fold_none
+	case token_and, token_or:
+		return optimizeChain(e)
+	}
+	return e, fold_none
+}
+
+// optimizeChain simplifies a chain of the same operator as a whole, so the
+// operands are compared with each other wherever the brackets are
+func optimizeChain(e *exprT) (*exprT, int) {
+	op := e.token.t
+	absorbing, neutral := fold_false, fold_true
+	if op == token_or {
+		absorbing, neutral = fold_true, fold_false
+	}
+
+	var list []*exprT
+	for _, operand := range operands(e) {
+		x, c := optimize(operand)
+		switch {
+		case c == absorbing:
+			return nil, absorbing
+		case c == neutral:
+		case x.token.t == op:
+			list = append(list, operands(x)...)
+		default:
+			list = append(list, x)
+		}
+	}
+	for {
+		list = absorb(op, list)
+		if op != token_or {
+			break
+		}
+		var merged bool
+		if list, merged = mergeCidrs(list); !merged {
+			break
+		}
+	}
+	if complementary(op, list) {
+		return nil, absorbing
+	}
+	if len(list) == 0 {
+		return nil, neutral
+	}
+
+	chain := list[0]
+	for _, y := range list[1:] {
+		chain = &exprT{token: e.token, x: chain, y: y}
+	}
+	return chain, fold_none
+}
+
+// absorb drops the operands of an or which imply another one, and those of
+// an and which another one implies, the first of equal operands is kept
+func absorb(op int, list []*exprT) []*exprT {
+	dropped := make([]bool, len(list))
+	absorbCidrs(op, list, dropped)
+	var others []int
+	for i, x := range list {
+		if prefixKey(x.token) == nil {
+			others = append(others, i)
+		}
+	}
+	drop := func(i, j int) {
+		if i == j || dropped[i] || dropped[j] {
+			return
+		}
+		if (op == token_or && implies(list[i], list[j])) || (op == token_and && implies(list[j], list[i])) {
+			dropped[i] = true
+		}
+	}
+	for _, i := range others {
+		for j := range list {
+			drop(i, j)
+			drop(j, i)
+		}
+	}
+	kept := list[:0:0]
+	for i, x := range list {
+		if !dropped[i] {
+			kept = append(kept, x)
+		}
+	}
+	return kept
+}
+
+// prefixT is a network value with a prefix mask
+type prefixT struct {
+	dir int
+	ip  ipT
+	n   int
+}
+
+// prefixKey returns the network of token, nil if it is not a network value
+// with a prefix mask
+func prefixKey(token tokenT) *prefixT {
+	if !isCidr(token) || token.cidr.isRange {
+		return nil
+	}
+	n, ok := maskLen(token.cidr.mask)
+	if !ok {
+		return nil
+	}
+	return &prefixT{dir: token.dir, ip: token.cidr.ip.and(token.cidr.mask), n: n}
+}
+
+// absorbCidrs is absorb for the network values, it looks the networks
+// containing a network up by their prefixes instead of comparing every two,
+// as a long list of networks or-ed together would take
+func absorbCidrs(op int, list []*exprT, dropped []bool) {
+	index := map[prefixT]int{}
+	for i, x := range list {
+		if key := prefixKey(x.token); key == nil {
+		} else if _, found := index[*key]; found {
+			dropped[i] = true
+		} else {
+			index[*key] = i
+		}
+	}
+	for i, x := range list {
+		key := prefixKey(x.token)
+		if key == nil || dropped[i] {
+			continue
+		}
+		dirs := []int{dir_any}
+		if key.dir != dir_any {
+			dirs = append(dirs, key.dir)
+		}
+		for _, dir := range dirs {
+			for n := 0; n <= key.n && !dropped[i]; n++ {
+				j, found := index[prefixT{dir: dir, ip: key.ip.and(maskOf(n)), n: n}]
+				if !found || j == i || dropped[j] || !valueImplies(x.token, list[j].token) {
+					continue
+				}
+				if op == token_or {
+					dropped[i] = true
+				} else {
+					dropped[j] = true
+				}
+			}
+		}
+	}
+}
+
+// complementary reports whether an or is always true, as "x or not x" is,
+// or an and always false
+func complementary(op int, list []*exprT) bool {
+	for j := range list {
+		for i := 0; list[j].token.t == token_not && i < len(list); i++ {
+			if i == j {
+				continue
+			}
+			if (op == token_or && implies(list[j].x, list[i])) || (op == token_and && implies(list[i], list[j].x)) {
+				return true
+			}
+		}
+	}
+	if op == token_or {
+		return false
+	}
+	// the values of one direction are checked against each other, those of
+	// either direction never are disjoint but protocols
+	values := map[int][]tokenT{}
+	for _, x := range list {
+		if x.token.t == token_value {
+			dir := x.token.dir
+			if isProto(x.token) {
+				dir = -1
+			}
+			values[dir] = append(values[dir], x.token)
+		}
+	}
+	for dir, tokens := range values {
+		for i := 0; dir != dir_any && i < len(tokens); i++ {
+			for j := i + 1; j < len(tokens); j++ {
+				if disjoint(tokens[i], tokens[j]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// implies reports whether every packet a matches is matched by b, it may
+// miss some which are
+func implies(a, b *exprT) bool {
+	switch {
+	case b.token.t == token_and:
+		for _, y := range operands(b) {
+			if !implies(a, y) {
+				return false
+			}
+		}
+		return true
+	case a.token.t == token_or:
+		for _, x := range operands(a) {
+			if !implies(x, b) {
+				return false
+			}
+		}
+		return true
+	case a.token.t == token_and:
+		for _, x := range operands(a) {
+			if implies(x, b) {
+				return true
+			}
+		}
+		return false
+	case b.token.t == token_or:
+		for _, y := range operands(b) {
+			if implies(a, y) {
+				return true
+			}
+		}
+		return false
+	case a.token.t == token_not && b.token.t == token_not:
+		return implies(b.x, a.x)
+	case b.token.t == token_not:
+		return a.token.t == token_value && b.x.token.t == token_value && disjoint(a.token, b.x.token)
+	case a.token.t == token_not:
+		return false
+	}
+	return valueImplies(a.token, b.token)
+}
+
+// valueImplies reports whether every packet value a matches is matched by
+// value b
+func valueImplies(a, b tokenT) bool {
+	if a.dir != b.dir && b.dir != dir_any {
+		return false
+	}
+	switch {
+	case isCidr(a) && isCidr(b):
+		return cidrSubset(a.cidr, b.cidr)
+	case isPorts(a) && isPorts(b):
+		return a.ports.lo >= b.ports.lo && a.ports.hi <= b.ports.hi
+	case isProto(a) && isProto(b):
+		return a.proto == b.proto && (a.kind == b.kind || b.kind == kind_proto)
+	}
+	return false
+}
+
+// disjoint reports whether no packet matches both values a and b
+func disjoint(a, b tokenT) bool {
+	switch {
+	case isProto(a) && isProto(b):
+		return a.proto != b.proto || (a.kind != b.kind && a.kind != kind_proto && b.kind != kind_proto)
+	case a.dir != b.dir || a.dir == dir_any:
+		return false
+	case isCidr(a) && isCidr(b):
+		return cidrDisjoint(a.cidr, b.cidr)
+	case isPorts(a) && isPorts(b):
+		return a.ports.hi < b.ports.lo || b.ports.hi < a.ports.lo
+	}
+	return false
+}
+
+func isPorts(token tokenT) bool {
+	return token.kind == kind_port || token.kind == kind_portrange
+}
+
+func isProto(token tokenT) bool {
+	return token.kind == kind_proto || token.kind == kind_proto4 || token.kind == kind_proto6
+}
+
+// cidrSubset reports whether the hosts of a, as checkIn matches them, are
+// hosts of b, a network without an ipv4 mask has no v4-mapped host
+func cidrSubset(a, b cidrT) bool {
+	if a.isRange || b.isRange {
+		x, ok := cidrRanges(a, nil)
+		y, ok2 := cidrRanges(b, nil)
+		return ok && ok2 && len(intersectRanges(x, complementRanges(y))) == 0
+	}
+	m, ok := maskLen(a.mask)
+	n, ok2 := maskLen(b.mask)
+	if !ok || !ok2 || n > m || a.ip.and(b.mask) != b.ip.and(b.mask) {
+		return false
+	}
+	return isV4Mask(b.mask) || !isV4Mask(a.mask) || !a.ip.isV4()
+}
+
+// cidrDisjoint reports whether a and b have no host in common
+func cidrDisjoint(a, b cidrT) bool {
+	if a.isRange || b.isRange {
+		x, ok := cidrRanges(a, nil)
+		y, ok2 := cidrRanges(b, nil)
+		return ok && ok2 && len(intersectRanges(x, y)) == 0
+	}
+	m, ok := maskLen(a.mask)
+	n, ok2 := maskLen(b.mask)
+	if !ok || !ok2 {
+		return false
+	}
+	if m < n {
+		a, b = b, a
+	}
+	// a is the longer prefix, its hosts are all in b unless they are v4-mapped
+	return !cidrSubset(a, b)
+}
+
+// mergeCidrs replaces two networks of the same direction which are the
+// halves of a network by that network
+func mergeCidrs(list []*exprT) ([]*exprT, bool) {
+	seen := map[prefixT]int{}
+	dropped := make([]bool, len(list))
+	merged := false
+	for i, x := range list {
+		key := prefixKey(x.token)
+		if key == nil || key.n == 0 {
+			continue
+		}
+		sibling := *key
+		sibling.ip = key.ip.xor(maskOf(key.n).xor(maskOf(key.n - 1)))
+		// ::ffff:0:0/96 has the v4 hosts, which ::fffe:0:0/95 has not
+		if key.n == 96 && (key.ip.isV4() || sibling.ip.isV4()) {
+			continue
+		}
+		j, found := seen[sibling]
+		if !found {
+			seen[*key] = i
+			continue
+		}
+		token := list[j].token
+		if token.kind != kind_net || x.token.kind != kind_net {
+			token.kind = kind_any
+		}
+		token.cidr = cidrT{ip: key.ip.and(maskOf(key.n - 1)), mask: maskOf(key.n - 1)}
+		list[j] = &exprT{token: token}
+		dropped[i], merged = true, true
+		delete(seen, sibling)
+	}
+	kept := list[:0:0]
+	for i, x := range list {
+		if !dropped[i] {
+			kept = append(kept, x)
+		}
+	}
+	return kept, merged
+}
+
+// constantExpr returns "x or not x" or "x and not x" of the first value
+// of rpn for a filter folded to c
+func constantExpr(rpn []tokenT, c int) *exprT {
+	var value tokenT
+	for _, token := range rpn {
+		if token.t == token_value {
+			value = token
+			break
+		}
+	}
+	op := tokenT{t: token_and}
+	if c == fold_true {
+		op.t = token_or
+	}
+	x := &exprT{token: value}
+	return &exprT{token: op, x: x, y: &exprT{token: tokenT{t: token_not}, x: x}}
+}
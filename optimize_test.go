@@ -0,0 +1,149 @@
+package filter
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	for filter, expect := range map[string]string{
+		"10 or 10.1.2.3":                         "10.0.0.0/8",
+		"10.1.2.3 or 10":                         "10.0.0.0/8",
+		"10 and 10.1":                            "10.1.0.0/16",
+		"not not 10":                             "10.0.0.0/8",
+		"not not not 10":                         "not 10.0.0.0/8",
+		"10 or 10":                               "10.0.0.0/8",
+		"192.168.0.0/24 or 192.168.1.0/24":       "192.168.0.0/23",
+		"192.168.0.0/24 or 11 or 192.168.1.0/24": "192.168.0.0/23 or 11.0.0.0/8",
+		"10.0.0.0/10 or 10.64.0.0/10 or 10.128.0.0/9": "10.0.0.0/8",
+		"src 192.168.0.0/24 or dst 192.168.1.0/24":    "src 192.168.0.0/24 or dst 192.168.1.0/24",
+		"src 10.1 or 10":                                         "10.0.0.0/8",
+		"src 10.1 and 10":                                        "src 10.1.0.0/16",
+		"10 or (10 and port 80)":                                 "10.0.0.0/8",
+		"10 and (10 or port 80)":                                 "10.0.0.0/8",
+		"(10 or not 10) and 11":                                  "11.0.0.0/8",
+		"(10 and not 10) or 11":                                  "11.0.0.0/8",
+		"(src 10 and src 11) or 12":                              "12.0.0.0/8",
+		"(10 and 11) or 12":                                      "10.0.0.0/8 and 11.0.0.0/8 or 12.0.0.0/8",
+		"(10 or not 10.1) and 12":                                "12.0.0.0/8",
+		"(tcp and udp) or 12":                                    "12.0.0.0/8",
+		"(ip proto 6 and ip6 proto 6) or 12":                     "12.0.0.0/8",
+		"ip proto 6 or tcp":                                      "tcp",
+		"portrange 1-100 or port 80":                             "portrange 1-100",
+		"(src port 80 and src port 81) or 12":                    "12.0.0.0/8",
+		"port 80 and port 81":                                    "port 80 and port 81",
+		"not (10 and not 11) or 10":                              "10.0.0.0/8 or not 10.0.0.0/8",
+		"10 or not not (12 or 10.1)":                             "10.0.0.0/8 or 12.0.0.0/8",
+		"::ffff:0:0/96 or ::fffe:0:0/96":                         "0.0.0.0/0 or ::fffe:0:0/96",
+		"::/1 or 8000::/1":                                       "::/0",
+		"::/0 or 10":                                             "::/0 or 10.0.0.0/8",
+		"::/0 and 10":                                            "::/0 and 10.0.0.0/8",
+		"src ::/0 and src 10 or 11":                              "11.0.0.0/8",
+		"10 or not not (11 or 10.1)":                             "10.0.0.0/7",
+		"src ::/0 or src 10 and src 11":                          "src ::/0 or src 10.0.0.0/8 and src 11.0.0.0/8",
+		"0.0.0.0/1 or 128.0.0.0/1":                               "0.0.0.0/0",
+		"10 or not 10":                                           "10.0.0.0/8 or not 10.0.0.0/8",
+		"src 10 and src 11":                                      "src 10.0.0.0/8 and src 11.0.0.0/8",
+		"(10 or not 10) and (11 and not 11)":                     "10.0.0.0/8 and not 10.0.0.0/8",
+		"10.0.0.5-10.0.0.77 or 10":                               "10.0.0.0/8",
+		"10.0.0.5-10.0.0.77 and 10.0.0.0/24":                     "10.0.0.5-10.0.0.77",
+		"10.0.0.5-10.0.0.77 and not 10.0.0.0/24":                 "10.0.0.5-10.0.0.77 and not 10.0.0.5-10.0.0.77",
+		"10.0.0.5-10.0.0.77 and not 10.0.0.64/26":                "10.0.0.5-10.0.0.77 and not 10.0.0.64/26",
+		"src 10.0.0.5-10.0.0.77 and src 11":                      "src 10.0.0.5-10.0.0.77 and src 11.0.0.0/8",
+		"src 10.0.0.5-10.0.0.77 and src 10.0.0.1-10.0.0.4 or 12": "12.0.0.0/8",
+	} {
+		f := FilterT{}
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		f.Optimize()
+		if f.GetFilter() != expect {
+			t.Errorf("Optimize(%q): expect %q, got %q", filter, expect, f.GetFilter())
+		}
+		if len(f.Expr().String()) == 0 {
+			t.Errorf("Optimize(%q): no tree", filter)
+		}
+	}
+
+	f := FilterT{}
+	f.Optimize()
+	if f.OK() {
+		t.Error("optimized a filter not compiled")
+	}
+}
+
+func TestOptimizeEquivalent(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	probes := tableProbes(r)
+	var pkts []pktT
+	for i := 0; i < 1000; i++ {
+		pkt := pktT{src: probes[r.Intn(len(probes))], dst: probes[r.Intn(len(probes))], hasSrc: r.Intn(8) != 0, hasDst: r.Intn(8) != 0}
+		if r.Intn(8) != 0 {
+			pkt.proto, pkt.hasProto = []int{proto_tcp, proto_udp, proto_icmp}[r.Intn(3)], true
+		}
+		if pkt.proto != proto_icmp {
+			pkt.sport, pkt.dport, pkt.hasPorts = 78+r.Intn(5), 78+r.Intn(5), true
+		}
+		pkts = append(pkts, pkt)
+	}
+	smaller := 0
+	for n := 0; n < 500; n++ {
+		filter := redundantFilter(r, 5)
+		f, g := FilterT{}, FilterT{}
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(filter, err)
+		}
+		if err := g.Compile(filter); err != nil {
+			t.Fatal(filter, err)
+		}
+		g.Optimize()
+		if len(g.rpn) > len(f.rpn) {
+			t.Fatalf("Optimize(%q) = %q is larger", filter, g.GetFilter())
+		} else if len(g.rpn) < len(f.rpn) {
+			smaller++
+		}
+		for i := range pkts {
+			if f.eval(&pkts[i]) != g.eval(&pkts[i]) {
+				t.Fatalf("Optimize(%q) = %q, packet %+v: expect %v", filter, g.GetFilter(), pkts[i], f.eval(&pkts[i]))
+			}
+		}
+		for _, ip := range probes {
+			if f.check(ip) != g.check(ip) {
+				t.Fatalf("Optimize(%q) = %q, %s: expect %v", filter, g.GetFilter(), outputIP(ip), f.check(ip))
+			}
+		}
+	}
+	if smaller < 150 {
+		t.Errorf("expect most filters optimized, got %d of 500", smaller)
+	}
+}
+
+// redundantFilter returns a random filter of few distinct values, so they
+// often contain, complement or neighbour each other
+func redundantFilter(r *rand.Rand, depth int) string {
+	if depth == 0 || r.Intn(3) == 0 {
+		dir := []string{"", "src ", "dst "}[r.Intn(3)]
+		switch r.Intn(7) {
+		case 0, 1:
+			return fmt.Sprintf("%s10.%d.0.0/%d", dir, r.Intn(4)<<6, 8+r.Intn(3))
+		case 2:
+			return fmt.Sprintf("%s::%x:0:0/%d", dir, 0xfffe+r.Intn(2), 95+r.Intn(3))
+		case 3:
+			return fmt.Sprintf("%s2001:db8::/%d", dir, 31+r.Intn(3))
+		case 4:
+			return fmt.Sprintf("%sportrange 79-%d", dir, 79+r.Intn(3))
+		case 5:
+			return []string{"tcp", "udp", "ip proto 6", "ip6 proto 6"}[r.Intn(4)]
+		default:
+			return fmt.Sprintf("%s10.*.%d.*", dir, r.Intn(2)<<6)
+		}
+	}
+	switch r.Intn(4) {
+	case 0:
+		return "not (" + redundantFilter(r, depth-1) + ")"
+	case 1:
+		return "(" + redundantFilter(r, depth-1) + " and " + redundantFilter(r, depth-1) + ")"
+	}
+	return "(" + redundantFilter(r, depth-1) + " or " + redundantFilter(r, depth-1) + ")"
+}
@@ -0,0 +1,141 @@
+package filter
+
+import (
+	"encoding/binary"
+)
+
+const (
+	ether_header_len = 14
+	ether_type_ip4   = 0x0800
+	ether_type_ip6   = 0x86dd
+	ip4_header_len   = 20
+	ip6_header_len   = 40
+	ip4_offset_mask  = 0x1fff
+	tcp_header_len   = 20
+	udp_header_len   = 8
+	sctp_header_len  = 12
+)
+
+// CheckPacket reports whether the ethernet frame data matches the filter.
+// A truncated or malformed frame, or one not carrying ip, never matches.
+func (f *FilterT) CheckPacket(data []byte) bool {
+	return f.CheckPacketLen(data, len(data))
+}
+
+// CheckPacketLen reports whether the ethernet frame data, the first bytes
+// of a frame of length bytes as a capture snaplen truncates it, matches the
+// filter. Only the ip and transport headers are read, so a frame matches if
+// data holds them, a length shorter than data is taken as its length.
+func (f *FilterT) CheckPacketLen(data []byte, length int) bool {
+	pkt, ok := decodeEthernet(data, max(length-len(data), 0))
+	return ok && f.eval(&pkt)
+}
+
+// CheckIPPacket reports whether the raw ipv4 or ipv6 packet data matches the
+// filter. A truncated or malformed packet never matches.
+func (f *FilterT) CheckIPPacket(data []byte) bool {
+	return f.CheckIPPacketLen(data, len(data))
+}
+
+// CheckIPPacketLen reports whether the raw ipv4 or ipv6 packet data, the
+// first bytes of a packet of length bytes, matches the filter, as
+// CheckPacketLen does for a frame.
+func (f *FilterT) CheckIPPacketLen(data []byte, length int) bool {
+	pkt, ok := decodeIP(data, max(length-len(data), 0))
+	return ok && f.eval(&pkt)
+}
+
+// decodeEthernet decodes the frame data, missing is the number of bytes
+// truncated after it, and so are the decoders of the packets it carries
+func decodeEthernet(data []byte, missing int) (pktT, bool) {
+	if len(data) < ether_header_len {
+		return pktT{}, false
+	}
+	switch binary.BigEndian.Uint16(data[12:14]) {
+	case ether_type_ip4:
+		return decodeIP4(data[ether_header_len:], missing)
+	case ether_type_ip6:
+		return decodeIP6(data[ether_header_len:], missing)
+	}
+	return pktT{}, false
+}
+
+func decodeIP(data []byte, missing int) (pktT, bool) {
+	if len(data) == 0 {
+		return pktT{}, false
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return decodeIP4(data, missing)
+	case 6:
+		return decodeIP6(data, missing)
+	}
+	return pktT{}, false
+}
+
+func decodeIP4(data []byte, missing int) (pktT, bool) {
+	if len(data) < ip4_header_len || data[0]>>4 != 4 {
+		return pktT{}, false
+	}
+	headerLen := int(data[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+	if headerLen < ip4_header_len || headerLen > len(data) || totalLen < headerLen || totalLen > len(data)+missing {
+		return pktT{}, false
+	}
+	pkt := pktT{
+		src:    v4IP(int(binary.BigEndian.Uint32(data[12:16]))),
+		dst:    v4IP(int(binary.BigEndian.Uint32(data[16:20]))),
+		hasSrc: true,
+		hasDst: true,
+	}
+	first := binary.BigEndian.Uint16(data[6:8])&ip4_offset_mask == 0
+	ok := decodeTransport(&pkt, int(data[9]), data[headerLen:min(totalLen, len(data))], first)
+	return pkt, ok
+}
+
+// decodeIP6 takes the next header of the fixed header as the protocol,
+// extension headers are not followed
+func decodeIP6(data []byte, missing int) (pktT, bool) {
+	if len(data) < ip6_header_len || data[0]>>4 != 6 {
+		return pktT{}, false
+	}
+	totalLen := ip6_header_len + int(binary.BigEndian.Uint16(data[4:6]))
+	if totalLen > len(data)+missing {
+		return pktT{}, false
+	}
+	var src, dst [16]byte
+	copy(src[:], data[8:24])
+	copy(dst[:], data[24:40])
+	pkt := pktT{src: ipFrom16(src), dst: ipFrom16(dst), hasSrc: true, hasDst: true}
+	ok := decodeTransport(&pkt, int(data[6]), data[ip6_header_len:min(totalLen, len(data))], true)
+	return pkt, ok
+}
+
+// decodeTransport sets the protocol of pkt, and its ports if data is the
+// first fragment of a tcp, udp or sctp header
+func decodeTransport(pkt *pktT, proto int, data []byte, first bool) bool {
+	pkt.proto, pkt.hasProto = proto, true
+	if !first {
+		return true
+	}
+	switch proto {
+	case proto_tcp:
+		if len(data) < tcp_header_len {
+			return false
+		}
+	case proto_udp:
+		if len(data) < udp_header_len {
+			return false
+		}
+	case proto_sctp:
+		if len(data) < sctp_header_len {
+			return false
+		}
+	default:
+		return true
+	}
+	pkt.sport = int(binary.BigEndian.Uint16(data[0:2]))
+	pkt.dport = int(binary.BigEndian.Uint16(data[2:4]))
+	pkt.hasPorts = true
+	return true
+}
@@ -0,0 +1,149 @@
+package filter
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func TestCheckPacket(t *testing.T) {
+	f := FilterT{}
+	tcp4 := newEthernet(ether_type_ip4, newIP4Packet("10.0.0.1", "192.168.1.1", proto_tcp, newTransport(proto_tcp, 40000, 443)))
+	udp6 := newEthernet(ether_type_ip6, newIP6Packet("2001:db8::1", "fe80::1", proto_udp, newTransport(proto_udp, 53, 5353)))
+	icmp4 := newEthernet(ether_type_ip4, newIP4Packet("10.0.0.2", "10.0.0.3", proto_icmp, []byte{8, 0, 0, 0, 0, 0, 0, 0}))
+	fragment := newIP4Packet("10.0.0.1", "192.168.1.1", proto_tcp, []byte{1, 187, 1, 187})
+	binary.BigEndian.PutUint16(fragment[6:8], 100)
+	fragment = newEthernet(ether_type_ip4, fragment)
+	arp := newEthernet(0x0806, make([]byte, 28))
+
+	for filter, checks := range map[string][][]byte{
+		"src net 10 and dst 192.168.1.1 and tcp and dst port 443": {tcp4},
+		"2001:db8::/32 and udp and src port 53":                   {udp6},
+		"icmp and not port 0":                                     {icmp4},
+		"tcp and 10.0.0.1":                                        {tcp4, fragment},
+		"port 443":                                                {tcp4},
+		"not 1.2.3.4":                                             {tcp4, udp6, icmp4, fragment},
+	} {
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		expect := map[string]bool{}
+		for _, data := range checks {
+			expect[string(data)] = true
+		}
+		for name, data := range map[string][]byte{"tcp4": tcp4, "udp6": udp6, "icmp4": icmp4, "fragment": fragment, "arp": arp} {
+			if got := f.CheckPacket(data); got != expect[string(data)] {
+				t.Errorf("CheckPacket(%s): expect %v, got %v, filter %q", name, expect[string(data)], got, filter)
+			}
+			if name != "arp" {
+				if got := f.CheckIPPacket(data[ether_header_len:]); got != expect[string(data)] {
+					t.Errorf("CheckIPPacket(%s): expect %v, got %v, filter %q", name, expect[string(data)], got, filter)
+				}
+			}
+		}
+	}
+}
+
+func TestCheckMalformedPacket(t *testing.T) {
+	f := FilterT{}
+	if err := f.Compile("not 1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{
+		newEthernet(ether_type_ip4, newIP4Packet("10.0.0.1", "10.0.0.2", proto_tcp, newTransport(proto_tcp, 1, 2))),
+		newEthernet(ether_type_ip4, newIP4Packet("10.0.0.1", "10.0.0.2", proto_udp, newTransport(proto_udp, 1, 2))),
+		newEthernet(ether_type_ip6, newIP6Packet("::1", "::2", proto_tcp, newTransport(proto_tcp, 1, 2))),
+		newEthernet(ether_type_ip6, newIP6Packet("::1", "::2", proto_sctp, newTransport(proto_sctp, 1, 2))),
+	} {
+		if !f.CheckPacket(data) {
+			t.Fatalf("CheckPacket(%x): expect true", data)
+		}
+		for i := 0; i < len(data); i++ {
+			if f.CheckPacket(data[:i]) {
+				t.Errorf("CheckPacket(%x): a frame truncated to %d bytes matches", data, i)
+			}
+		}
+	}
+
+	// a snaplen keeps the headers of a frame only
+	long := newEthernet(ether_type_ip6, newIP6Packet("::1", "::2", proto_udp, append(newTransport(proto_udp, 1, 2), make([]byte, 100)...)))
+	for i := 0; i < len(long); i++ {
+		got := f.CheckPacketLen(long[:i], len(long))
+		if expect := i >= ether_header_len+ip6_header_len+udp_header_len; got != expect {
+			t.Errorf("CheckPacketLen of a frame snapped to %d bytes: expect %v, got %v", i, expect, got)
+		}
+		if f.CheckPacketLen(long[:i], i+1) != (i == len(long)-1) {
+			t.Errorf("CheckPacketLen of a frame of %d bytes snapped to %d: expect a match only of the whole datagram", i+1, i)
+		}
+	}
+	if !f.CheckIPPacketLen(long[ether_header_len:ether_header_len+50], len(long)-ether_header_len) {
+		t.Error("CheckIPPacketLen: expect a snapped packet to match")
+	}
+
+	ip4 := newIP4Packet("10.0.0.1", "10.0.0.2", proto_icmp, nil)
+	for _, corrupt := range []func([]byte){
+		func(b []byte) { b[0] = 0x65 },
+		func(b []byte) { b[0] = 0x44 },
+		func(b []byte) { b[0] = 0x46 },
+		func(b []byte) { binary.BigEndian.PutUint16(b[2:4], 19) },
+		func(b []byte) { binary.BigEndian.PutUint16(b[2:4], 21) },
+	} {
+		data := append([]byte(nil), ip4...)
+		corrupt(data)
+		if f.CheckIPPacket(data) {
+			t.Errorf("CheckIPPacket(%x): a malformed packet matches", data)
+		}
+	}
+	if f.CheckIPPacket(nil) {
+		t.Error("CheckIPPacket of an empty packet matches")
+	}
+}
+
+func newEthernet(etherType int, payload []byte) []byte {
+	data := make([]byte, ether_header_len, ether_header_len+len(payload))
+	copy(data[0:6], []byte{0, 1, 2, 3, 4, 5})
+	copy(data[6:12], []byte{0, 6, 7, 8, 9, 10})
+	binary.BigEndian.PutUint16(data[12:14], uint16(etherType))
+	return append(data, payload...)
+}
+
+func newIP4Packet(src, dst string, proto int, payload []byte) []byte {
+	data := make([]byte, ip4_header_len, ip4_header_len+len(payload))
+	data[0] = 0x45
+	binary.BigEndian.PutUint16(data[2:4], uint16(ip4_header_len+len(payload)))
+	data[8] = 64
+	data[9] = byte(proto)
+	srcIP, dstIP := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(data[12:16], srcIP[:])
+	copy(data[16:20], dstIP[:])
+	return append(data, payload...)
+}
+
+func newIP6Packet(src, dst string, proto int, payload []byte) []byte {
+	data := make([]byte, ip6_header_len, ip6_header_len+len(payload))
+	data[0] = 0x60
+	binary.BigEndian.PutUint16(data[4:6], uint16(len(payload)))
+	data[6] = byte(proto)
+	data[7] = 64
+	srcIP, dstIP := netip.MustParseAddr(src).As16(), netip.MustParseAddr(dst).As16()
+	copy(data[8:24], srcIP[:])
+	copy(data[24:40], dstIP[:])
+	return append(data, payload...)
+}
+
+func newTransport(proto, sport, dport int) []byte {
+	var data []byte
+	switch proto {
+	case proto_tcp:
+		data = make([]byte, tcp_header_len)
+		data[12] = 5 << 4
+	case proto_udp:
+		data = make([]byte, udp_header_len)
+		binary.BigEndian.PutUint16(data[4:6], udp_header_len)
+	case proto_sctp:
+		data = make([]byte, sctp_header_len)
+	}
+	binary.BigEndian.PutUint16(data[0:2], uint16(sport))
+	binary.BigEndian.PutUint16(data[2:4], uint16(dport))
+	return data
+}
@@ -0,0 +1,496 @@
+// Package pcap reads classic pcap and pcapng captures and writes classic
+// pcap captures, so captures can be replayed through a filter offline.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"time"
+
+	"github.com/GaoYusong/filter"
+)
+
+// link types of the packets, as registered for pcap and pcapng
+const (
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101
+	LinkTypeLinuxSLL = 113
+	LinkTypeIPv4     = 228
+	LinkTypeIPv6     = 229
+)
+
+const (
+	magic_micro       = 0xa1b2c3d4
+	magic_nano        = 0xa1b23c4d
+	header_len        = 24
+	record_len        = 16
+	version_major     = 2
+	version_minor     = 4
+	default_snaplen   = 262144
+	max_packet_len    = 16 << 20
+	ng_block_shb      = 0x0a0d0d0a
+	ng_block_idb      = 0x00000001
+	ng_block_opb      = 0x00000002
+	ng_block_spb      = 0x00000003
+	ng_block_epb      = 0x00000006
+	ng_byte_order     = 0x1a2b3c4d
+	ng_version_major  = 1
+	ng_opt_end        = 0
+	ng_opt_tsresol    = 9
+	resol_micro       = 6
+	resol_nano        = 9
+	sll_header_len    = 16
+	ether_type_ip4    = 0x0800
+	ether_type_ip6    = 0x86dd
+	ng_block_min_len  = 12
+	ng_shb_min_len    = 28
+	ng_idb_body_len   = 8
+	ng_epb_body_len   = 20
+	ng_spb_body_len   = 4
+	ng_resol_pow2_bit = 0x80
+	ng_resol_max_dec  = 19 // 10^19 is the last power of 10 in 64 bits
+)
+
+var (
+	ErrFormat    = errors.New("pcap: unknown capture format")
+	ErrMalformed = errors.New("pcap: malformed capture")
+	ErrLinkType  = errors.New("pcap: packet of another link type")
+)
+
+// PacketT is a captured packet, Data may be shorter than Length if the
+// packet was truncated by the capture snaplen.
+type PacketT struct {
+	Time     time.Time
+	LinkType int
+	Length   int
+	Data     []byte
+}
+
+// interfaceT is a pcapng interface, resol is the timestamp resolution,
+// 10^-resol seconds, or 2^-resol seconds if pow2
+type interfaceT struct {
+	linkType int
+	snaplen  int
+	resol    uint
+	pow2     bool
+}
+
+// ReaderT reads the packets of a classic pcap or a pcapng capture.
+type ReaderT struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	ng     bool
+	ifaces []interfaceT
+}
+
+// NewReader reads the header of the capture r, the format is detected by
+// its magic number.
+func NewReader(r io.Reader) (*ReaderT, error) {
+	reader := &ReaderT{r: r}
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, eofError(err)
+	}
+	if binary.BigEndian.Uint32(magic[:]) == ng_block_shb {
+		reader.ng = true
+		if err := reader.readSection(); err != nil {
+			return nil, err
+		}
+		// the first interface gives the link type of the capture
+		for len(reader.ifaces) == 0 {
+			t, body, err := reader.readBlock()
+			if err != nil {
+				return nil, eofError(err)
+			}
+			switch t {
+			case ng_block_idb:
+				if err := reader.readInterface(body); err != nil {
+					return nil, err
+				}
+			case ng_block_epb, ng_block_spb, ng_block_opb:
+				return nil, ErrMalformed
+			}
+		}
+		return reader, nil
+	}
+	return reader, reader.readHeader(magic)
+}
+
+// LinkType returns the link type of the capture, that is of its first
+// interface for pcapng.
+func (r *ReaderT) LinkType() int {
+	return r.ifaces[0].linkType
+}
+
+// Snaplen returns the snaplen of the capture, 0 if unlimited.
+func (r *ReaderT) Snaplen() int {
+	return r.ifaces[0].snaplen
+}
+
+// Next returns the next packet, or io.EOF at the end of the capture.
+func (r *ReaderT) Next() (PacketT, error) {
+	if !r.ng {
+		return r.readRecord()
+	}
+	for {
+		t, body, err := r.readBlock()
+		if err != nil {
+			return PacketT{}, err
+		}
+		switch t {
+		case ng_block_idb:
+			err = r.readInterface(body)
+		case ng_block_epb, ng_block_spb, ng_block_opb:
+			return r.readPacket(t, body)
+		}
+		if err != nil {
+			return PacketT{}, err
+		}
+	}
+}
+
+func (r *ReaderT) readHeader(magic [4]byte) error {
+	resol := uint(resol_micro)
+	switch {
+	case binary.LittleEndian.Uint32(magic[:]) == magic_micro:
+		r.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic[:]) == magic_micro:
+		r.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(magic[:]) == magic_nano:
+		r.order, resol = binary.LittleEndian, resol_nano
+	case binary.BigEndian.Uint32(magic[:]) == magic_nano:
+		r.order, resol = binary.BigEndian, resol_nano
+	default:
+		return ErrFormat
+	}
+	var header [header_len - 4]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return eofError(err)
+	}
+	r.ifaces = []interfaceT{{
+		linkType: int(r.order.Uint32(header[16:20]) & 0xffff),
+		snaplen:  int(r.order.Uint32(header[12:16])),
+		resol:    resol,
+	}}
+	return nil
+}
+
+func (r *ReaderT) readRecord() (PacketT, error) {
+	var record [record_len]byte
+	if _, err := io.ReadFull(r.r, record[:]); err != nil {
+		if err == io.EOF {
+			return PacketT{}, io.EOF
+		}
+		return PacketT{}, eofError(err)
+	}
+	capLen := r.order.Uint32(record[8:12])
+	if capLen > max_packet_len {
+		return PacketT{}, ErrMalformed
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return PacketT{}, eofError(err)
+	}
+	iface := r.ifaces[0]
+	frac := uint64(r.order.Uint32(record[4:8]))
+	if iface.resol == resol_micro {
+		frac *= uint64(time.Microsecond)
+	}
+	return PacketT{
+		Time:     time.Unix(int64(r.order.Uint32(record[0:4])), int64(frac)),
+		LinkType: iface.linkType,
+		Length:   int(r.order.Uint32(record[12:16])),
+		Data:     data,
+	}, nil
+}
+
+// readBlock reads a pcapng block, a section header block switches the byte
+// order before its length is decoded
+func (r *ReaderT) readBlock() (uint32, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r.r, header[0:4]); err != nil {
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, eofError(err)
+	}
+	if binary.BigEndian.Uint32(header[0:4]) == ng_block_shb {
+		return ng_block_shb, nil, r.readSection()
+	}
+	if _, err := io.ReadFull(r.r, header[4:8]); err != nil {
+		return 0, nil, eofError(err)
+	}
+	t := r.order.Uint32(header[0:4])
+	body, err := r.readBody(r.order.Uint32(header[4:8]))
+	return t, body, err
+}
+
+// readBody reads the body of a block of length blockLen and its trailing
+// length
+func (r *ReaderT) readBody(blockLen uint32) ([]byte, error) {
+	if blockLen < ng_block_min_len || blockLen%4 != 0 || blockLen > max_packet_len {
+		return nil, ErrMalformed
+	}
+	body := make([]byte, blockLen-ng_block_min_len+4)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return nil, eofError(err)
+	}
+	if r.order.Uint32(body[len(body)-4:]) != blockLen {
+		return nil, ErrMalformed
+	}
+	return body[:len(body)-4], nil
+}
+
+// readSection reads a section header block after its type, the byte order
+// magic sets the byte order of the section. The interfaces are reset.
+func (r *ReaderT) readSection() error {
+	var header [8]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return eofError(err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(header[4:8]) == ng_byte_order:
+		r.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header[4:8]) == ng_byte_order:
+		r.order = binary.BigEndian
+	default:
+		return ErrFormat
+	}
+	blockLen := r.order.Uint32(header[0:4])
+	if blockLen < ng_shb_min_len || blockLen%4 != 0 || blockLen > max_packet_len {
+		return ErrMalformed
+	}
+	// version, section length, options and the trailing length
+	body := make([]byte, blockLen-ng_block_min_len)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return eofError(err)
+	}
+	if r.order.Uint32(body[len(body)-4:]) != blockLen {
+		return ErrMalformed
+	}
+	if r.order.Uint16(body[0:2]) != ng_version_major {
+		return ErrFormat
+	}
+	r.ifaces = nil
+	return nil
+}
+
+func (r *ReaderT) readInterface(body []byte) error {
+	if len(body) < ng_idb_body_len {
+		return ErrMalformed
+	}
+	iface := interfaceT{
+		linkType: int(r.order.Uint16(body[0:2])),
+		snaplen:  int(r.order.Uint32(body[4:8])),
+		resol:    resol_micro,
+	}
+	options := body[ng_idb_body_len:]
+	for len(options) >= 4 {
+		code, optLen := r.order.Uint16(options[0:2]), int(r.order.Uint16(options[2:4]))
+		if code == ng_opt_end {
+			break
+		}
+		padded := (optLen + 3) &^ 3
+		if 4+padded > len(options) {
+			return ErrMalformed
+		}
+		if code == ng_opt_tsresol && optLen == 1 {
+			resol := options[4]
+			iface.pow2 = resol&ng_resol_pow2_bit != 0
+			iface.resol = uint(resol &^ ng_resol_pow2_bit)
+			if !iface.pow2 && iface.resol > ng_resol_max_dec {
+				return ErrMalformed
+			}
+		}
+		options = options[4+padded:]
+	}
+	r.ifaces = append(r.ifaces, iface)
+	return nil
+}
+
+func (r *ReaderT) readPacket(t uint32, body []byte) (PacketT, error) {
+	var ifIndex, capLen, length int
+	var ts uint64
+	var data []byte
+	switch t {
+	case ng_block_epb, ng_block_opb:
+		// an obsolete packet block has a 16 bit interface id and a drops count
+		// instead of the 32 bit interface id, and is as long
+		if len(body) < ng_epb_body_len {
+			return PacketT{}, ErrMalformed
+		}
+		if t == ng_block_epb {
+			ifIndex = int(r.order.Uint32(body[0:4]))
+		} else {
+			ifIndex = int(r.order.Uint16(body[0:2]))
+		}
+		ts = uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+		capLen = int(r.order.Uint32(body[12:16]))
+		length = int(r.order.Uint32(body[16:20]))
+		data = body[ng_epb_body_len:]
+	case ng_block_spb:
+		if len(body) < ng_spb_body_len || len(r.ifaces) == 0 {
+			return PacketT{}, ErrMalformed
+		}
+		length = int(r.order.Uint32(body[0:4]))
+		data = body[ng_spb_body_len:]
+		capLen = length
+		if snaplen := r.ifaces[0].snaplen; snaplen != 0 && capLen > snaplen {
+			capLen = snaplen
+		}
+		if capLen > len(data) {
+			capLen = len(data)
+		}
+	}
+	if ifIndex >= len(r.ifaces) || capLen > len(data) {
+		return PacketT{}, ErrMalformed
+	}
+	iface := r.ifaces[ifIndex]
+	return PacketT{
+		Time:     iface.time(ts),
+		LinkType: iface.linkType,
+		Length:   length,
+		Data:     data[:capLen:capLen],
+	}, nil
+}
+
+// time converts a timestamp in the resolution of iface
+func (iface interfaceT) time(ts uint64) time.Time {
+	if iface.pow2 {
+		if iface.resol >= 64 {
+			return time.Unix(0, 0)
+		}
+		frac := ts & (1<<iface.resol - 1)
+		hi, lo := bits.Mul64(frac, uint64(time.Second))
+		nsec := lo >> iface.resol
+		if iface.resol > 0 {
+			nsec |= hi << (64 - iface.resol)
+		}
+		return time.Unix(int64(ts>>iface.resol), int64(nsec))
+	}
+	unit := uint64(1)
+	for i := uint(0); i < iface.resol; i++ {
+		unit *= 10
+	}
+	sec, frac := ts/unit, ts%unit
+	if iface.resol <= 9 {
+		frac *= uint64(time.Second) / unit
+	} else {
+		frac /= unit / uint64(time.Second)
+	}
+	return time.Unix(int64(sec), int64(frac))
+}
+
+// WriterT writes a classic pcap capture with microsecond timestamps.
+type WriterT struct {
+	w        io.Writer
+	linkType int
+	snaplen  int
+}
+
+// NewWriter writes the header of a capture of packets of linkType, a
+// snaplen of 0 stands for the default 262144.
+func NewWriter(w io.Writer, linkType, snaplen int) (*WriterT, error) {
+	if snaplen <= 0 {
+		snaplen = default_snaplen
+	}
+	var header [header_len]byte
+	binary.LittleEndian.PutUint32(header[0:4], magic_micro)
+	binary.LittleEndian.PutUint16(header[4:6], version_major)
+	binary.LittleEndian.PutUint16(header[6:8], version_minor)
+	binary.LittleEndian.PutUint32(header[16:20], uint32(snaplen))
+	binary.LittleEndian.PutUint32(header[20:24], uint32(linkType))
+	if _, err := w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	return &WriterT{w: w, linkType: linkType, snaplen: snaplen}, nil
+}
+
+// Write writes pkt, which must be of the link type of the capture, its data
+// is truncated to the snaplen.
+func (w *WriterT) Write(pkt PacketT) error {
+	if pkt.LinkType != w.linkType {
+		return ErrLinkType
+	}
+	data := pkt.Data
+	if len(data) > w.snaplen {
+		data = data[:w.snaplen]
+	}
+	length := pkt.Length
+	if length < len(data) {
+		length = len(data)
+	}
+	var record [record_len]byte
+	binary.LittleEndian.PutUint32(record[0:4], uint32(pkt.Time.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(pkt.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(length))
+	if _, err := w.w.Write(record[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(data)
+	return err
+}
+
+// Check reports whether pkt matches f, packets of a link type other than
+// ethernet, linux cooked or raw ip never match. A packet truncated by the
+// snaplen matches if its headers are captured, Length is its length.
+func Check(f *filter.FilterT, pkt PacketT) bool {
+	switch pkt.LinkType {
+	case LinkTypeEthernet:
+		return f.CheckPacketLen(pkt.Data, pkt.Length)
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		return f.CheckIPPacketLen(pkt.Data, pkt.Length)
+	case LinkTypeLinuxSLL:
+		if len(pkt.Data) < sll_header_len {
+			return false
+		}
+		switch binary.BigEndian.Uint16(pkt.Data[14:16]) {
+		case ether_type_ip4, ether_type_ip6:
+			return f.CheckIPPacketLen(pkt.Data[sll_header_len:], pkt.Length-sll_header_len)
+		}
+	}
+	return false
+}
+
+// Filter copies the packets of the capture r that match f to a new classic
+// pcap capture w, as tcpdump -r r -w w does, and returns the number of
+// packets read and copied. The link type of w is the one of r, that is of
+// its first interface for pcapng, and the packets of the other interfaces
+// of another link type are skipped.
+func Filter(w io.Writer, r io.Reader, f *filter.FilterT) (int, int, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	writer, err := NewWriter(w, reader.LinkType(), reader.Snaplen())
+	if err != nil {
+		return 0, 0, err
+	}
+	total, matched := 0, 0
+	for {
+		pkt, err := reader.Next()
+		if err == io.EOF {
+			return total, matched, nil
+		} else if err != nil {
+			return total, matched, err
+		}
+		total++
+		if pkt.LinkType == writer.linkType && Check(f, pkt) {
+			if err := writer.Write(pkt); err != nil {
+				return total, matched, err
+			}
+			matched++
+		}
+	}
+}
+
+// eofError turns an unexpected end of the capture into ErrMalformed
+func eofError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrMalformed
+	}
+	return err
+}
@@ -0,0 +1,423 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/GaoYusong/filter"
+)
+
+func TestWriteRead(t *testing.T) {
+	packets := []PacketT{
+		{Time: time.Unix(1600000000, 123456000), LinkType: LinkTypeEthernet, Length: 60, Data: ethernet(ip4("10.0.0.1", "10.0.0.2", 6, 1234, 443))},
+		{Time: time.Unix(1600000001, 0), LinkType: LinkTypeEthernet, Length: 1500, Data: []byte{1, 2, 3}},
+	}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, LinkTypeEthernet, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range packets {
+		if err := w.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Write(PacketT{LinkType: LinkTypeRaw}); err != ErrLinkType {
+		t.Errorf("Write of another link type: expect %v, got %v", ErrLinkType, err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != LinkTypeEthernet || r.Snaplen() != default_snaplen {
+		t.Errorf("NewReader: got link type %d, snaplen %d", r.LinkType(), r.Snaplen())
+	}
+	for _, expect := range packets {
+		pkt, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		comparePacket(t, pkt, expect)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next at the end: expect io.EOF, got %v", err)
+	}
+}
+
+func TestReadClassic(t *testing.T) {
+	data := ethernet(ip4("10.0.0.1", "10.0.0.2", 17, 53, 53))
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for magic, nsec := range map[uint32]uint32{magic_micro: 5, magic_nano: 5000} {
+			var buf bytes.Buffer
+			header := make([]byte, header_len)
+			order.PutUint32(header[0:4], magic)
+			order.PutUint32(header[16:20], 96)
+			order.PutUint32(header[20:24], LinkTypeEthernet)
+			buf.Write(header)
+			record := make([]byte, record_len)
+			order.PutUint32(record[0:4], 10)
+			order.PutUint32(record[4:8], nsec)
+			order.PutUint32(record[8:12], uint32(len(data)))
+			order.PutUint32(record[12:16], 100)
+			buf.Write(record)
+			buf.Write(data)
+
+			r, err := NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pkt, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			comparePacket(t, pkt, PacketT{Time: time.Unix(10, 5000), LinkType: LinkTypeEthernet, Length: 100, Data: data})
+			if r.Snaplen() != 96 {
+				t.Errorf("Snaplen: expect 96, got %d", r.Snaplen())
+			}
+		}
+	}
+}
+
+func TestReadNG(t *testing.T) {
+	data := ethernet(ip4("10.0.0.1", "10.0.0.2", 6, 1234, 443))
+	raw := ip4("10.0.0.3", "10.0.0.4", 17, 53, 53)
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		b := ngBuilder{order: order}
+		b.section()
+		b.iface(LinkTypeEthernet, 0, nil)
+		b.iface(LinkTypeRaw, 0, []byte{ng_resol_pow2_bit | 1})
+		b.iface(LinkTypeEthernet, 0, []byte{9})
+		b.iface(LinkTypeEthernet, 0, []byte{19})
+		b.packet(0, 1600000000123456, data, 200)
+		b.block(5, make([]byte, 8)) // interface statistics, skipped
+		b.packet(1, 21, raw, len(raw))
+		b.packet(2, 3000000001, data, len(data))
+		b.packet(3, 15000000000000000000, data, len(data))
+		b.simple(data, len(data))
+		opb := make([]byte, ng_epb_body_len)
+		order.PutUint16(opb[0:2], 0)
+		order.PutUint32(opb[4:8], 0)
+		order.PutUint32(opb[8:12], 7)
+		order.PutUint32(opb[12:16], uint32(len(data)))
+		order.PutUint32(opb[16:20], uint32(len(data)))
+		b.block(ng_block_opb, append(opb, data...))
+		// a new section resets the interfaces
+		b.section()
+		b.iface(LinkTypeRaw, 16, nil)
+		b.simple(raw, len(raw))
+
+		r, err := NewReader(bytes.NewReader(b.buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.LinkType() != LinkTypeEthernet {
+			t.Errorf("LinkType: expect %d, got %d", LinkTypeEthernet, r.LinkType())
+		}
+		for _, expect := range []PacketT{
+			{Time: time.Unix(1600000000, 123456000), LinkType: LinkTypeEthernet, Length: 200, Data: data},
+			{Time: time.Unix(10, 500000000), LinkType: LinkTypeRaw, Length: len(raw), Data: raw},
+			{Time: time.Unix(3, 1), LinkType: LinkTypeEthernet, Length: len(data), Data: data},
+			{Time: time.Unix(1, 500000000), LinkType: LinkTypeEthernet, Length: len(data), Data: data},
+			{Time: time.Unix(0, 0), LinkType: LinkTypeEthernet, Length: len(data), Data: data},
+			{Time: time.Unix(0, 7000), LinkType: LinkTypeEthernet, Length: len(data), Data: data},
+			{Time: time.Unix(0, 0), LinkType: LinkTypeRaw, Length: len(raw), Data: raw[:16]},
+		} {
+			pkt, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			comparePacket(t, pkt, expect)
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Errorf("Next at the end: expect io.EOF, got %v", err)
+		}
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("not a capture file"))); err != ErrFormat {
+		t.Errorf("NewReader of garbage: expect %v, got %v", ErrFormat, err)
+	}
+
+	b := ngBuilder{order: binary.LittleEndian}
+	b.section()
+	b.iface(LinkTypeEthernet, 0, nil)
+	b.packet(0, 1, ethernet(ip4("10.0.0.1", "10.0.0.2", 6, 1, 2)), 60)
+	ng := b.buf.Bytes()
+
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, LinkTypeEthernet, 0)
+	w.Write(PacketT{LinkType: LinkTypeEthernet, Data: []byte{1, 2, 3, 4}})
+	classic := buf.Bytes()
+
+	// a capture truncated after its header is a valid empty capture
+	for name, capture := range map[string][]byte{"pcapng": ng, "pcap": classic} {
+		headerLen := header_len
+		if name == "pcapng" {
+			headerLen = 48
+		}
+		for i := 1; i < len(capture); i++ {
+			r, err := NewReader(bytes.NewReader(capture[:i]))
+			if err == nil {
+				_, err = r.Next()
+			}
+			if err == nil || (err == io.EOF && i != headerLen) {
+				t.Errorf("%s truncated to %d bytes: expect an error, got %v", name, i, err)
+			}
+		}
+	}
+
+	b = ngBuilder{order: binary.LittleEndian}
+	b.section()
+	b.packet(0, 1, []byte{1}, 1)
+	if _, err := NewReader(bytes.NewReader(b.buf.Bytes())); err != ErrMalformed {
+		t.Errorf("pcapng packet before an interface: expect %v, got %v", ErrMalformed, err)
+	}
+
+	// a decimal resolution past 10^-19 seconds does not fit in 64 bits
+	for _, resol := range []byte{20, 64, 127} {
+		b = ngBuilder{order: binary.LittleEndian}
+		b.section()
+		b.iface(LinkTypeEthernet, 0, nil)
+		b.iface(LinkTypeEthernet, 0, []byte{resol})
+		b.packet(1, 1, []byte{1}, 1)
+		r, err := NewReader(bytes.NewReader(b.buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Next(); err != ErrMalformed {
+			t.Errorf("pcapng resolution 10^-%d: expect %v, got %v", resol, ErrMalformed, err)
+		}
+	}
+
+	b = ngBuilder{order: binary.LittleEndian}
+	b.section()
+	b.iface(LinkTypeEthernet, 0, nil)
+	b.packet(3, 1, []byte{1}, 1)
+	r, err := NewReader(bytes.NewReader(b.buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err != ErrMalformed {
+		t.Errorf("pcapng packet of an unknown interface: expect %v, got %v", ErrMalformed, err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := filter.FilterT{}
+	if err := f.Compile("tcp and dst port 443"); err != nil {
+		t.Fatal(err)
+	}
+	https := ethernet(ip4("10.0.0.1", "10.0.0.2", 6, 1234, 443))
+	b := ngBuilder{order: binary.LittleEndian}
+	b.section()
+	b.iface(LinkTypeEthernet, 0, nil)
+	b.packet(0, 1000000, https, len(https))
+	b.packet(0, 2000000, ethernet(ip4("10.0.0.1", "10.0.0.2", 17, 1234, 443)), 60)
+	b.packet(0, 3000000, ethernet(ip4("10.0.0.1", "10.0.0.2", 6, 1234, 80)), 60)
+	b.packet(0, 4000000, https[:30], len(https))
+
+	var out bytes.Buffer
+	total, matched, err := Filter(&out, bytes.NewReader(b.buf.Bytes()), &f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 || matched != 1 {
+		t.Errorf("Filter: expect 4 packets read, 1 copied, got %d, %d", total, matched)
+	}
+	r, err := NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePacket(t, pkt, PacketT{Time: time.Unix(1, 0), LinkType: LinkTypeEthernet, Length: len(https), Data: https})
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next at the end: expect io.EOF, got %v", err)
+	}
+
+	// the packets of an interface of another link type are skipped
+	b = ngBuilder{order: binary.LittleEndian}
+	b.section()
+	b.iface(LinkTypeEthernet, 0, nil)
+	b.iface(LinkTypeRaw, 0, nil)
+	b.packet(1, 1000000, https[14:], len(https)-14)
+	b.packet(0, 2000000, https, len(https))
+	out.Reset()
+	total, matched, err = Filter(&out, bytes.NewReader(b.buf.Bytes()), &f)
+	if err != nil || total != 2 || matched != 1 {
+		t.Errorf("Filter of two link types: expect 2 packets read, 1 copied, got %d, %d, %v", total, matched, err)
+	}
+	if r, err := NewReader(&out); err != nil {
+		t.Fatal(err)
+	} else if pkt, err := r.Next(); err != nil || pkt.LinkType != LinkTypeEthernet || pkt.Time != time.Unix(2, 0) {
+		t.Errorf("Filter of two link types: unexpected packet %+v, %v", pkt, err)
+	}
+
+	if _, _, err := Filter(&out, bytes.NewReader(nil), &f); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Filter of an empty capture: expect %v, got %v", ErrMalformed, err)
+	}
+}
+
+func TestFilterSnaplen(t *testing.T) {
+	f := filter.FilterT{}
+	if err := f.Compile("10.0.0.1 and port 443"); err != nil {
+		t.Fatal(err)
+	}
+	// a 1048 bytes datagram captured with a snaplen of 96
+	datagram := append(ip4("10.0.0.1", "10.0.0.2", 6, 1234, 443), make([]byte, 1008)...)
+	binary.BigEndian.PutUint16(datagram[2:4], uint16(len(datagram)))
+	frame := ethernet(datagram)
+	if !f.CheckPacket(frame) {
+		t.Fatal("expect the whole frame to match")
+	}
+	var in bytes.Buffer
+	w, err := NewWriter(&in, LinkTypeEthernet, 96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range []PacketT{
+		{Time: time.Unix(1, 0), LinkType: LinkTypeEthernet, Length: len(frame), Data: frame},
+		{Time: time.Unix(2, 0), LinkType: LinkTypeEthernet, Length: len(frame), Data: frame[:40]},
+		{Time: time.Unix(3, 0), LinkType: LinkTypeEthernet, Length: 90, Data: frame},
+	} {
+		if err := w.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	total, matched, err := Filter(&out, &in, &f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ip header is cut by the second snap, and the third frame is
+	// shorter than its datagram
+	if total != 3 || matched != 1 {
+		t.Errorf("Filter: expect 3 packets read, 1 copied, got %d, %d", total, matched)
+	}
+
+	raw := datagram[:60]
+	if !Check(&f, PacketT{LinkType: LinkTypeRaw, Length: len(datagram), Data: raw}) || Check(&f, PacketT{LinkType: LinkTypeRaw, Data: raw}) {
+		t.Error("Check: expect a truncated raw packet to match only with its length")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	f := filter.FilterT{}
+	if err := f.Compile("udp and 10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	raw := ip4("10.0.0.3", "10.0.0.4", 17, 53, 53)
+	sll := append(make([]byte, sll_header_len), raw...)
+	binary.BigEndian.PutUint16(sll[14:16], ether_type_ip4)
+	for pkt, expect := range map[*PacketT]bool{
+		{LinkType: LinkTypeEthernet, Data: ethernet(raw)}: true,
+		{LinkType: LinkTypeRaw, Data: raw}:                true,
+		{LinkType: LinkTypeIPv4, Data: raw}:               true,
+		{LinkType: LinkTypeLinuxSLL, Data: sll}:           true,
+		{LinkType: LinkTypeLinuxSLL, Data: sll[:10]}:      false,
+		{LinkType: 105, Data: raw}:                        false,
+	} {
+		if got := Check(&f, *pkt); got != expect {
+			t.Errorf("Check(link type %d): expect %v, got %v", pkt.LinkType, expect, got)
+		}
+	}
+}
+
+func comparePacket(t *testing.T, got, expect PacketT) {
+	t.Helper()
+	if !got.Time.Equal(expect.Time) || got.LinkType != expect.LinkType || got.Length != expect.Length ||
+		!bytes.Equal(got.Data, expect.Data) {
+		t.Errorf("expect packet %v %d %d %x, got %v %d %d %x", expect.Time, expect.LinkType, expect.Length, expect.Data,
+			got.Time, got.LinkType, got.Length, got.Data)
+	}
+}
+
+// ngBuilder builds a pcapng capture
+type ngBuilder struct {
+	order binary.ByteOrder
+	buf   bytes.Buffer
+}
+
+func (b *ngBuilder) block(t uint32, body []byte) {
+	padded := make([]byte, (len(body)+3)&^3)
+	copy(padded, body)
+	header := make([]byte, 8)
+	b.order.PutUint32(header[0:4], t)
+	b.order.PutUint32(header[4:8], uint32(len(padded)+ng_block_min_len))
+	b.buf.Write(header)
+	b.buf.Write(padded)
+	b.buf.Write(header[4:8])
+}
+
+func (b *ngBuilder) section() {
+	body := make([]byte, 16)
+	b.order.PutUint32(body[0:4], ng_byte_order)
+	b.order.PutUint16(body[4:6], ng_version_major)
+	binary.LittleEndian.PutUint64(body[8:16], ^uint64(0))
+	b.block(ng_block_shb, body)
+}
+
+func (b *ngBuilder) iface(linkType, snaplen int, tsresol []byte) {
+	body := make([]byte, ng_idb_body_len)
+	b.order.PutUint16(body[0:2], uint16(linkType))
+	b.order.PutUint32(body[4:8], uint32(snaplen))
+	if tsresol != nil {
+		option := make([]byte, 8)
+		b.order.PutUint16(option[0:2], ng_opt_tsresol)
+		b.order.PutUint16(option[2:4], uint16(len(tsresol)))
+		copy(option[4:], tsresol)
+		body = append(body, option...)
+		body = append(body, 0, 0, 0, 0)
+	}
+	b.block(ng_block_idb, body)
+}
+
+func (b *ngBuilder) packet(iface int, ts uint64, data []byte, length int) {
+	body := make([]byte, ng_epb_body_len)
+	b.order.PutUint32(body[0:4], uint32(iface))
+	b.order.PutUint32(body[4:8], uint32(ts>>32))
+	b.order.PutUint32(body[8:12], uint32(ts))
+	b.order.PutUint32(body[12:16], uint32(len(data)))
+	b.order.PutUint32(body[16:20], uint32(length))
+	b.block(ng_block_epb, append(body, data...))
+}
+
+func (b *ngBuilder) simple(data []byte, length int) {
+	body := make([]byte, ng_spb_body_len)
+	b.order.PutUint32(body[0:4], uint32(length))
+	b.block(ng_block_spb, append(body, data...))
+}
+
+func ethernet(payload []byte) []byte {
+	data := make([]byte, 14)
+	binary.BigEndian.PutUint16(data[12:14], ether_type_ip4)
+	return append(data, payload...)
+}
+
+// ip4 builds an ipv4 packet with a tcp or udp header
+func ip4(src, dst string, proto, sport, dport int) []byte {
+	transportLen := 8
+	if proto == 6 {
+		transportLen = 20
+	}
+	data := make([]byte, 20+transportLen)
+	data[0] = 0x45
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	data[8] = 64
+	data[9] = byte(proto)
+	srcIP, dstIP := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(data[12:16], srcIP[:])
+	copy(data[16:20], dstIP[:])
+	binary.BigEndian.PutUint16(data[20:22], uint16(sport))
+	binary.BigEndian.PutUint16(data[22:24], uint16(dport))
+	return data
+}
@@ -0,0 +1,204 @@
+package filter
+
+import (
+	"errors"
+	"math/bits"
+	"net/netip"
+)
+
+// ErrNotPrefix is the error of a filter with masks which are not prefix
+// masks and whose hosts are more than 65536 ranges in all, as
+// 2001:db8::1 mask ffff:ffff::ffff is, the hosts of a mask as 10.*.3.* are
+// 256 ranges.
+var ErrNotPrefix = errors.New("filter has masks which are not prefix masks, of too many ranges")
+
+// AddrRange is an inclusive range of addresses of one family.
+type AddrRange struct {
+	First netip.Addr
+	Last  netip.Addr
+}
+
+// Ranges returns the sorted, disjoint and non-adjacent ranges of the hosts
+// Check, CheckHost and CheckAddr match, the ipv4 ranges before the ipv6
+// ones. An ipv6 range which would end and start again around
+// ::ffff:0:0/96 covers it, as those hosts are the ipv4 hosts.
+func (f *FilterT) Ranges() ([]AddrRange, error) {
+	v4, v6, err := f.familyRanges()
+	if err != nil {
+		return nil, err
+	}
+	var ranges []AddrRange
+	for _, r := range append(v4, v6...) {
+		ranges = append(ranges, AddrRange{First: HostT{ip: r.lo}.Addr(), Last: HostT{ip: r.hi}.Addr()})
+	}
+	return ranges, nil
+}
+
+// CIDRs returns the fewest disjoint prefixes of the hosts Check, CheckHost
+// and CheckAddr match, sorted, the ipv4 prefixes before the ipv6 ones. An
+// ipv6 prefix covers ::ffff:0:0/96 if that makes them fewer, as
+// "10 and not 10.1" is 10.0.0.0/16 and seven more and "::/0" is ::/0.
+func (f *FilterT) CIDRs() ([]netip.Prefix, error) {
+	v4, v6, err := f.familyRanges()
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []netip.Prefix
+	for _, r := range v4 {
+		for _, cidr := range rangeCidrs(r) {
+			prefixes = append(prefixes, cidr.prefix())
+		}
+	}
+	var plain, covering []cidrT
+	for _, r := range v6 {
+		plain = append(plain, rangeCidrs(r)...)
+	}
+	for _, r := range unionRanges(append([]rangeT{v4_mapped}, v6...)) {
+		for _, cidr := range rangeCidrs(r) {
+			if !cidr.ip.isV4() || !isV4Mask(cidr.mask) {
+				covering = append(covering, cidr)
+			}
+		}
+	}
+	if len(covering) < len(plain) {
+		plain = covering
+	}
+	for _, cidr := range plain {
+		prefixes = append(prefixes, cidr.prefix())
+	}
+	return prefixes, nil
+}
+
+// familyRanges splits the hosts of the filter into the v4-mapped ranges
+// and the others, which are joined across ::ffff:0:0/96
+func (f *FilterT) familyRanges() ([]rangeT, []rangeT, error) {
+	table, err := f.hosts()
+	if err != nil {
+		return nil, nil, err
+	}
+	v4 := intersectRanges(table.ranges, []rangeT{v4_mapped})
+	var v6 []rangeT
+	for _, r := range intersectRanges(table.ranges, complementRanges([]rangeT{v4_mapped})) {
+		if last := len(v6) - 1; last >= 0 && v6[last].hi == v4_mapped.lo.prev() && r.lo == v4_mapped.hi.next() {
+			v6[last].hi = r.hi
+		} else {
+			v6 = append(v6, r)
+		}
+	}
+	return v4, v6, nil
+}
+
+// hosts returns the table of the hosts the filter matches
+func (f *FilterT) hosts() (*tableT, error) {
+	if !f.OK() {
+		return nil, ErrNotCompiled
+	} else if f.table != nil {
+		return f.table, nil
+	}
+	table, ok := newTable(f.rpn)
+	if !ok {
+		return nil, ErrNotPrefix
+	}
+	return table, nil
+}
+
+// Equivalent reports whether f and g match the same hosts, as CheckAddr
+// matches them. If not, it returns a host one of them matches and the other
+// does not.
+func (f *FilterT) Equivalent(g *FilterT) (bool, netip.Addr, error) {
+	a, b, err := hostsOf(f, g)
+	if err != nil {
+		return false, netip.Addr{}, err
+	}
+	diff := unionRanges(append(intersectRanges(a, complementRanges(b)), intersectRanges(b, complementRanges(a))...))
+	return len(diff) == 0, firstAddr(diff), nil
+}
+
+// Subset reports whether g matches every host f matches. If not, it returns
+// a host f matches and g does not.
+func (f *FilterT) Subset(g *FilterT) (bool, netip.Addr, error) {
+	a, b, err := hostsOf(f, g)
+	if err != nil {
+		return false, netip.Addr{}, err
+	}
+	diff := intersectRanges(a, complementRanges(b))
+	return len(diff) == 0, firstAddr(diff), nil
+}
+
+// Intersects reports whether f and g match a host in common, and returns
+// one if they do.
+func (f *FilterT) Intersects(g *FilterT) (bool, netip.Addr, error) {
+	a, b, err := hostsOf(f, g)
+	if err != nil {
+		return false, netip.Addr{}, err
+	}
+	common := intersectRanges(a, b)
+	return len(common) != 0, firstAddr(common), nil
+}
+
+func hostsOf(f, g *FilterT) ([]rangeT, []rangeT, error) {
+	a, err := f.hosts()
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := g.hosts()
+	if err != nil {
+		return nil, nil, err
+	}
+	return a.ranges, b.ranges, nil
+}
+
+// firstAddr returns the first host of ranges, the ipv4 hosts first, or the
+// invalid addr if there is none
+func firstAddr(ranges []rangeT) netip.Addr {
+	if v4 := intersectRanges(ranges, []rangeT{v4_mapped}); len(v4) != 0 {
+		return HostT{ip: v4[0].lo}.Addr()
+	} else if len(ranges) != 0 {
+		return HostT{ip: ranges[0].lo}.Addr()
+	}
+	return netip.Addr{}
+}
+
+// rangeCidrs returns the fewest cidrs of r, each the largest aligned block
+// left at its start
+func rangeCidrs(r rangeT) []cidrT {
+	var cidrs []cidrT
+	for lo := r.lo; ; {
+		n := 128 - trailingZeros(lo)
+		for ; n < 128 && r.hi.less(lo.or(hostMask(n))); n++ {
+		}
+		hi := lo.or(hostMask(n))
+		cidrs = append(cidrs, cidrT{ip: lo, mask: maskOf(n)})
+		if hi == r.hi {
+			return cidrs
+		}
+		lo = hi.next()
+	}
+}
+
+// cidrsOf returns the fewest prefixes of the hosts of a range, or cidr
+// itself if it is not one
+func cidrsOf(cidr cidrT) []cidrT {
+	if !cidr.isRange {
+		return []cidrT{cidr}
+	}
+	ranges, _ := cidrRanges(cidr, nil)
+	var cidrs []cidrT
+	for _, r := range ranges {
+		cidrs = append(cidrs, rangeCidrs(r)...)
+	}
+	return cidrs
+}
+
+// hostMask returns the host bits of a prefix of n bits
+func hostMask(n int) ipT {
+	mask := maskOf(n)
+	return ipT{hi: ^mask.hi, lo: ^mask.lo}
+}
+
+func trailingZeros(ip ipT) int {
+	if ip.lo != 0 {
+		return bits.TrailingZeros64(ip.lo)
+	}
+	return 64 + bits.TrailingZeros64(ip.hi)
+}
@@ -0,0 +1,244 @@
+package filter
+
+import (
+	"errors"
+	"math/rand"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCIDRs(t *testing.T) {
+	for filter, expect := range map[string]string{
+		"10":                          "10.0.0.0/8",
+		"10 or 10.1.2.3":              "10.0.0.0/8",
+		"10.0.0.0/9 or 10.128.0.0/16": "10.0.0.0/9 10.128.0.0/16",
+		"10 and not 10.1": "10.0.0.0/16 10.2.0.0/15 10.4.0.0/14 10.8.0.0/13 10.16.0.0/12 10.32.0.0/11 " +
+			"10.64.0.0/10 10.128.0.0/9",
+		"not 0.0.0.0/1":               "128.0.0.0/1 ::/0",
+		"::/0":                        "::/0",
+		"::/0 or 0.0.0.0/0":           "0.0.0.0/0 ::/0",
+		"::/0 and not ::/1":           "8000::/1",
+		"::/81":                       "::/81",
+		"::/0 and not 8000::/2":       "::/1 c000::/2",
+		"::/80 and not ::ffff:0:0/96": "::/80",
+		"::ffff:0:0/96":               "0.0.0.0/0",
+		"::fffe:0:0/95":               "::fffe:0:0/96",
+		"::fffe:0:0/95 or 10":         "10.0.0.0/8 ::fffe:0:0/96",
+		"::/80 and not ::/81":         "::8000:0:0/81",
+		"::/80 and not ::/82":         "::4000:0:0/82 ::8000:0:0/81",
+		"port 80":                     "",
+		"not port 80":                 "0.0.0.0/0 ::/0",
+	} {
+		f := FilterT{}
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		prefixes, err := f.CIDRs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, p := range prefixes {
+			got = append(got, p.String())
+		}
+		if strings.Join(got, " ") != expect {
+			t.Errorf("CIDRs of %q: expect %q, got %q", filter, expect, strings.Join(got, " "))
+		}
+	}
+
+	f := FilterT{}
+	if err := f.Compile("10.*.3.* or 11"); err != nil {
+		t.Fatal(err)
+	}
+	prefixes, err := f.CIDRs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefixes) != 257 || prefixes[0].String() != "10.0.3.0/24" || prefixes[1].String() != "10.1.3.0/24" ||
+		prefixes[255].String() != "10.255.3.0/24" || prefixes[256].String() != "11.0.0.0/8" {
+		t.Errorf("CIDRs of 10.*.3.*: unexpected %v", prefixes)
+	}
+	if err := f.Compile("10.0.0.1 mask 255.255.0.255 and not 10.0.5.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if prefixes, err := f.CIDRs(); err != nil || len(prefixes) != 255 || prefixes[0].String() != "10.0.0.1/32" {
+		t.Errorf("CIDRs of a mask of holes: unexpected %v, %v", prefixes, err)
+	}
+	if err := f.Compile("2001:db8::1 mask ffff:ffff::ffff or 10.*.*.*"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.CIDRs(); !errors.Is(err, ErrNotPrefix) {
+		t.Errorf("expect ErrNotPrefix, got %v", err)
+	}
+
+	f = FilterT{}
+	if _, err := f.CIDRs(); !errors.Is(err, ErrNotCompiled) {
+		t.Errorf("expect ErrNotCompiled, got %v", err)
+	}
+	if _, err := f.Ranges(); !errors.Is(err, ErrNotCompiled) {
+		t.Errorf("expect ErrNotCompiled, got %v", err)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	f := FilterT{}
+	if err := f.Compile("(10 and not 10.1) or (::/1 and not ::ffff:0:0/96) or 2001:db8::/32"); err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := f.Ranges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []AddrRange{
+		{netip.MustParseAddr("10.0.0.0"), netip.MustParseAddr("10.0.255.255")},
+		{netip.MustParseAddr("10.2.0.0"), netip.MustParseAddr("10.255.255.255")},
+		{netip.MustParseAddr("::"), netip.MustParseAddr("7fff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")},
+	}
+	if !reflect.DeepEqual(ranges, expect) {
+		t.Errorf("expect %v, got %v", expect, ranges)
+	}
+}
+
+func TestCIDRsRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	probes := tableProbes(r)
+	for n := 0; n < 300; n++ {
+		filter := randomFilter(r, 4)
+		f := FilterT{}
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(filter, err)
+		}
+		prefixes, err := f.CIDRs()
+		if err != nil {
+			t.Fatal(filter, err)
+		}
+		// the hosts of the prefixes, as a filter of them matches them, must
+		// be disjoint and be the hosts of the filter
+		var hosts []rangeT
+		for _, p := range prefixes {
+			ranges, ok := cidrRanges(cidrFromPrefix(p), nil)
+			if !ok || p != p.Masked() {
+				t.Fatalf("CIDRs of %q: bad prefix %s", filter, p)
+			}
+			hosts = append(hosts, ranges...)
+		}
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i].lo.less(hosts[j].lo) })
+		for i := 1; i < len(hosts); i++ {
+			if !hosts[i-1].hi.less(hosts[i].lo) {
+				t.Fatalf("CIDRs of %q: %v overlap", filter, prefixes)
+			}
+		}
+		if !reflect.DeepEqual(unionRanges(hosts), f.table.ranges) {
+			t.Fatalf("CIDRs of %q: %v are not its hosts", filter, prefixes)
+		}
+		for _, ip := range probes {
+			addr := HostT{ip: ip}.Addr()
+			in := false
+			for _, p := range prefixes {
+				in = in || p.Contains(addr)
+			}
+			if in != f.CheckAddr(addr) {
+				t.Fatalf("CIDRs of %q: %s, expect %v", filter, addr, f.CheckAddr(addr))
+			}
+		}
+
+		ranges, err := f.Ranges()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ip := range probes {
+			addr := HostT{ip: ip}.Addr()
+			in := false
+			for _, r := range ranges {
+				in = in || (r.First.BitLen() == addr.BitLen() && r.First.Compare(addr) <= 0 && addr.Compare(r.Last) <= 0)
+			}
+			if in != f.CheckAddr(addr) {
+				t.Fatalf("Ranges of %q: %s, expect %v", filter, addr, f.CheckAddr(addr))
+			}
+		}
+	}
+}
+
+func TestEquivalent(t *testing.T) {
+	for _, c := range []struct {
+		a, b                       string
+		equivalent, subset, common bool
+	}{
+		{"10", "10.0.0.0/9 or 10.128.0.0/9", true, true, true},
+		{"10 and not 10.1", "10", false, true, true},
+		{"10", "10 and not 10.1", false, false, true},
+		{"10", "11", false, false, false},
+		{"::/0", "not 0.0.0.0/0", true, true, true},
+		{"::/0", "0.0.0.0/0", false, false, false},
+		{"port 80", "10 and not 10", true, true, false},
+		{"not port 80", "::/0 or 0.0.0.0/0", true, true, true},
+		{"10.*.3.*", "10.0.3.0 wildcard 0.255.0.255", true, true, true},
+		{"10.*.3.* and 10.5", "10.5.3.0/24", true, true, true},
+		{"10.*.3.*", "10.0.0.0/16", false, false, true},
+		{"10.*.3.*", "10 and not 10.*.4.*", false, true, true},
+		{"10.*.3.1", "11.*.3.1 or 10.0.0.0/16", false, false, true},
+	} {
+		f, g := FilterT{}, FilterT{}
+		if err := f.Compile(c.a); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Compile(c.b); err != nil {
+			t.Fatal(err)
+		}
+		equivalent, addr, err := f.Equivalent(&g)
+		if err != nil || equivalent != c.equivalent || (!equivalent && f.CheckAddr(addr) == g.CheckAddr(addr)) {
+			t.Errorf("Equivalent(%q, %q) = %v, %s, %v", c.a, c.b, equivalent, addr, err)
+		}
+		subset, addr, err := f.Subset(&g)
+		if err != nil || subset != c.subset || (!subset && (!f.CheckAddr(addr) || g.CheckAddr(addr))) {
+			t.Errorf("Subset(%q, %q) = %v, %s, %v", c.a, c.b, subset, addr, err)
+		}
+		common, addr, err := f.Intersects(&g)
+		if err != nil || common != c.common || common != addr.IsValid() || (common && (!f.CheckAddr(addr) || !g.CheckAddr(addr))) {
+			t.Errorf("Intersects(%q, %q) = %v, %s, %v", c.a, c.b, common, addr, err)
+		}
+	}
+
+	f, g := FilterT{}, FilterT{}
+	if err := g.Compile("10"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := f.Equivalent(&g); !errors.Is(err, ErrNotCompiled) {
+		t.Errorf("expect ErrNotCompiled, got %v", err)
+	}
+	if _, _, err := g.Subset(&f); !errors.Is(err, ErrNotCompiled) {
+		t.Errorf("expect ErrNotCompiled, got %v", err)
+	}
+}
+
+func TestEquivalentRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+	probes := tableProbes(r)
+	for n := 0; n < 300; n++ {
+		a, b := randomFilter(r, 3), randomFilter(r, 3)
+		f, g := FilterT{}, FilterT{}
+		if err := f.Compile(a); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Compile(b); err != nil {
+			t.Fatal(err)
+		}
+		equivalent, diff, _ := f.Equivalent(&g)
+		subset, missing, _ := f.Subset(&g)
+		common, both, _ := f.Intersects(&g)
+		if !equivalent && f.CheckAddr(diff) == g.CheckAddr(diff) || !subset && (!f.CheckAddr(missing) || g.CheckAddr(missing)) ||
+			common && (!f.CheckAddr(both) || !g.CheckAddr(both)) {
+			t.Fatalf("%q, %q: bad counterexample %s, %s, %s", a, b, diff, missing, both)
+		}
+		for _, ip := range probes {
+			addr := HostT{ip: ip}.Addr()
+			x, y := f.CheckAddr(addr), g.CheckAddr(addr)
+			if equivalent && x != y || subset && x && !y || !common && x && y {
+				t.Fatalf("%q, %q: %v, %v, %v, but %s", a, b, equivalent, subset, common, addr)
+			}
+		}
+	}
+}
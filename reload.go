@@ -0,0 +1,199 @@
+package filter
+
+import (
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const reload_events_len = 16
+
+// ReloadEventT reports a reload of the source of a ReloaderT at Time. Filter
+// is the new filter, or nil if Err is the error compiling the source, and the
+// previous filter is kept.
+type ReloadEventT struct {
+	Time   time.Time
+	Filter *FilterT
+	Err    error
+}
+
+// ReloaderT holds the filter of a source file, as CompileFile reads it, and
+// compiles it again on Reload or when Watch sees the file or a file it
+// includes change. The filter is swapped atomically, a check in flight
+// goes on with the filter it started with, and a source which does not
+// compile leaves the filter as it was. A ReloaderT is safe for concurrent
+// use.
+type ReloaderT struct {
+	name   string
+	env    *EnvT
+	mode   HostMode
+	filter atomic.Pointer[FilterT]
+	err    atomic.Pointer[error]
+	events chan ReloadEventT
+
+	mu     sync.Mutex           // serializes the reloads
+	stats  map[string]fileStatT // the files of the source before they were read
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// fileStatT is what Watch compares to see a file change
+type fileStatT struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+// NewReloader compiles the source file name with the names of env, reading
+// its ipv4 addresses in mode, and returns a ReloaderT holding the filter, or
+// the error if it does not compile.
+func NewReloader(name string, env *EnvT, mode HostMode) (*ReloaderT, error) {
+	r := &ReloaderT{name: name, env: env, mode: mode, events: make(chan ReloadEventT, reload_events_len)}
+	f := &FilterT{Mode: mode}
+	stats, err := f.compileFile(name, env)
+	if err != nil {
+		return nil, err
+	}
+	r.filter.Store(f)
+	r.stats = stats
+	return r, nil
+}
+
+// Filter returns the filter held now, which is never compiled again, it must
+// not be compiled or optimized by the caller either.
+func (r *ReloaderT) Filter() *FilterT {
+	return r.filter.Load()
+}
+
+// Err returns the error of the last reload, or nil if it succeeded.
+func (r *ReloaderT) Err() error {
+	if err := r.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// Events returns the channel of the events of the reloads. An event is
+// dropped if the channel is full, and the channel is closed by Close.
+func (r *ReloaderT) Events() <-chan ReloadEventT {
+	return r.events
+}
+
+func (r *ReloaderT) Check(ip int) bool {
+	return r.Filter().Check(ip)
+}
+
+func (r *ReloaderT) CheckHost(host HostT) bool {
+	return r.Filter().CheckHost(host)
+}
+
+func (r *ReloaderT) CheckAddr(addr netip.Addr) bool {
+	return r.Filter().CheckAddr(addr)
+}
+
+func (r *ReloaderT) CheckConn(conn ConnT) bool {
+	return r.Filter().CheckConn(conn)
+}
+
+// Reload compiles the source again and swaps the filter for the new one. On
+// error the filter is kept and the error is returned, and reported by Err
+// and an event as the success is.
+func (r *ReloaderT) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reload()
+}
+
+// reload is Reload with mu locked
+func (r *ReloaderT) reload() error {
+	f := &FilterT{Mode: r.mode}
+	stats, err := f.compileFile(r.name, r.env)
+	r.stats = stats
+	r.err.Store(&err)
+	event := ReloadEventT{Time: time.Now(), Err: err}
+	if err == nil {
+		r.filter.Store(f)
+		event.Filter = f
+	}
+	if !r.closed {
+		select {
+		case r.events <- event:
+		default:
+		}
+	}
+	return err
+}
+
+// Watch polls the source and the files it includes every interval, and
+// reloads it when one of them changes, until Close. Watch does nothing if
+// the source is already watched.
+func (r *ReloaderT) Watch(interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil || r.closed {
+		return
+	}
+	r.stop, r.done = make(chan struct{}), make(chan struct{})
+	go r.watch(interval, r.stop, r.done)
+}
+
+func (r *ReloaderT) watch(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		if r.changed() {
+			r.reload()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// changed reports whether a file of the source changed since it was read
+func (r *ReloaderT) changed() bool {
+	for name, stat := range r.stats {
+		if statFile(name) != stat {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops watching the source and closes the channel of the events, the
+// filter is kept.
+func (r *ReloaderT) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	stop, done := r.stop, r.done
+	r.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	close(r.events)
+}
+
+func statFile(name string) fileStatT {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileStatT{}
+	}
+	return statOf(info)
+}
+
+func statOf(info os.FileInfo) fileStatT {
+	return fileStatT{modTime: info.ModTime(), size: info.Size(), exists: true}
+}
@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// touchSource writes the file name with content, dated after its last
+// write, for a poll to see the change
+func touchSource(t *testing.T, name, content string, at time.Time) {
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := writeSources(t, map[string]string{"acl.filter": "10.0.0.0/8\n"})
+	name := filepath.Join(dir, "acl.filter")
+	r, err := NewReloader(name, nil, HostDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	addr := netip.MustParseAddr("10.1.1.1")
+	if !r.CheckAddr(addr) || r.Err() != nil {
+		t.Fatal("expect the filter of the source")
+	}
+	if r.changed() {
+		t.Error("expect the source unchanged since it was read")
+	}
+	touchSource(t, name, "10.0.0.0/8\n", time.Now().Add(-time.Hour))
+	if !r.changed() {
+		t.Error("expect a change of the source seen")
+	}
+
+	touchSource(t, name, "10.0.0.0/8 and\n", time.Now())
+	old := r.Filter()
+	err = r.Reload()
+	var srcErr *SourceError
+	if !errors.As(err, &srcErr) || srcErr.Line != 1 || !errors.Is(r.Err(), ErrNoValues) {
+		t.Fatalf("expect the error of the source, got %v", err)
+	}
+	if r.Filter() != old || !r.CheckAddr(addr) {
+		t.Error("expect the filter kept on error")
+	}
+	if event := <-r.Events(); event.Err != err || event.Filter != nil {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	touchSource(t, name, "192.168.0.0/16\n", time.Now())
+	if err := r.Reload(); err != nil || r.Err() != nil {
+		t.Fatal(err)
+	}
+	if r.CheckAddr(addr) || !r.CheckAddr(netip.MustParseAddr("192.168.1.1")) {
+		t.Error("expect the filter swapped")
+	}
+	if event := <-r.Events(); event.Err != nil || event.Filter != r.Filter() {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if !old.CheckAddr(addr) {
+		t.Error("expect the old filter unchanged")
+	}
+
+	if _, err := NewReloader(filepath.Join(dir, "none.filter"), nil, HostDefault); err == nil {
+		t.Error("expect an error of a missing source")
+	}
+	touchSource(t, name, "10.0.0.010\n", time.Now())
+	if _, err := NewReloader(name, nil, HostStrict); !errors.Is(err, ErrLeadingZero) {
+		t.Errorf("expect ErrLeadingZero, got %v", err)
+	}
+}
+
+func TestReloaderWatch(t *testing.T) {
+	dir := writeSources(t, map[string]string{
+		"acl.filter": "include \"lab.filter\"\n",
+		"lab.filter": "10.0.0.0/8\n",
+	})
+	r, err := NewReloader(filepath.Join(dir, "acl.filter"), nil, HostDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Watch(time.Millisecond)
+	r.Watch(time.Millisecond)
+
+	// checks go on while the filter is swapped
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					r.Check(0x0a000001)
+				}
+			}
+		}()
+	}
+
+	next := func() ReloadEventT {
+		select {
+		case event := <-r.Events():
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reload seen")
+		}
+		return ReloadEventT{}
+	}
+	at := time.Now().Add(time.Hour)
+	touchSource(t, filepath.Join(dir, "lab.filter"), "10.0.0.0/8 or\n", at)
+	if event := next(); !errors.Is(event.Err, ErrNoValues) || !r.Check(0x0a000001) {
+		t.Errorf("expect the error of the included file, got %+v", event)
+	}
+	touchSource(t, filepath.Join(dir, "lab.filter"), "172.16.0.0/12\n", at.Add(time.Hour))
+	if event := next(); event.Err != nil || r.Check(0x0a000001) || !r.Check(0xac100001) {
+		t.Errorf("expect the filter of the included file, got %+v", event)
+	}
+	close(stop)
+	wg.Wait()
+
+	r.Close()
+	r.Close()
+	if _, ok := <-r.Events(); ok {
+		t.Error("expect the events closed")
+	}
+	if err := r.Reload(); err != nil || !r.Check(0xac100001) {
+		t.Errorf("expect a reload after Close, got %v", err)
+	}
+}
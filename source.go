@@ -0,0 +1,269 @@
+package filter
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	include_keyword       = "include"
+	comment_char          = '#'
+	continue_char         = '\\'
+	err_msg_include       = "malformed include, must be include \"file\""
+	err_msg_include_cycle = "include cycle"
+)
+
+var (
+	ErrInclude      = errors.New(err_msg_include)
+	ErrIncludeCycle = errors.New(err_msg_include_cycle)
+)
+
+// SourceError records an error of a filter source at Line and Col of File,
+// both counted from 1, the column in bytes. Err is the *ParseError of the
+// filter, whose Pos is in the filter the source is compiled to, or the error
+// of an include.
+type SourceError struct {
+	File string
+	Line int
+	Col  int
+	Err  error
+}
+
+func (e *SourceError) Error() string {
+	msg := e.Err.Error()
+	var parseErr *ParseError
+	if errors.As(e.Err, &parseErr) {
+		msg = "[" + strconv.FormatInt(int64(parseErr.Code), 10) + "] "
+		if parseErr.Token != "" {
+			msg += "token \"" + parseErr.Token + "\", "
+		}
+		msg += parseErr.Msg
+	}
+	return e.File + ":" + strconv.Itoa(e.Line) + ":" + strconv.Itoa(e.Col) + ": " + msg
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// placeT is a place in the files of a source
+type placeT struct {
+	file      string
+	line, col int
+}
+
+// sourceT is a source flattened to one filter, at is the place of each
+// byte of filter, end the place after the last rule and files the files it
+// is read from, as they were before they were read
+type sourceT struct {
+	filter string
+	at     []placeT
+	end    placeT
+	files  map[string]fileStatT
+}
+
+// CompileFile compiles the filter source of the file name, see
+// CompileReader.
+func (f *FilterT) CompileFile(name string) error {
+	return f.CompileFileEnv(name, nil)
+}
+
+// CompileFileEnv compiles the filter source of the file name as
+// CompileFile does, with the names of env.
+func (f *FilterT) CompileFileEnv(name string, env *EnvT) error {
+	_, err := f.compileFile(name, env)
+	return err
+}
+
+// compileFile compiles the source of the file name, and returns the files
+// it is read from, the files read until the error if it fails
+func (f *FilterT) compileFile(name string, env *EnvT) (map[string]fileStatT, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return map[string]fileStatT{name: {}}, err
+	}
+	defer file.Close()
+	return f.compileReader(file, name, env)
+}
+
+// CompileReader compiles the filter source read from r, named name in
+// errors. A source is a list of rules, one per line, and matches a host if
+// any rule does, as if the rules were bracketed and or-ed. A # starts a
+// comment up to the end of the line, but not in the quoted file of an
+// include, a line ending with \ is continued on the next one and blank
+// lines are skipped. A line
+//
+//	include "other.filter"
+//
+// is a rule matching what the rules of the source other.filter match, the
+// file is relative to the directory of name, and a source including itself
+// is an error. A failure is a *SourceError with the file, line and column of
+// the error. The filter is not replaced on error, GetFilter returns the
+// filter the source is flattened to.
+func (f *FilterT) CompileReader(r io.Reader, name string) error {
+	return f.CompileReaderEnv(r, name, nil)
+}
+
+// CompileReaderEnv compiles the filter source read from r as CompileReader
+// does, with the names of env.
+func (f *FilterT) CompileReaderEnv(r io.Reader, name string, env *EnvT) error {
+	_, err := f.compileReader(r, name, env)
+	return err
+}
+
+// compileReader compiles the source read from r as compileFile does
+func (f *FilterT) compileReader(r io.Reader, name string, env *EnvT) (map[string]fileStatT, error) {
+	src := &sourceT{end: placeT{file: name, line: 1, col: 1}, files: map[string]fileStatT{}}
+	if err := src.read(r, name, nil); err != nil {
+		return src.files, err
+	}
+	if err := f.CompileEnv(src.filter, env); err != nil {
+		return src.files, src.errorOf(err)
+	}
+	return src.files, nil
+}
+
+// read appends the rules of the source r named name, or-ed, to the filter,
+// including are the files being included, for a cycle is an error
+func (src *sourceT) read(r io.Reader, name string, including []string) error {
+	// a file is stated before it is read, for a change while it is read is
+	// seen as a change by a ReloaderT
+	src.files[name] = fileStatT{}
+	if file, ok := r.(*os.File); ok {
+		if info, err := file.Stat(); err == nil {
+			src.files[name] = statOf(info)
+		}
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	including = append(including[:len(including):len(including)], sourceKey(name))
+
+	lines := strings.Split(string(content), "\n")
+	for i := 0; i < len(lines); i++ {
+		// the logical line of the rule, with the place of each byte
+		var rule []byte
+		var at []placeT
+		for ; i < len(lines); i++ {
+			line := stripComment(lines[i])
+			line = strings.TrimRight(line, " \t\r")
+			continued := strings.HasSuffix(line, string(continue_char))
+			if continued {
+				line = line[:len(line)-1] + " "
+			}
+			for k := 0; k < len(line); k++ {
+				rule = append(rule, line[k])
+				at = append(at, placeT{file: name, line: i + 1, col: k + 1})
+			}
+			if !continued {
+				break
+			}
+		}
+		first := strings.IndexFunc(string(rule), func(c rune) bool { return !isSpace(byte(c)) })
+		if first < 0 {
+			continue
+		}
+		rest, ok := strings.CutPrefix(string(rule[first:]), include_keyword)
+		if ok && (rest == "" || isSpace(rest[0]) || rest[0] == '"') {
+			if err := src.include(strings.TrimSpace(rest), name, at[first], including); err != nil {
+				return err
+			}
+			continue
+		}
+		last := at[len(at)-1]
+		src.appendRule(string(rule), at, placeT{file: name, line: last.line, col: last.col + 1})
+	}
+	return nil
+}
+
+// include appends the rules of the file quoted in an include directive at
+// place of the source name, bracketed as one rule
+func (src *sourceT) include(quoted, name string, place placeT, including []string) error {
+	file, err := strconv.Unquote(quoted)
+	if err != nil || quoted[0] != '"' || file == "" {
+		return &SourceError{File: place.file, Line: place.line, Col: place.col, Err: ErrInclude}
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(name), file)
+	}
+	for _, key := range including {
+		if key == sourceKey(file) {
+			return &SourceError{File: place.file, Line: place.line, Col: place.col, Err: ErrIncludeCycle}
+		}
+	}
+	r, err := os.Open(file)
+	if err != nil {
+		src.files[file] = fileStatT{}
+		return &SourceError{File: place.file, Line: place.line, Col: place.col, Err: err}
+	}
+	defer r.Close()
+
+	included := &sourceT{files: src.files}
+	err = included.read(r, file, including)
+	if err != nil {
+		return err
+	}
+	if included.filter != "" {
+		src.appendRule(included.filter, included.at, included.end)
+	}
+	return nil
+}
+
+// appendRule or-s the rule with the place of each byte at, and after the
+// place after it, to the filter, an added bracket or operator is at the
+// place of the byte next to it
+func (src *sourceT) appendRule(rule string, at []placeT, after placeT) {
+	if src.filter != "" {
+		src.filter += " or "
+		src.at = append(src.at, src.end, src.end, src.end, src.end)
+	}
+	src.filter += "(" + rule + ")"
+	src.at = append(src.at, at[0])
+	src.at = append(src.at, at...)
+	src.at = append(src.at, after)
+	src.end = after
+}
+
+// errorOf returns err of the filter at the place in the source of its
+// position, or after the last rule if it is not about a token
+func (src *sourceT) errorOf(err error) error {
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		return err
+	}
+	place := src.end
+	if parseErr.Pos >= 0 && parseErr.Pos < len(src.at) {
+		place = src.at[parseErr.Pos]
+	}
+	return &SourceError{File: place.file, Line: place.line, Col: place.col, Err: err}
+}
+
+// stripComment strips the comment of line, a # in a quoted string, as the
+// file of an include may have, does not start one
+func stripComment(line string) string {
+	quoted := false
+	for k := 0; k < len(line); k++ {
+		switch {
+		case quoted && line[k] == '\\':
+			k++
+		case line[k] == '"':
+			quoted = !quoted
+		case !quoted && line[k] == comment_char:
+			return line[:k]
+		}
+	}
+	return line
+}
+
+// sourceKey returns the key of the file name to detect include cycles
+func sourceKey(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return filepath.Clean(name)
+}
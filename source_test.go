@@ -0,0 +1,125 @@
+package filter
+
+import (
+	"errors"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSources(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCompileFile(t *testing.T) {
+	dir := writeSources(t, map[string]string{
+		"main.filter": "# office networks\n" +
+			"10.1.0.0/16   # first floor\n" +
+			"\n" +
+			"src 10.2.0.0/16 and \\\n" +
+			"    port 80\r\n" +
+			"include \"lists/lab.filter\"\n" +
+			"  include \"empty.filter\"\n" +
+			"include \"#7 \\\"dmz\\\".filter\" # rack #7\n",
+		"#7 \"dmz\".filter": "203.0.113.0/24 # dmz\n",
+		"lists/lab.filter":  "192.168.1.0/24\ninclude \"../more.filter\"\n",
+		"more.filter":       "172.16.0.0/12 and not 172.16.5.0/24",
+		"empty.filter":      "# nothing yet\n\n",
+	})
+	f := FilterT{}
+	if err := f.CompileFile(filepath.Join(dir, "main.filter")); err != nil {
+		t.Fatal(err)
+	}
+	expect := "(10.1.0.0/16) or (src 10.2.0.0/16 and      port 80) or " +
+		"((192.168.1.0/24) or ((172.16.0.0/12 and not 172.16.5.0/24))) or ((203.0.113.0/24))"
+	if f.GetFilter() != expect {
+		t.Errorf("GetFilter: expected %q, got %q", expect, f.GetFilter())
+	}
+	for host, match := range map[string]bool{
+		"10.1.2.3": true, "192.168.1.9": true, "203.0.113.9": true, "172.16.1.1": true, "172.16.5.1": false, "10.3.0.1": false,
+	} {
+		ip, _ := ParseHost(host)
+		if f.Check(ip) != match {
+			t.Errorf("Check(%s): expected %v", host, match)
+		}
+	}
+
+	g := FilterT{}
+	if err := g.CompileReaderEnv(strings.NewReader("@lab\n$web"), "rules", &EnvT{
+		Sets:   map[string][]netip.Prefix{"lab": prefixes("10.9.0.0/16")},
+		Macros: map[string]string{"web": "10.8.0.0/16 and port 80"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := ParseHost("10.9.1.1"); !g.Check(ip) {
+		t.Error("expect a match of the set")
+	}
+}
+
+func TestFailCompileFile(t *testing.T) {
+	dir := writeSources(t, map[string]string{
+		"bad.filter":        "10.0.0.0/8\n\n  src 10.0.0.300 # typo\n",
+		"open.filter":       "10.0.0.0/8 and \\\n  (11 or\n",
+		"incomplete.filter": "10.0.0.0/8 or\n# the end\n",
+		"nested.filter":     "10\ninclude \"bad.filter\"\n",
+		"cycle.filter":      "10\ninclude \"loop.filter\"\n",
+		"loop.filter":       "11\n include \"cycle.filter\"\n",
+		"self.filter":       "include \"./self.filter\"",
+		"missing.filter":    "10\ninclude \"none.filter\"",
+		"quote.filter":      "include other.filter",
+		"blank.filter":      "# only comments\n",
+	})
+	for name, c := range map[string]struct {
+		file      string
+		line, col int
+		err       error
+		msg       string
+	}{
+		"bad.filter":        {"bad.filter", 3, 7, ErrIPDomain, "[1008] token \"CIDR\", ip domain must be 0~255"},
+		"open.filter":       {"open.filter", 2, 7, ErrNoValues, ""},
+		"incomplete.filter": {"incomplete.filter", 1, 12, ErrNoValues, "[1001] token \"or\", no values"},
+		"nested.filter":     {"bad.filter", 3, 7, ErrIPDomain, ""},
+		"cycle.filter":      {"loop.filter", 2, 2, ErrIncludeCycle, "include cycle"},
+		"self.filter":       {"self.filter", 1, 1, ErrIncludeCycle, ""},
+		"missing.filter":    {"missing.filter", 2, 1, fs.ErrNotExist, ""},
+		"quote.filter":      {"quote.filter", 1, 1, ErrInclude, ""},
+		"blank.filter":      {"blank.filter", 1, 1, ErrFilter, ""},
+	} {
+		f := FilterT{}
+		if err := f.Compile("10"); err != nil {
+			t.Fatal(err)
+		}
+		err := f.CompileFile(filepath.Join(dir, name))
+		var srcErr *SourceError
+		if !errors.As(err, &srcErr) || !errors.Is(err, c.err) {
+			t.Errorf("CompileFile(%s): expected %q, got %v", name, c.err, err)
+			continue
+		}
+		if filepath.Base(srcErr.File) != c.file || srcErr.Line != c.line || srcErr.Col != c.col {
+			t.Errorf("CompileFile(%s): expected %s:%d:%d, got %s", name, c.file, c.line, c.col, err)
+		}
+		expect := filepath.Join(dir, c.file) + ":"
+		if !strings.HasPrefix(err.Error(), expect) || c.msg != "" && !strings.HasSuffix(err.Error(), ": "+c.msg) {
+			t.Errorf("CompileFile(%s): unexpected error message %q", name, err.Error())
+		}
+		if f.GetFilter() != "10" {
+			t.Errorf("CompileFile(%s): the filter is replaced on error", name)
+		}
+	}
+	if err := (&FilterT{}).CompileFile(filepath.Join(dir, "none.filter")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expect fs.ErrNotExist, got %v", err)
+	}
+}
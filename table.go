@@ -0,0 +1,248 @@
+package filter
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// rangeT is an inclusive range of addresses
+type rangeT struct {
+	lo ipT
+	hi ipT
+}
+
+// tableT is the set of hosts a filter matches, as sorted, disjoint and
+// non-adjacent ranges, so a host is checked with a binary search instead of
+// walking the rpn
+type tableT struct {
+	ranges []rangeT
+}
+
+var (
+	ip_min    = ipT{}
+	ip_max    = ipT{hi: ^uint64(0), lo: ^uint64(0)}
+	v4_mapped = rangeT{lo: ipT{lo: v4_mapped_prefix << 32}, hi: ipT{lo: v4_mapped_prefix<<32 | 0xffffffff}}
+)
+
+func (ip ipT) less(other ipT) bool {
+	return ip.hi < other.hi || (ip.hi == other.hi && ip.lo < other.lo)
+}
+
+func (ip ipT) next() ipT {
+	if ip.lo == ^uint64(0) {
+		return ipT{hi: ip.hi + 1}
+	}
+	return ipT{hi: ip.hi, lo: ip.lo + 1}
+}
+
+func (ip ipT) prev() ipT {
+	if ip.lo == 0 {
+		return ipT{hi: ip.hi - 1, lo: ^uint64(0)}
+	}
+	return ipT{hi: ip.hi, lo: ip.lo - 1}
+}
+
+// max_mask_ranges is the most ranges the masks of a filter which are not
+// prefix masks are expanded to in all, a filter of more has no table and is
+// checked by walking its rpn
+const max_mask_ranges = 1 << 16
+
+// newTable builds the table of the hosts matched by rpn, as check does, it
+// fails if its masks which are not prefix masks are too many ranges
+func newTable(rpn []tokenT) (*tableT, bool) {
+	if len(rpn) == 0 {
+		return nil, false
+	}
+	budget := max_mask_ranges
+	ranges, ok := hostRanges(toExpr(rpn), &budget)
+	if !ok {
+		return nil, false
+	}
+	return &tableT{ranges: ranges}, true
+}
+
+func (t *tableT) contains(ip ipT) bool {
+	i := sort.Search(len(t.ranges), func(i int) bool {
+		return ip.less(t.ranges[i].lo)
+	})
+	return i > 0 && !t.ranges[i-1].hi.less(ip)
+}
+
+// hostRanges returns the hosts matched by e, a port or protocol value never
+// matches a host, the ranges of its masks are taken out of budget
+func hostRanges(e *exprT, budget *int) ([]rangeT, bool) {
+	switch e.token.t {
+	case token_or:
+		var all []rangeT
+		for _, operand := range operands(e) {
+			ranges, ok := hostRanges(operand, budget)
+			if !ok {
+				return nil, false
+			}
+			all = append(all, ranges...)
+		}
+		return unionRanges(all), true
+	case token_and:
+		var all []rangeT
+		for i, operand := range operands(e) {
+			ranges, ok := hostRanges(operand, budget)
+			if !ok {
+				return nil, false
+			}
+			if i == 0 {
+				all = ranges
+			} else {
+				all = intersectRanges(all, ranges)
+			}
+		}
+		return all, true
+	case token_not:
+		ranges, ok := hostRanges(e.x, budget)
+		if !ok {
+			return nil, false
+		}
+		return complementRanges(ranges), true
+	}
+	switch e.token.kind {
+	case kind_port, kind_portrange, kind_proto, kind_proto4, kind_proto6:
+		return nil, true
+	}
+	return cidrRanges(e.token.cidr, budget)
+}
+
+// operands flattens a chain of the same operator, as a long list of cidrs
+// or-ed together is, into its operands
+func operands(e *exprT) []*exprT {
+	var list []*exprT
+	stack := []*exprT{e}
+	for len(stack) != 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if top.token.t == e.token.t {
+			stack = append(stack, top.y, top.x)
+		} else {
+			list = append(list, top)
+		}
+	}
+	return list
+}
+
+// cidrRanges returns the hosts in cidr as checkIn matches them, a cidr
+// without an ipv4 mask, or an ipv6 range, never matches a v4-mapped host.
+// It fails if the mask is not a prefix mask and its ranges are more than
+// what is left of budget, a nil budget is max_mask_ranges.
+func cidrRanges(cidr cidrT, budget *int) ([]rangeT, bool) {
+	if cidr.isRange {
+		r := []rangeT{{lo: cidr.ip, hi: cidr.last}}
+		if cidr.ip.isV4() {
+			return r, true
+		}
+		return intersectRanges(r, complementRanges([]rangeT{v4_mapped})), true
+	}
+	r, ok := maskRanges(cidr.ip, cidr.mask, budget)
+	if !ok {
+		return nil, false
+	}
+	if isV4Mask(cidr.mask) {
+		return r, true
+	}
+	return intersectRanges(r, complementRanges([]rangeT{v4_mapped})), true
+}
+
+// maskRanges returns the sorted ranges of the hosts whose bits under mask
+// are those of ip, one for each value of the holes of the mask, the bits out
+// of it above its last bit, as 10.*.3.* is 256 ranges of 256 hosts. The
+// ranges of a mask with holes are taken out of budget before they are made.
+func maskRanges(ip, mask ipT, budget *int) ([]rangeT, bool) {
+	block := trailingZeros(mask)
+	var holes []ipT
+	for bit := block + 1; bit < 128; bit++ {
+		hole := ipT{lo: 1 << uint(bit)}
+		if bit >= 64 {
+			hole = ipT{hi: 1 << uint(bit-64)}
+		}
+		if mask.and(hole) == (ipT{}) {
+			holes = append(holes, hole)
+		}
+	}
+	if budget == nil {
+		budget = new(int)
+		*budget = max_mask_ranges
+	}
+	if len(holes) != 0 {
+		if len(holes) >= bits.Len(uint(*budget)) {
+			return nil, false
+		}
+		*budget -= 1 << uint(len(holes))
+	}
+	lo, hosts := ip.and(mask), hostMask(128-block)
+	ranges := make([]rangeT, 0, 1<<uint(len(holes)))
+	for n := 0; n < 1<<uint(len(holes)); n++ {
+		first := lo
+		for k, hole := range holes {
+			if n>>uint(k)&1 != 0 {
+				first = first.or(hole)
+			}
+		}
+		ranges = append(ranges, rangeT{lo: first, hi: first.or(hosts)})
+	}
+	return ranges, true
+}
+
+func unionRanges(ranges []rangeT) []rangeT {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].lo.less(ranges[j].lo)
+	})
+	union := []rangeT{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &union[len(union)-1]
+		if last.hi == ip_max || !last.hi.next().less(r.lo) {
+			if last.hi.less(r.hi) {
+				last.hi = r.hi
+			}
+		} else {
+			union = append(union, r)
+		}
+	}
+	return union
+}
+
+func intersectRanges(a, b []rangeT) []rangeT {
+	var ranges []rangeT
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		lo, hi := a[i].lo, a[i].hi
+		if lo.less(b[j].lo) {
+			lo = b[j].lo
+		}
+		if b[j].hi.less(hi) {
+			hi = b[j].hi
+		}
+		if !hi.less(lo) {
+			ranges = append(ranges, rangeT{lo: lo, hi: hi})
+		}
+		if a[i].hi.less(b[j].hi) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return ranges
+}
+
+func complementRanges(ranges []rangeT) []rangeT {
+	var complement []rangeT
+	lo := ip_min
+	for _, r := range ranges {
+		if lo.less(r.lo) {
+			complement = append(complement, rangeT{lo: lo, hi: r.lo.prev()})
+		}
+		if r.hi == ip_max {
+			return complement
+		}
+		lo = r.hi.next()
+	}
+	return append(complement, rangeT{lo: lo, hi: ip_max})
+}
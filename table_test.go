@@ -0,0 +1,218 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// walk checks ip with the rpn, as check does without a table
+func (f *FilterT) walk(ip ipT) bool {
+	return f.eval(&pktT{src: ip, dst: ip, hasSrc: true, hasDst: true})
+}
+
+func tableProbes(r *rand.Rand) []ipT {
+	probes := []ipT{ip_min, ip_max, v4_mapped.lo, v4_mapped.hi, v4_mapped.lo.prev(), v4_mapped.hi.next()}
+	for _, host := range []string{"10.0.0.0", "10.255.255.255", "11.0.0.0", "9.255.255.255", "192.168.1.1",
+		"172.16.0.1", "0.0.0.0", "255.255.255.255", "2001:db8::", "2001:db8::1", "2001:db9::", "2001:db7:ffff::",
+		"fe80::1", "::1", "::", "::fffe:ffff:ffff"} {
+		h, err := ParseHostT(host)
+		if err != nil {
+			panic(err)
+		}
+		probes = append(probes, h.ip, h.ip.next(), h.ip.prev())
+	}
+	for i := 0; i < 2000; i++ {
+		probes = append(probes, v4IP(int(r.Uint32())), ipT{hi: r.Uint64(), lo: r.Uint64()}, ipT{hi: 0x20010db800000000 | r.Uint64()&0xffff, lo: r.Uint64()})
+	}
+	return probes
+}
+
+func TestTable(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	probes := tableProbes(r)
+	for _, host := range []string{"10.0.3.0", "10.7.3.255", "10.7.4.0", "192.0.1.7", "192.9.1.6", "10.0.2.1",
+		"10.5.2.0", "2001:db8::f1", "2001:db8::1", "2001:db8::11"} {
+		h, _ := ParseHostT(host)
+		probes = append(probes, h.ip, h.ip.next(), h.ip.prev())
+	}
+	f := FilterT{}
+	for _, filter := range []string{
+		"10",
+		"not 10",
+		"10 or 192.168 or 172.16.0.0/12",
+		"10 and not 10.0.0.0/9",
+		"::/0",
+		"not ::/0",
+		"::/64 or 2001:db8::/32",
+		"not (::/64 or 2001:db8::/32) and not 10",
+		"0.0.0.0/0 and ::/0",
+		"::ffff:0:0/96",
+		"::ffff:0:0/95",
+		"port 80 or 10",
+		"not tcp and 10",
+		"src 10 and dst 10.1",
+		"ip proto 6 or not ip6 proto 17",
+		"host 2001:db8::1 or net 2001:db8:1::/48",
+		"10.*.3.*",
+		"10 and not 10.*.3.* or 192.*.1.7",
+		"10.1.2.3 mask 255.0.255.1",
+		"2001:db8::1 mask ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff0f",
+	} {
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		if f.table == nil {
+			t.Fatalf("filter %q: no table", filter)
+		}
+		for _, ip := range probes {
+			if expect, got := f.walk(ip), f.check(ip); expect != got {
+				t.Errorf("filter %q, %s: expect %v, got %v", filter, outputIP(ip), expect, got)
+			}
+		}
+	}
+}
+
+func TestTableBudget(t *testing.T) {
+	// each mask is 65536 ranges, together they are too many for a table
+	f := FilterT{}
+	filter := "10.*.*.1 or 11.*.*.1 or 1.2.3.4 mask 255.0.0.255"
+	if err := f.Compile(filter); err != nil {
+		t.Fatal(err)
+	}
+	if f.table != nil {
+		t.Fatalf("filter %q: expect no table", filter)
+	}
+	for host, match := range map[string]bool{
+		"10.5.6.1": true, "10.5.6.2": false, "11.0.0.1": true, "1.9.9.4": true, "1.9.9.5": false, "12.0.0.1": false,
+	} {
+		if h, _ := ParseHostT(host); f.CheckHost(h) != match {
+			t.Errorf("filter %q, %s: expect %v", filter, host, match)
+		}
+	}
+	if _, err := f.Ranges(); !errors.Is(err, ErrNotPrefix) {
+		t.Errorf("expect ErrNotPrefix, got %v", err)
+	}
+	if err := f.Compile("10.*.*.1 or 11"); err != nil || f.table == nil {
+		t.Errorf("expect a table of one mask in the budget, got %v", err)
+	}
+}
+
+func TestTableRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	probes := tableProbes(r)
+	f := FilterT{}
+	for n := 0; n < 50; n++ {
+		filter := randomFilter(r, 4)
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(filter, err)
+		}
+		for _, ip := range probes {
+			if expect, got := f.walk(ip), f.check(ip); expect != got {
+				t.Fatalf("filter %q, %s: expect %v, got %v", filter, outputIP(ip), expect, got)
+			}
+		}
+	}
+}
+
+func TestTableRanges(t *testing.T) {
+	f := FilterT{}
+	for filter, expect := range map[string]int{
+		"10 or 11 or 10.1":           1,
+		"10 or 12":                   2,
+		"not 10":                     2,
+		"::/0":                       2,
+		"::/0 or 0.0.0.0/0":          1,
+		"10 and 11":                  0,
+		"port 80":                    0,
+		"not port 80":                1,
+		"10.0.0.0/9 or 10.128.0.0/9": 1,
+		"10.*.3.*":                   256,
+		"10.*.*.*":                   1,
+		"10.*.3.* or 10.*.2.*":       256,
+	} {
+		if err := f.Compile(filter); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(f.table.ranges); got != expect {
+			t.Errorf("filter %q: expect %d ranges, got %d", filter, expect, got)
+		}
+	}
+}
+
+func randomFilter(r *rand.Rand, depth int) string {
+	if depth == 0 || r.Intn(3) == 0 {
+		switch r.Intn(6) {
+		case 0:
+			return fmt.Sprintf("%d.%d.0.0/%d", r.Intn(4)+10, r.Intn(256), r.Intn(33))
+		case 1:
+			return fmt.Sprintf("2001:db8:%x::/%d", r.Intn(4), r.Intn(129))
+		case 2:
+			return fmt.Sprintf("::/%d", r.Intn(97))
+		case 3:
+			lo := 10<<24 + r.Intn(1<<25)
+			return outputIP4(lo) + "-" + outputIP4(lo+r.Intn(1<<20))
+		case 4:
+			last := []string{"::1:0:%x:0", "::fffe:ffff:%x"}[r.Intn(2)]
+			return fmt.Sprintf("::fffe:%x:0-"+last, r.Intn(1<<16), r.Intn(1<<16))
+		default:
+			return "port 80"
+		}
+	}
+	switch r.Intn(3) {
+	case 0:
+		return "not (" + randomFilter(r, depth-1) + ")"
+	case 1:
+		return "(" + randomFilter(r, depth-1) + " and " + randomFilter(r, depth-1) + ")"
+	}
+	return "(" + randomFilter(r, depth-1) + " or " + randomFilter(r, depth-1) + ")"
+}
+
+// benchFilter ors n random ipv4 cidrs together
+func benchFilter(n int) string {
+	r := rand.New(rand.NewSource(int64(n)))
+	terms := make([]string, n)
+	for i := range terms {
+		terms[i] = fmt.Sprintf("%s/%d", outputIP4(int(r.Uint32())), 16+r.Intn(17))
+	}
+	return strings.Join(terms, " or ")
+}
+
+func benchmarkCheck(b *testing.B, n int, walk bool) {
+	f := FilterT{}
+	if err := f.Compile(benchFilter(n)); err != nil {
+		b.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(0))
+	ips := make([]ipT, 1024)
+	for i := range ips {
+		ips[i] = v4IP(int(r.Uint32()))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if walk {
+			f.walk(ips[i%len(ips)])
+		} else {
+			f.check(ips[i%len(ips)])
+		}
+	}
+}
+
+func BenchmarkCheckTable10(b *testing.B)    { benchmarkCheck(b, 10, false) }
+func BenchmarkCheckRPN10(b *testing.B)      { benchmarkCheck(b, 10, true) }
+func BenchmarkCheckTable1000(b *testing.B)  { benchmarkCheck(b, 1000, false) }
+func BenchmarkCheckRPN1000(b *testing.B)    { benchmarkCheck(b, 1000, true) }
+func BenchmarkCheckTable50000(b *testing.B) { benchmarkCheck(b, 50000, false) }
+func BenchmarkCheckRPN50000(b *testing.B)   { benchmarkCheck(b, 50000, true) }
+
+func BenchmarkCompile50000(b *testing.B) {
+	filter := benchFilter(50000)
+	for i := 0; i < b.N; i++ {
+		f := FilterT{}
+		if err := f.Compile(filter); err != nil {
+			b.Fatal(err)
+		}
+	}
+}